@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: qplugin <mode> [options]
+
+modes:
+  validate    dry-run validation of a plugins directory, no plugin code is executed
+  migrate     rewrite plugin manifests in place to the latest manifest_version
+
+run 'qplugin <mode> -h' for the options of the mode
+`)
+}
+
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	dir := flags.String("dir", ".", "plugins directory to validate")
+	namespace := flags.String("namespace", "local", "namespace of the plugins")
+	major := flags.Int("major", 1, "major version supported by the registry")
+	kinds := flags.String("kinds", "", "comma-separated plugin kinds supported by the registry")
+	hostVersion := flags.String("host-version", "", "version of the host application, to check requires.host")
+	apiLevel := flags.Int("api-level", 0, "API level of the host application, to check requires.api_level")
+	flags.Parse(args)
+
+	supportedKinds := []string{}
+	for _, kind := range strings.Split(*kinds, ",") {
+		if kind = strings.TrimSpace(kind); len(kind) > 0 {
+			supportedKinds = append(supportedKinds, kind)
+		}
+	}
+
+	fs := afero.NewOsFs()
+	registry := qplugin.NewPluginRegistry(*major, supportedKinds...)
+	if len(*hostVersion) > 0 {
+		registry.SetHostVersion(*hostVersion)
+	}
+	registry.SetApiLevel(*apiLevel)
+	report := qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, *dir, *namespace)
+
+	for _, d := range report.Diagnostics() {
+		fmt.Fprintln(os.Stderr, d.Error())
+	}
+	for _, p := range report.Plugins() {
+		if mf := p.Manifest(); mf.Outdated() {
+			path := p.Dir()
+			if qplugin.IsSingleFilePlugin(fs, p.CodeFile()) {
+				path = p.CodeFile()
+			}
+			fmt.Fprintf(os.Stderr, "%s: manifest_version %d is deprecated, run 'qplugin migrate %s'\n",
+				path, mf.MigratedFrom(), path)
+		}
+	}
+	if report.HasError() {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(report.Diagnostics()))
+		return 1
+	}
+
+	fmt.Printf("%d plugin(s) validated\n", len(report.Plugins()))
+	return 0
+}
+
+func migrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: qplugin migrate [plugin directory, manifest file or single-file plugin]...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	fs := afero.NewOsFs()
+	failed := 0
+
+	for _, path := range paths {
+		manifestFile := path
+		if isDir, err := afero.IsDir(fs, path); err == nil && isDir {
+			if manifestFile = qplugin.FindPluginManifestFile(fs, path); len(manifestFile) == 0 {
+				fmt.Fprintf(os.Stderr, "%s: no manifest found\n", path)
+				failed++
+				continue
+			}
+		}
+
+		fromVersion, err := qplugin.MigratePluginManifestFile(fs, manifestFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			failed++
+		} else if fromVersion == qplugin.PLUGIN_MANIFEST_VERSION {
+			fmt.Printf("%s: up to date\n", manifestFile)
+		} else {
+			fmt.Printf("%s: migrated from manifest_version %d to %d\n", manifestFile, fromVersion, qplugin.PLUGIN_MANIFEST_VERSION)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d manifest(s) failed to migrate\n", failed)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "validate":
+		os.Exit(validate(os.Args[2:]))
+	case "migrate":
+		os.Exit(migrate(os.Args[2:]))
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
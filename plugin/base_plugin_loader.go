@@ -5,23 +5,29 @@ import (
 	"sync"
 
 	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
 )
 
 type BasePluginLoaderT struct {
 	started   bool
 	namespace string
 	plugins   map[string]Plugin
-	mutex     sync.RWMutex
+
+	// plugins started by the last successful Start, in the order they were started
+	startedPlugins []Plugin
+
+	mutex sync.RWMutex
 }
 
 type BasePluginLoader = *BasePluginLoaderT
 
 func NewPluginLoader(namespace string) BasePluginLoader {
 	return &BasePluginLoaderT{
-		started:   false,
-		namespace: namespace,
-		plugins:   map[string]Plugin{},
-		mutex:     sync.RWMutex{},
+		started:        false,
+		namespace:      namespace,
+		plugins:        map[string]Plugin{},
+		startedPlugins: []Plugin{},
+		mutex:          sync.RWMutex{},
 	}
 }
 
@@ -29,6 +35,10 @@ func (me BasePluginLoader) Register(plugin Plugin) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
 
+	me.register(plugin)
+}
+
+func (me BasePluginLoader) register(plugin Plugin) {
 	name := plugin.Name()
 	if _, found := me.plugins[name]; found {
 		panic(fmt.Errorf("plugin %s is duplicated", PluginId(me.Namespace(), name)))
@@ -49,9 +59,39 @@ func (me BasePluginLoader) Namespace() string {
 }
 
 func (me BasePluginLoader) Plugins() map[string]Plugin {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+
 	return me.plugins
 }
 
+// Discover returns the registered plugins as candidates
+func (me BasePluginLoader) Discover(logger comm.Logger) ([]Plugin, error) {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+
+	return sortedPlugins(me.plugins), nil
+}
+
+// Accept keeps only the plugins accepted by the registry, the others won't be started
+func (me BasePluginLoader) Accept(plugins []Plugin) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	accepted := make(map[string]Plugin, len(plugins))
+	for _, plugin := range plugins {
+		accepted[plugin.Name()] = plugin
+	}
+	me.plugins = accepted
+}
+
+func (me BasePluginLoader) IsStarted() bool {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+
+	return me.started
+}
+
 func (me BasePluginLoader) Start(logger comm.Logger) error {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
@@ -61,19 +101,35 @@ func (me BasePluginLoader) Start(logger comm.Logger) error {
 		return nil
 	}
 
-	errs := comm.NewErrorGroup(false)
+	return me.startPlugins(logger)
+}
+
+// startPlugins starts the plugins in the order of their names, all or nothing: once a required plugin fails,
+// the plugins started in this pass are stopped in reverse order, so that nothing is left running and the loader
+// remains not started. Failures of optional plugins are logged only.
+func (me BasePluginLoader) startPlugins(logger comm.Logger) error {
 	ns := me.Namespace()
+	started := make([]Plugin, 0, len(me.plugins))
 
-	for _, plugin := range me.plugins {
+	for _, plugin := range sortedPlugins(me.plugins) {
 		if err := StartPlugin(ns, plugin, logger); err != nil {
+			if IsOptionalPlugin(plugin) {
+				logger.Error(err).Str("pluginId", PluginId(ns, plugin.Name())).Msg("optional plugin failed to start, ignored")
+				continue
+			}
+
+			errs := comm.NewErrorGroup(false)
 			errs.Add(err)
+			if err := stopPluginsInReverse(ns, started, logger); err != nil {
+				errs.Add(errors.Wrapf(err, "rollback plugins of namespace %s", ns))
+			}
+			return errs
 		}
-	}
 
-	if errs.HasError() {
-		return errs
+		started = append(started, plugin)
 	}
 
+	me.startedPlugins = started
 	me.started = true
 	return nil
 }
@@ -88,17 +144,21 @@ func (me BasePluginLoader) Stop(logger comm.Logger) error {
 	}
 	me.started = false
 
+	started := me.startedPlugins
+	me.startedPlugins = []Plugin{}
+
+	return stopPluginsInReverse(me.Namespace(), started, logger)
+}
+
+// stopPluginsInReverse stops the plugins in reverse order, and tries all of them even if some failed
+func stopPluginsInReverse(namespace string, plugins []Plugin, logger comm.Logger) error {
 	errs := comm.NewErrorGroup(false)
-	ns := me.Namespace()
 
-	for _, plugin := range me.plugins {
-		if err := StopPlugin(ns, plugin, logger); err != nil {
+	for i := len(plugins) - 1; i >= 0; i-- {
+		if err := StopPlugin(namespace, plugins[i], logger); err != nil {
 			errs.Add(err)
 		}
 	}
 
-	if errs.HasError() {
-		return errs
-	}
-	return nil
+	return errs.MayError()
 }
@@ -0,0 +1,114 @@
+package qplugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// ExternalDeclarativePluginContextT is a plugin without code, contributing the data declared in the contributes
+// section of its manifest, ie. templates, default config, static mappings, UI metadata. The codeFile passed to
+// Compile / Init is the plugin directory, which the files of the contributions are relative to.
+type ExternalDeclarativePluginContextT struct {
+	logger comm.Logger
+	host   HostPlugin
+
+	declarations  []PluginManifestContributionT
+	contributions []PluginContribution
+	permissions   []PluginPermission
+}
+
+type ExternalDeclarativePluginContext = *ExternalDeclarativePluginContextT
+
+func NewExternalDeclarativePluginContext(declarations []PluginManifestContributionT) ExternalDeclarativePluginContext {
+	return &ExternalDeclarativePluginContextT{
+		logger: comm.NewDiscardLogger(),
+		host:   nil,
+
+		declarations:  declarations,
+		contributions: []PluginContribution{},
+		permissions:   nil,
+	}
+}
+
+func (me ExternalDeclarativePluginContext) Permissions() []PluginPermission {
+	return me.permissions
+}
+
+// SetPermissions restricts the templates: env and expandenv read the environment of the host process only with
+// the env permission. nil means unrestricted. It affects the Compile / Init afterwards.
+func (me ExternalDeclarativePluginContext) SetPermissions(permissions []PluginPermission) {
+	me.permissions = permissions
+}
+
+func (me ExternalDeclarativePluginContext) allows(permission PluginPermission) bool {
+	return me.permissions == nil || hasPluginPermission(me.permissions, permission)
+}
+
+// loadContributions fails if any declaration is invalid, or duplicated with the same type and name
+func (me ExternalDeclarativePluginContext) loadContributions(host HostPlugin, fs afero.Fs, pluginDir string) ([]PluginContribution, error) {
+	r := make([]PluginContribution, 0, len(me.declarations))
+	errs := comm.NewErrorGroup(false)
+	names := map[string]bool{}
+
+	for i, decl := range me.declarations {
+		c, err := newPluginContribution(host, fs, pluginDir, decl, me.allows(PLUGIN_PERMISSION_ENV))
+		if err != nil {
+			errs.Add(errors.Wrapf(err, "contributes[%d]", i))
+			continue
+		}
+
+		key := c.Type() + "/" + c.Name()
+		if names[key] {
+			errs.Add(fmt.Errorf("contributes[%d]: duplicated %s contribution %s", i, c.Type(), c.Name()))
+			continue
+		}
+		names[key] = true
+
+		r = append(r, c)
+	}
+
+	if err := errs.MayError(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (me ExternalDeclarativePluginContext) Compile(fs afero.Fs, codeFile string) error {
+	_, err := me.loadContributions(nil, fs, codeFile)
+	return err
+}
+
+func (me ExternalDeclarativePluginContext) Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string) {
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("pluginDir", codeFile)
+	me.logger = logger.NewSubLogger(logCtx)
+	me.host = host
+
+	contributions, err := me.loadContributions(host, fs, codeFile)
+	if err != nil {
+		panic(err)
+	}
+	me.contributions = contributions
+}
+
+// Contributions returns the contributions in the order of declaration
+func (me ExternalDeclarativePluginContext) Contributions() []PluginContribution {
+	return me.contributions
+}
+
+func (me ExternalDeclarativePluginContext) Start(ctx context.Context) error {
+	return nil
+}
+
+func (me ExternalDeclarativePluginContext) Stop(ctx context.Context) error {
+	return nil
+}
+
+// Invoke always fails, a declarative plugin has no function
+func (me ExternalDeclarativePluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	return nil, fmt.Errorf("function not found: %s, declarative plugin has no function", funcName)
+}
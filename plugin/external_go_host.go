@@ -0,0 +1,210 @@
+package qplugin
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/traefik/yaegi/interp"
+)
+
+// HOST_PACKAGE is the import path of the built-in package for script plugins to reach the host
+const HOST_PACKAGE = "qplugin/host"
+
+// HostPlugin is what a script plugin sees of itself and the host, through the built-in qplugin/host package
+type HostPlugin interface {
+	Id() string
+	Namespace() string
+	Name() string
+	Kind() PluginKind
+	Logger() comm.Logger
+	Config() map[string]any
+	DataDir() string
+	Manifest() PluginManifest
+
+	// Lookup returns the plugin with the full plugin id, or nil if not found
+	Lookup(id string) Plugin
+
+	// ByKind returns the plugins of the kind, keyed by plugin id
+	ByKind(kind PluginKind) map[string]Plugin
+}
+
+var (
+	hostExports      = interp.Exports{}
+	hostExportsMutex sync.RWMutex
+)
+
+// RegisterHostExports adds export tables, usually generated by 'yaegi extract', for script plugins to import.
+// It affects the plugins initialized afterwards.
+func RegisterHostExports(exports interp.Exports) {
+	hostExportsMutex.Lock()
+	defer hostExportsMutex.Unlock()
+
+	for path, symbols := range exports {
+		if path == HOST_PACKAGE+"/host" {
+			panic(fmt.Errorf("package %s is reserved", HOST_PACKAGE))
+		}
+
+		existing, found := hostExports[path]
+		if !found {
+			existing = map[string]reflect.Value{}
+			hostExports[path] = existing
+		}
+		for name, symbol := range symbols {
+			existing[name] = symbol
+		}
+	}
+}
+
+// HostExports returns a copy of the export tables registered by the host
+func HostExports() interp.Exports {
+	hostExportsMutex.RLock()
+	defer hostExportsMutex.RUnlock()
+
+	r := make(interp.Exports, len(hostExports))
+	for path, symbols := range hostExports {
+		copied := make(map[string]reflect.Value, len(symbols))
+		for name, symbol := range symbols {
+			copied[name] = symbol
+		}
+		r[path] = copied
+	}
+	return r
+}
+
+// hostPackageExports builds the qplugin/host package for the plugin. The host could be nil, for example when the
+// code is compiled only, then the package is still there to type-check, but calling it panics.
+func hostPackageExports(host HostPlugin) interp.Exports {
+	current := func() HostPlugin {
+		if host == nil {
+			panic(fmt.Errorf("%s is not available", HOST_PACKAGE))
+		}
+		return host
+	}
+
+	return interp.Exports{
+		HOST_PACKAGE + "/host": {
+			"Current":  reflect.ValueOf(current),
+			"Id":       reflect.ValueOf(func() string { return current().Id() }),
+			"Logger":   reflect.ValueOf(func() comm.Logger { return current().Logger() }),
+			"Config":   reflect.ValueOf(func() map[string]any { return current().Config() }),
+			"DataDir":  reflect.ValueOf(func() string { return current().DataDir() }),
+			"Manifest": reflect.ValueOf(func() PluginManifest { return current().Manifest() }),
+			"Lookup":   reflect.ValueOf(func(id string) Plugin { return current().Lookup(id) }),
+			"ByKind":   reflect.ValueOf(func(kind PluginKind) map[string]Plugin { return current().ByKind(kind) }),
+
+			"Plugin": reflect.ValueOf((*HostPlugin)(nil)),
+		},
+	}
+}
+
+// externalPluginHostT implements HostPlugin for an external plugin. It has its own lock rather than sharing the
+// plugin's, because it is called by the plugin code while the plugin is starting or stopping.
+type externalPluginHostT struct {
+	namespace string
+	manifest  PluginManifest
+	logger    comm.Logger
+	registry  PluginRegistry
+
+	mutex sync.RWMutex
+}
+
+type externalPluginHost = *externalPluginHostT
+
+func newExternalPluginHost(logger comm.Logger, manifest PluginManifest) externalPluginHost {
+	return &externalPluginHostT{
+		namespace: "",
+		manifest:  manifest,
+		logger:    logger,
+		registry:  nil,
+		mutex:     sync.RWMutex{},
+	}
+}
+
+func (me externalPluginHost) bind(namespace string, registry PluginRegistry) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	me.namespace = namespace
+	me.registry = registry
+}
+
+func (me externalPluginHost) setLogger(logger comm.Logger) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	me.logger = logger
+}
+
+func (me externalPluginHost) Id() string {
+	return PluginId(me.Namespace(), me.Name())
+}
+
+func (me externalPluginHost) Namespace() string {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+
+	return me.namespace
+}
+
+func (me externalPluginHost) Name() string {
+	return me.manifest.Name
+}
+
+func (me externalPluginHost) Kind() PluginKind {
+	return me.manifest.Kind
+}
+
+func (me externalPluginHost) Logger() comm.Logger {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+
+	return me.logger
+}
+
+func (me externalPluginHost) Config() map[string]any {
+	if me.manifest.Config == nil {
+		return map[string]any{}
+	}
+	return me.manifest.Config
+}
+
+// DataDir returns the directory for the plugin to keep its data, ie. <registry data dir>/<namespace>/<name>,
+// or empty if the registry has no data dir
+func (me externalPluginHost) DataDir() string {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+
+	if me.registry == nil || len(me.registry.DataDir()) == 0 {
+		return ""
+	}
+	return filepath.Join(me.registry.DataDir(), me.namespace, me.manifest.Name)
+}
+
+func (me externalPluginHost) Manifest() PluginManifest {
+	return me.manifest
+}
+
+func (me externalPluginHost) Lookup(id string) Plugin {
+	me.mutex.RLock()
+	registry := me.registry
+	me.mutex.RUnlock()
+
+	if registry == nil {
+		return nil
+	}
+	return registry.ById(id)
+}
+
+func (me externalPluginHost) ByKind(kind PluginKind) map[string]Plugin {
+	me.mutex.RLock()
+	registry := me.registry
+	me.mutex.RUnlock()
+
+	if registry == nil {
+		return map[string]Plugin{}
+	}
+	return registry.ByKind(kind)
+}
@@ -0,0 +1,308 @@
+package qplugin
+
+import (
+	"context"
+	"debug/buildinfo"
+	"fmt"
+	"io"
+	"os"
+	"plugin"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// ExternalGoNativePluginContextT runs a prebuilt .so opened by the standard plugin package. The library exports
+// either a Plugin variable implementing qplugin.Plugin, or PluginStart/PluginStop functions with the same
+// signatures as a script plugin. Unlike a script plugin, the code is not sandboxed.
+type ExternalGoNativePluginContextT struct {
+	logger comm.Logger
+	host   HostPlugin
+
+	library *plugin.Plugin
+
+	// the Plugin variable, nil if the library exports the functions instead
+	pluginVar Plugin
+	startFunc *reflect.Value
+	stopFunc  *reflect.Value
+
+	funcs      map[string]reflect.Value
+	funcsMutex sync.Mutex
+}
+
+type ExternalGoNativePluginContext = *ExternalGoNativePluginContextT
+
+func NewExternalGoNativePluginContext() ExternalGoNativePluginContext {
+	return &ExternalGoNativePluginContextT{
+		logger:     comm.NewDiscardLogger(),
+		host:       nil,
+		library:    nil,
+		pluginVar:  nil,
+		startFunc:  nil,
+		stopFunc:   nil,
+		funcs:      map[string]reflect.Value{},
+		funcsMutex: sync.Mutex{},
+	}
+}
+
+// readGoNativeBuildInfo reads the build info of the library without opening it, so no code of it runs
+func readGoNativeBuildInfo(fs afero.Fs, libraryFile string) (*debug.BuildInfo, error) {
+	f, err := fs.Open(libraryFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", libraryFile)
+	}
+	defer f.Close()
+
+	r, err := buildinfo.Read(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read build info of %s", libraryFile)
+	}
+	return r, nil
+}
+
+// CheckGoNativeCompatibility verifies the library was built by the same Go version as the host, and with the same
+// versions of the modules shared with the host, which the runtime requires to open it
+func CheckGoNativeCompatibility(libraryFile string, library *debug.BuildInfo, host *debug.BuildInfo) error {
+	errs := comm.NewErrorGroup(false)
+
+	hostGoVersion := runtime.Version()
+	if host != nil {
+		hostGoVersion = host.GoVersion
+	}
+	if library.GoVersion != hostGoVersion {
+		errs.Add(fmt.Errorf("%s is built with %s, but the host is built with %s", libraryFile, library.GoVersion, hostGoVersion))
+	}
+
+	if host == nil {
+		return errs.MayError()
+	}
+
+	hostModules := map[string]string{}
+	hostModules[host.Main.Path] = goNativeModuleVersion(&host.Main)
+	for _, dep := range host.Deps {
+		hostModules[dep.Path] = goNativeModuleVersion(dep)
+	}
+
+	for _, dep := range library.Deps {
+		hostVersion, shared := hostModules[dep.Path]
+		if !shared {
+			continue
+		}
+		if version := goNativeModuleVersion(dep); version != hostVersion {
+			errs.Add(fmt.Errorf("%s is built with module %s %s, but the host has %s",
+				libraryFile, dep.Path, version, hostVersion))
+		}
+	}
+
+	for _, key := range []string{"GOOS", "GOARCH", "-race"} {
+		librarySetting, hostSetting := goNativeBuildSetting(library, key), goNativeBuildSetting(host, key)
+		if librarySetting != hostSetting {
+			errs.Add(fmt.Errorf("%s is built with %s=%s, but the host is built with %s=%s",
+				libraryFile, key, librarySetting, key, hostSetting))
+		}
+	}
+
+	return errs.MayError()
+}
+
+func goNativeModuleVersion(m *debug.Module) string {
+	if m.Replace != nil {
+		return m.Replace.Path + "@" + m.Replace.Version
+	}
+	return m.Version
+}
+
+func goNativeBuildSetting(info *debug.BuildInfo, key string) string {
+	for _, s := range info.Settings {
+		if s.Key == key {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+func (me ExternalGoNativePluginContext) checkCompatibility(fs afero.Fs, libraryFile string) error {
+	info, err := readGoNativeBuildInfo(fs, libraryFile)
+	if err != nil {
+		return err
+	}
+
+	host, _ := debug.ReadBuildInfo()
+	return CheckGoNativeCompatibility(libraryFile, info, host)
+}
+
+// Compile checks the library is compatible with the host, without opening it
+func (me ExternalGoNativePluginContext) Compile(fs afero.Fs, codeFile string) error {
+	return me.checkCompatibility(fs, codeFile)
+}
+
+// goNativeLibraryPath returns the path of the library on the OS filesystem, where the plugin package opens it.
+// A library on other filesystems is copied to a temporary file, which the returned function removes once the
+// library is opened.
+func goNativeLibraryPath(fs afero.Fs, libraryFile string) (string, func(), error) {
+	if r, ok := externalPluginRealPath(fs, libraryFile); ok {
+		return r, func() {}, nil
+	}
+
+	src, err := fs.Open(libraryFile)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "open %s", libraryFile)
+	}
+	defer src.Close()
+
+	dest, err := os.CreateTemp("", "qplugin-*.so")
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "copy %s", libraryFile)
+	}
+	defer dest.Close()
+
+	remove := func() {
+		os.Remove(dest.Name())
+	}
+	if _, err := io.Copy(dest, src); err != nil {
+		remove()
+		return "", nil, errors.Wrapf(err, "copy %s to %s", libraryFile, dest.Name())
+	}
+	return dest.Name(), remove, nil
+}
+
+// Init checks the compatibility then opens the library, which runs the package initialization of it
+func (me ExternalGoNativePluginContext) Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string) {
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("codeFile", codeFile)
+	me.logger = logger.NewSubLogger(logCtx)
+	me.host = host
+
+	if err := me.checkCompatibility(fs, codeFile); err != nil {
+		panic(err)
+	}
+
+	libraryPath, remove, err := goNativeLibraryPath(fs, codeFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// the opened library stays mapped after the file is removed
+	library, err := plugin.Open(libraryPath)
+	remove()
+	if err != nil {
+		panic(errors.Wrapf(err, "open %s", codeFile))
+	}
+	me.library = library
+
+	if sym, err := library.Lookup("Plugin"); err == nil {
+		v := reflect.ValueOf(sym)
+		var p Plugin
+		ok := false
+		if v.Kind() == reflect.Pointer {
+			p, ok = v.Elem().Interface().(Plugin)
+		}
+		if !ok {
+			panic(fmt.Errorf("%s: Plugin is %T, expect a variable implementing qplugin.Plugin", codeFile, sym))
+		}
+		me.pluginVar = p
+		return
+	}
+
+	me.startFunc = me.resolveLifecycleFunc("PluginStart")
+	me.stopFunc = me.resolveLifecycleFunc("PluginStop")
+}
+
+func (me ExternalGoNativePluginContext) resolveLifecycleFunc(funcName string) *reflect.Value {
+	sym, err := me.library.Lookup(funcName)
+	if err != nil {
+		me.logger.Debug().Msg("symbol not found: " + funcName)
+		return nil
+	}
+
+	r := reflect.ValueOf(sym)
+	if r.Kind() != reflect.Func {
+		me.logger.Warn().Msg(funcName + " is not a function")
+		return nil
+	}
+	if !isSupportedLifecycleFuncType(r.Type()) {
+		panic(fmt.Errorf("%s has unsupported signature %s, expect one of: %s",
+			funcName, r.Type(), strings.Join(supportedLifecycleFuncSignatures, ", ")))
+	}
+	return &r
+}
+
+func (me ExternalGoNativePluginContext) pluginLogger() comm.Logger {
+	if me.host != nil {
+		return me.host.Logger()
+	}
+	return me.logger
+}
+
+// PluginVar returns the Plugin variable exported by the library, or nil if it exports the functions instead
+func (me ExternalGoNativePluginContext) PluginVar() Plugin {
+	return me.pluginVar
+}
+
+func (me ExternalGoNativePluginContext) Start(ctx context.Context) (err error) {
+	if me.pluginVar == nil {
+		return callLifecycleFunc(ctx, me.host, "PluginStart", me.startFunc)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = errors.Wrap(panicToError(p), "Plugin.Start panicked")
+		}
+	}()
+	me.pluginVar.Start(me.pluginLogger())
+	return nil
+}
+
+func (me ExternalGoNativePluginContext) Stop(ctx context.Context) (err error) {
+	if me.pluginVar == nil {
+		return callLifecycleFunc(ctx, me.host, "PluginStop", me.stopFunc)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = errors.Wrap(panicToError(p), "Plugin.Stop panicked")
+		}
+	}()
+	me.pluginVar.Stop(me.pluginLogger())
+	return nil
+}
+
+// Invoke calls the function exported by the library
+func (me ExternalGoNativePluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	f, err := me.resolveFunc(funcName)
+	if err != nil {
+		return nil, err
+	}
+	return invokeFunc(ctx, funcName, f, args)
+}
+
+func (me ExternalGoNativePluginContext) resolveFunc(funcName string) (reflect.Value, error) {
+	me.funcsMutex.Lock()
+	defer me.funcsMutex.Unlock()
+
+	if f, found := me.funcs[funcName]; found {
+		return f, nil
+	}
+
+	if me.library == nil {
+		return reflect.Value{}, fmt.Errorf("%s: plugin is not initialized", funcName)
+	}
+
+	sym, err := me.library.Lookup(funcName)
+	if err != nil {
+		return reflect.Value{}, errors.Wrapf(err, "resolve %s", funcName)
+	}
+	f := reflect.ValueOf(sym)
+	if f.Kind() != reflect.Func {
+		return reflect.Value{}, fmt.Errorf("%s is not a function", funcName)
+	}
+
+	me.funcs[funcName] = f
+	return f, nil
+}
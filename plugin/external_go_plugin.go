@@ -1,7 +1,18 @@
 package qplugin
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 
 	"github.com/fastgh/go-comm/v2"
 	"github.com/pkg/errors"
@@ -12,21 +23,108 @@ import (
 
 type ExternalGoPluginContextT struct {
 	interpreter *interp.Interpreter
+	host        HostPlugin
+
+	// where Init loads the code from
+	fs       afero.Fs
+	codeFile string
+
+	// import path of the entry package, empty if the plugin is a single file
+	pkg string
+
+	// nil means unrestricted, otherwise only the stdlib symbols allowed by the permissions are available
+	permissions []PluginPermission
+
+	stdout              PluginOutput
+	stderr              PluginOutput
+	outputMaxLineBytes  int
+	outputMaxTotalBytes int64
 
 	startFunc *reflect.Value
 	stopFunc  *reflect.Value
+
+	// functions resolved by Invoke, keyed by the function name
+	funcs      map[string]reflect.Value
+	funcsMutex sync.Mutex
 }
 
 type ExternalGoPluginContext = *ExternalGoPluginContextT
 
 func NewExternalGoPluginContext() ExternalGoPluginContext {
+	return NewExternalGoPackagePluginContext("")
+}
+
+// NewExternalGoPackagePluginContext creates the context for a plugin whose code is a package, the code file
+// passed to Compile/Init is the plugin directory, mounted as the source of the package
+func NewExternalGoPackagePluginContext(pkg string) ExternalGoPluginContext {
 	return &ExternalGoPluginContextT{
 		interpreter: nil,
-		startFunc:   nil,
-		stopFunc:    nil,
+		host:        nil,
+		fs:          nil,
+		codeFile:    "",
+		pkg:         pkg,
+		stdout:      nil,
+		stderr:      nil,
+
+		outputMaxLineBytes:  DEFAULT_PLUGIN_OUTPUT_MAX_LINE_BYTES,
+		outputMaxTotalBytes: DEFAULT_PLUGIN_OUTPUT_MAX_TOTAL_BYTES,
+
+		startFunc:  nil,
+		stopFunc:   nil,
+		funcs:      map[string]reflect.Value{},
+		funcsMutex: sync.Mutex{},
 	}
 }
 
+func (me ExternalGoPluginContext) Package() string {
+	return me.pkg
+}
+
+func (me ExternalGoPluginContext) Permissions() []PluginPermission {
+	return me.permissions
+}
+
+// SetOutputLimits limits the size of each line and the total size of each output stream.
+// It affects the Init afterwards.
+func (me ExternalGoPluginContext) SetOutputLimits(maxLineBytes int, maxTotalBytes int64) {
+	me.outputMaxLineBytes = maxLineBytes
+	me.outputMaxTotalBytes = maxTotalBytes
+}
+
+// Stdout returns the stdout of the code, or nil if not initialized yet
+func (me ExternalGoPluginContext) Stdout() PluginOutput {
+	return me.stdout
+}
+
+// Stderr returns the stderr of the code, or nil if not initialized yet
+func (me ExternalGoPluginContext) Stderr() PluginOutput {
+	return me.stderr
+}
+
+// initOutputs routes the stdout/stderr of the code to the logger of the host, or the logger if no host.
+// Stdin is always at EOF.
+func (me ExternalGoPluginContext) initOutputs(logger comm.Logger, host HostPlugin, options *interp.Options) {
+	loggerOf := func() comm.Logger {
+		if host != nil {
+			return host.Logger()
+		}
+		return logger
+	}
+
+	me.stdout = NewPluginOutput(PLUGIN_OUTPUT_STDOUT, loggerOf, me.outputMaxLineBytes, me.outputMaxTotalBytes)
+	me.stderr = NewPluginOutput(PLUGIN_OUTPUT_STDERR, loggerOf, me.outputMaxLineBytes, me.outputMaxTotalBytes)
+
+	options.Stdin = bytes.NewReader(nil)
+	options.Stdout = me.stdout
+	options.Stderr = me.stderr
+}
+
+// SetPermissions restricts the stdlib symbols available to the code, nil means unrestricted.
+// It affects the Compile/Init afterwards.
+func (me ExternalGoPluginContext) SetPermissions(permissions []PluginPermission) {
+	me.permissions = permissions
+}
+
 func resolveExternalGoPluginFunc(logger comm.Logger, interpreter *interp.Interpreter, funcName string) *reflect.Value {
 	r, err := interpreter.Eval(funcName)
 	if err != nil {
@@ -46,23 +144,326 @@ func resolveExternalGoPluginFunc(logger comm.Logger, interpreter *interp.Interpr
 		return nil
 	}
 
+	if !isSupportedLifecycleFuncType(r.Type()) {
+		panic(fmt.Errorf("%s has unsupported signature %s, expect one of: %s",
+			funcName, r.Type(), strings.Join(supportedLifecycleFuncSignatures, ", ")))
+	}
+
 	return &r
 }
 
-func (me ExternalGoPluginContext) Init(logger comm.Logger, fs afero.Fs, codeFile string) {
+var (
+	contextType    = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	hostPluginType = reflect.TypeOf((*HostPlugin)(nil)).Elem()
+
+	supportedLifecycleFuncSignatures = []string{
+		"func()",
+		"func() error",
+		"func(context.Context) error",
+		"func(context.Context, host.Plugin) error",
+	}
+)
+
+func isSupportedLifecycleFuncType(t reflect.Type) bool {
+	switch t.NumOut() {
+	case 0:
+		return t.NumIn() == 0
+	case 1:
+		if t.Out(0) != errorType {
+			return false
+		}
+	default:
+		return false
+	}
+
+	switch t.NumIn() {
+	case 0:
+		return true
+	case 1:
+		return t.In(0) == contextType
+	case 2:
+		return t.In(0) == contextType && t.In(1) == hostPluginType
+	default:
+		return false
+	}
+}
+
+// callLifecycleFunc calls the function with arguments adapted to its signature, a returned error or panic
+// is returned as error
+func callLifecycleFunc(ctx context.Context, host HostPlugin, funcName string, f *reflect.Value) (err error) {
+	if f == nil {
+		return nil
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = errors.Wrapf(panicToError(p), "%s panicked", funcName)
+		}
+	}()
+
+	t := f.Type()
+
+	args := make([]reflect.Value, 0, t.NumIn())
+	if t.NumIn() > 0 {
+		args = append(args, reflect.ValueOf(&ctx).Elem())
+	}
+	if t.NumIn() > 1 {
+		args = append(args, reflect.ValueOf(&host).Elem())
+	}
+
+	results := f.Call(args)
+	if len(results) > 0 && !results[0].IsNil() {
+		return errors.Wrapf(results[0].Interface().(error), "%s failed", funcName)
+	}
+	return nil
+}
+
+func newExternalGoInterpreter(host HostPlugin, options interp.Options, codeFile string, permissions []PluginPermission) *interp.Interpreter {
+	// yaegi gives the code an empty environment unless specified
+	if hasPluginPermission(permissions, PLUGIN_PERMISSION_ENV) && options.Env == nil {
+		options.Env = os.Environ()
+	}
+
+	r := interp.New(options)
+	for _, exports := range externalGoExports(host, options, permissions) {
+		if err := r.Use(exports); err != nil {
+			panic(errors.Wrapf(err, "use exports failed: %s", codeFile))
+		}
+	}
+	return r
+}
+
+// externalGoExports returns the binary packages available to the code, in the order to use: the stdlib allowed
+// by the permissions, the stdio of the options, the host exports and the qplugin/host package
+func externalGoExports(host HostPlugin, options interp.Options, permissions []PluginPermission) []interp.Exports {
+	symbols := stdlib.Symbols
+	if permissions != nil {
+		symbols = filterPluginSymbols(symbols, permissions)
+	}
+
+	r := []interp.Exports{symbols}
+	if stdio := stdioExports(options); stdio != nil {
+		r = append(r, stdio)
+	}
+	return append(r, HostExports(), hostPackageExports(host))
+}
+
+// mergeExternalGoExports merges the exports as interp.Use does, the later ones override the earlier ones
+func mergeExternalGoExports(exportsList []interp.Exports) interp.Exports {
+	r := interp.Exports{}
+	for _, exports := range exportsList {
+		for path, symbols := range exports {
+			merged, found := r[path]
+			if !found {
+				merged = map[string]reflect.Value{}
+				r[path] = merged
+			}
+			for name, symbol := range symbols {
+				merged[name] = symbol
+			}
+		}
+	}
+	return r
+}
+
+// stdioExports replaces os.Stdin/Stdout/Stderr with the ones in the options, typed as io.Reader/io.Writer, since
+// yaegi keeps the process ones unless they are files. Returns nil if the options have none of them.
+func stdioExports(options interp.Options) interp.Exports {
+	symbols := map[string]reflect.Value{}
+	if stdin := options.Stdin; stdin != nil {
+		symbols["Stdin"] = reflect.ValueOf(&stdin).Elem()
+	}
+	if stdout := options.Stdout; stdout != nil {
+		symbols["Stdout"] = reflect.ValueOf(&stdout).Elem()
+	}
+	if stderr := options.Stderr; stderr != nil {
+		symbols["Stderr"] = reflect.ValueOf(&stderr).Elem()
+	}
+
+	if len(symbols) == 0 {
+		return nil
+	}
+	return interp.Exports{"os/os": symbols}
+}
+
+// Compile parses and type-checks the code file, without executing any code of it.
+// A package is type-checked by go/types rather than yaegi, because yaegi runs the package initialization once
+// it's imported.
+func (me ExternalGoPluginContext) Compile(fs afero.Fs, codeFile string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("compile %s, cause: %+v", codeFile, p)
+		}
+	}()
+
+	if len(me.pkg) > 0 {
+		options := interp.Options{}
+		me.initOutputs(comm.NewDiscardLogger(), nil, &options)
+		return me.checkPackage(fs, codeFile, options)
+	}
+
+	code, err := comm.ReadFileText(fs, codeFile)
+	if err != nil {
+		return err
+	}
+	if err := me.checkFilePermissions(codeFile, code); err != nil {
+		return errors.Wrapf(err, "compile %s", codeFile)
+	}
+
+	if _, err = newExternalGoInterpreter(nil, interp.Options{}, codeFile, me.permissions).Compile(code); err != nil {
+		return errors.Wrapf(err, "compile %s", codeFile)
+	}
+	return nil
+}
+
+// checkPackage checks the permissions then the types of the package in the plugin directory, with the binary
+// packages the interpreter would have by the options
+func (me ExternalGoPluginContext) checkPackage(fs afero.Fs, pluginDir string, options interp.Options) error {
+	fset, files, err := parseExternalGoPackage(fs, pluginDir)
+	if err != nil {
+		return err
+	}
+	if err := me.checkPermissions(fset, files); err != nil {
+		return err
+	}
+
+	exports := mergeExternalGoExports(externalGoExports(nil, options, me.permissions))
+	info := newExternalGoTypesInfo()
+	if err := typeCheckExternalGoPackage(fs, fset, files, pluginDir, me.pkg, exports, info); err != nil {
+		return errors.Wrapf(err, "type-check %s", me.pkg)
+	}
+	return me.checkMethodPermissions(fset, info)
+}
+
+// checkPermissions verifies the parsed code uses only the stdlib symbols allowed by the permissions
+func (me ExternalGoPluginContext) checkPermissions(fset *token.FileSet, files []*ast.File) error {
+	if me.permissions == nil {
+		return nil
+	}
+
+	errs := comm.NewErrorGroup(false)
+	for _, file := range files {
+		for _, err := range checkPluginSourcePermissions(fset, file, me.permissions) {
+			errs.Add(err)
+		}
+	}
+	return errs.MayError()
+}
+
+// checkMethodPermissions verifies the type-checked code calls only the stdlib methods allowed by the permissions
+func (me ExternalGoPluginContext) checkMethodPermissions(fset *token.FileSet, info *types.Info) error {
+	if me.permissions == nil {
+		return nil
+	}
+
+	errs := comm.NewErrorGroup(false)
+	for _, err := range checkPluginMethodPermissions(fset, info, me.permissions) {
+		errs.Add(err)
+	}
+	return errs.MayError()
+}
+
+// checkFilePermissions is checkPermissions and checkMethodPermissions for the single code file
+func (me ExternalGoPluginContext) checkFilePermissions(codeFile string, code string) error {
+	if me.permissions == nil {
+		return nil
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, codeFile, code, parser.AllErrors)
+	if err != nil {
+		return errors.Wrapf(err, "parse %s", codeFile)
+	}
+	if err := me.checkPermissions(fset, []*ast.File{file}); err != nil {
+		return err
+	}
+
+	exports := mergeExternalGoExports(externalGoExports(nil, interp.Options{}, me.permissions))
+	info := newExternalGoTypesInfo()
+	typeCheckExternalGoFile(fset, file, exports, info)
+	return me.checkMethodPermissions(fset, info)
+}
+
+// parseExternalGoPackage parses all go files in the plugin directory, including sub packages and vendor
+func parseExternalGoPackage(afs afero.Fs, pluginDir string) (*token.FileSet, []*ast.File, error) {
+	errs := comm.NewErrorGroup(false)
+	fset := token.NewFileSet()
+	files := []*ast.File{}
+
+	err := afero.Walk(afs, pluginDir, func(f string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(f) != ".go" {
+			return nil
+		}
+
+		code, err := comm.ReadFileBytes(afs, f)
+		if err != nil {
+			return err
+		}
+		file, err := parser.ParseFile(fset, f, code, parser.AllErrors)
+		if err != nil {
+			errs.Add(errors.Wrapf(err, "parse %s", f))
+		}
+		if file != nil {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "walk %s", pluginDir)
+	}
+
+	if len(files) == 0 {
+		errs.Add(fmt.Errorf("no go files in %s", pluginDir))
+	}
+	return fset, files, errs.MayError()
+}
+
+// Init evaluates the code file and resolves the plugin functions, host is available to the code as qplugin/host
+// package, it could be nil if the code doesn't need it
+func (me ExternalGoPluginContext) Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string) {
 	logCtx := comm.NewLogContext(false)
 	logCtx.Str("codeFile", codeFile)
 	logger = logger.NewSubLogger(logCtx)
 
-	me.interpreter = interp.New(interp.Options{})
-	if err := me.interpreter.Use(stdlib.Symbols); err != nil {
-		panic(errors.Wrapf(err, "use stdlib failed: %s", codeFile))
-	}
+	me.host = host
+	me.fs = fs
+	me.codeFile = codeFile
 
-	code := comm.ReadFileTextP(fs, codeFile)
-	_, err := me.interpreter.Eval(code)
-	if err != nil {
-		panic(errors.Wrapf(err, "eval %s", codeFile))
+	if len(me.pkg) > 0 {
+		options := interp.Options{
+			GoPath:               ".",
+			SourcecodeFilesystem: newExternalGoSourceFs(fs, codeFile, me.pkg),
+		}
+		me.initOutputs(logger, host, &options)
+
+		// fails before the package initialization runs
+		if err := me.checkPackage(fs, codeFile, options); err != nil {
+			panic(err)
+		}
+
+		me.interpreter = newExternalGoInterpreter(host, options, codeFile, me.permissions)
+
+		// imported as 'plugin', so the functions are resolved the same as a single file plugin
+		if _, err := me.interpreter.Eval(fmt.Sprintf("import plugin %q", me.pkg)); err != nil {
+			panic(errors.Wrapf(err, "import %s from %s", me.pkg, codeFile))
+		}
+	} else {
+		code := comm.ReadFileTextP(fs, codeFile)
+		if err := me.checkFilePermissions(codeFile, code); err != nil {
+			panic(err)
+		}
+
+		options := interp.Options{}
+		me.initOutputs(logger, host, &options)
+
+		me.interpreter = newExternalGoInterpreter(host, options, codeFile, me.permissions)
+		if _, err := me.interpreter.Eval(code); err != nil {
+			panic(errors.Wrapf(err, "eval %s", codeFile))
+		}
 	}
 
 	me.startFunc = resolveExternalGoPluginFunc(logger, me.interpreter, "plugin.PluginStart")
@@ -73,20 +474,92 @@ func (me ExternalGoPluginContext) GetStartFunc() *reflect.Value {
 	return me.startFunc
 }
 
-func (me ExternalGoPluginContext) Start() any {
-	if me.startFunc == nil {
-		return ""
-	}
-	return me.startFunc.Call([]reflect.Value{})
+func (me ExternalGoPluginContext) Start(ctx context.Context) error {
+	defer me.flushOutputs()
+	return callLifecycleFunc(ctx, me.host, "plugin.PluginStart", me.startFunc)
 }
 
 func (me ExternalGoPluginContext) GetStopFunc() *reflect.Value {
 	return me.stopFunc
 }
 
-func (me ExternalGoPluginContext) Stop() any {
-	if me.stopFunc == nil {
-		return ""
+func (me ExternalGoPluginContext) Stop(ctx context.Context) error {
+	defer me.flushOutputs()
+	return callLifecycleFunc(ctx, me.host, "plugin.PluginStop", me.stopFunc)
+}
+
+func (me ExternalGoPluginContext) flushOutputs() {
+	if me.stdout != nil {
+		me.stdout.Flush()
+	}
+	if me.stderr != nil {
+		me.stderr.Flush()
+	}
+}
+
+// resolveFunc returns the function of the plugin package, resolved at the first time then cached
+func (me ExternalGoPluginContext) resolveFunc(funcName string) (reflect.Value, error) {
+	me.funcsMutex.Lock()
+	defer me.funcsMutex.Unlock()
+
+	if f, found := me.funcs[funcName]; found {
+		return f, nil
+	}
+
+	if me.interpreter == nil {
+		return reflect.Value{}, fmt.Errorf("%s: plugin is not initialized", funcName)
+	}
+
+	// evaluated as code, so it must be a plain name
+	if !token.IsIdentifier(funcName) || !token.IsExported(funcName) {
+		return reflect.Value{}, fmt.Errorf("%q is not an exported function name", funcName)
+	}
+
+	f, err := me.interpreter.Eval("plugin." + funcName)
+	if err != nil {
+		return reflect.Value{}, errors.Wrapf(err, "resolve %s", funcName)
+	}
+	if !f.IsValid() || f.Kind() != reflect.Func || f.IsNil() {
+		return reflect.Value{}, fmt.Errorf("%s is not a function", funcName)
+	}
+
+	me.funcs[funcName] = f
+	return f, nil
+}
+
+// Invoke calls the function defined in the plugin package
+func (me ExternalGoPluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	f, err := me.resolveFunc(funcName)
+	if err != nil {
+		return nil, err
+	}
+
+	defer me.flushOutputs()
+	return invokeFunc(ctx, funcName, f, args)
+}
+
+// newInstance calls the constructor and verifies the result implements the interface. yaegi converts the result to
+// the registered wrapper if the constructor declares the interface as its result type, but loses the methods of a
+// script value returned as any, so the error hints to declare the interface then.
+func (me ExternalGoPluginContext) newInstance(ctx context.Context, kind PluginKind, ifaceType reflect.Type) (any, error) {
+	f, err := me.resolveFunc(PLUGIN_CONSTRUCTOR)
+	if err != nil {
+		return nil, errors.Wrapf(err, "plugin of kind %s must export the constructor %s", kind, PLUGIN_CONSTRUCTOR)
+	}
+
+	results, err := invokeFunc(ctx, PLUGIN_CONSTRUCTOR, f, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("%s returns %d values, expect 1", PLUGIN_CONSTRUCTOR, len(results))
+	}
+
+	if err := checkPluginInstance(ifaceType, results[0]); err != nil {
+		if resultType := f.Type().Out(0); !resultType.Implements(ifaceType) {
+			return nil, errors.Wrapf(err, "%s declares the result as %s, expect %s", PLUGIN_CONSTRUCTOR, resultType, ifaceType)
+		}
+		return nil, err
 	}
-	return me.stopFunc.Call([]reflect.Value{})
+	return results[0], nil
 }
@@ -0,0 +1,129 @@
+package qplugin
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// externalGoSourceFsT mounts a plugin directory as $GOPATH/src/<package> for the yaegi interpreter, where GOPATH
+// is ".". So the plugin imports its own sub packages as <package>/xxx, and its third-party dependencies from
+// the vendor directory in the plugin directory.
+type externalGoSourceFsT struct {
+	pluginDir afero.IOFS
+	mount     string
+}
+
+type externalGoSourceFs = *externalGoSourceFsT
+
+func newExternalGoSourceFs(afs afero.Fs, pluginDir string, pkg string) externalGoSourceFs {
+	return &externalGoSourceFsT{
+		pluginDir: afero.NewIOFS(afero.NewBasePathFs(afs, pluginDir)),
+		mount:     path.Join("src", pkg),
+	}
+}
+
+var (
+	_ fs.ReadDirFS = &externalGoSourceFsT{}
+	_ fs.StatFS    = &externalGoSourceFsT{}
+)
+
+// resolve returns the path in plugin directory if the name is inside the mount point, otherwise the name of the
+// only child if the name is an ancestor directory of the mount point
+func (me externalGoSourceFs) resolve(op string, name string) (inPluginDir string, child string, err error) {
+	if !fs.ValidPath(name) {
+		return "", "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == me.mount {
+		return ".", "", nil
+	}
+	if strings.HasPrefix(name, me.mount+"/") {
+		return strings.TrimPrefix(name, me.mount+"/"), "", nil
+	}
+
+	if name == "." {
+		return "", strings.Split(me.mount, "/")[0], nil
+	}
+	if strings.HasPrefix(me.mount, name+"/") {
+		return "", strings.Split(strings.TrimPrefix(me.mount, name+"/"), "/")[0], nil
+	}
+
+	return "", "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (me externalGoSourceFs) Open(name string) (fs.File, error) {
+	inPluginDir, child, err := me.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(inPluginDir) > 0 {
+		return me.pluginDir.Open(inPluginDir)
+	}
+	return &virtualGoSourceDirT{name: path.Base(name), child: child}, nil
+}
+
+func (me externalGoSourceFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	inPluginDir, child, err := me.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(inPluginDir) > 0 {
+		return me.pluginDir.ReadDir(inPluginDir)
+	}
+	return []fs.DirEntry{fs.FileInfoToDirEntry(virtualGoSourceDirInfo(child))}, nil
+}
+
+func (me externalGoSourceFs) Stat(name string) (fs.FileInfo, error) {
+	inPluginDir, _, err := me.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(inPluginDir) > 0 {
+		return me.pluginDir.Stat(inPluginDir)
+	}
+	return virtualGoSourceDirInfo(path.Base(name)), nil
+}
+
+// virtualGoSourceDirT is an ancestor directory of the mount point, it has only one child
+type virtualGoSourceDirT struct {
+	name  string
+	child string
+	read  bool
+}
+
+func (me *virtualGoSourceDirT) Stat() (fs.FileInfo, error) {
+	return virtualGoSourceDirInfo(me.name), nil
+}
+
+func (me *virtualGoSourceDirT) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: me.name, Err: fs.ErrInvalid}
+}
+
+func (me *virtualGoSourceDirT) Close() error {
+	return nil
+}
+
+func (me *virtualGoSourceDirT) ReadDir(n int) ([]fs.DirEntry, error) {
+	if me.read {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return []fs.DirEntry{}, nil
+	}
+	me.read = true
+	return []fs.DirEntry{fs.FileInfoToDirEntry(virtualGoSourceDirInfo(me.child))}, nil
+}
+
+type virtualGoSourceDirInfo string
+
+func (me virtualGoSourceDirInfo) Name() string       { return string(me) }
+func (me virtualGoSourceDirInfo) Size() int64        { return 0 }
+func (me virtualGoSourceDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (me virtualGoSourceDirInfo) ModTime() time.Time { return time.Time{} }
+func (me virtualGoSourceDirInfo) IsDir() bool        { return true }
+func (me virtualGoSourceDirInfo) Sys() any           { return nil }
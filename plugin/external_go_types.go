@@ -0,0 +1,412 @@
+package qplugin
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/spf13/afero"
+	"github.com/traefik/yaegi/interp"
+)
+
+// typeCheckExternalGoPackage type-checks the package plugin from its source, without executing any of it. The
+// packages are resolved the same as the interpreter does: the binary packages first, ie. the stdlib and the host
+// exports, then the plugin's own sub packages and the vendor directory. Only the packages reachable from the
+// entry package are checked.
+//
+// The soft errors, ie. unused imports and variables, are ignored, since the interpreter accepts them. The types
+// of the checked packages are recorded into info.
+func typeCheckExternalGoPackage(afs afero.Fs, fset *token.FileSet, files []*ast.File, pluginDir string, pkg string, exports interp.Exports, info *types.Info) error {
+	errs := comm.NewErrorGroup(false)
+
+	importer := newExternalGoImporter(fset, exports, info, errs)
+	importer.pluginDir = filepath.Clean(pluginDir)
+	importer.pkg = pkg
+	importer.sources = groupExternalGoFiles(afs, fset, files)
+
+	if _, err := importer.Import(pkg); err != nil {
+		errs.Add(err)
+	}
+	return errs.MayError()
+}
+
+// typeCheckExternalGoFile type-checks the single file plugin only to record the types into info, the errors are
+// left to the interpreter
+func typeCheckExternalGoFile(fset *token.FileSet, file *ast.File, exports interp.Exports, info *types.Info) {
+	importer := newExternalGoImporter(fset, exports, info, comm.NewErrorGroup(false))
+
+	config := types.Config{
+		Importer: importer,
+		Error:    func(err error) {},
+	}
+	config.Check(file.Name.Name, fset, []*ast.File{file}, info)
+}
+
+// newExternalGoTypesInfo returns the info to record the selections and the used objects, for checking the
+// permissions of methods
+func newExternalGoTypesInfo() *types.Info {
+	return &types.Info{
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+		Uses:       map[*ast.Ident]types.Object{},
+	}
+}
+
+// groupExternalGoFiles groups the files by directory, the test files and the ones excluded by the build
+// constraints are skipped as the interpreter does
+func groupExternalGoFiles(afs afero.Fs, fset *token.FileSet, files []*ast.File) map[string][]*ast.File {
+	ctx := build.Default
+	ctx.OpenFile = func(path string) (io.ReadCloser, error) {
+		return afs.Open(path)
+	}
+
+	r := map[string][]*ast.File{}
+	for _, file := range files {
+		path := fset.Position(file.Package).Filename
+		dir, name := filepath.Split(path)
+		dir = filepath.Clean(dir)
+
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if matched, err := ctx.MatchFile(dir, name); err == nil && !matched {
+			continue
+		}
+		r[dir] = append(r[dir], file)
+	}
+	return r
+}
+
+type externalGoBinaryPackage struct {
+	name    string
+	symbols map[string]reflect.Value
+}
+
+type externalGoImporter struct {
+	fset      *token.FileSet
+	pluginDir string
+	pkg       string
+	sources   map[string][]*ast.File
+	binaries  map[string]externalGoBinaryPackage
+	checked   map[string]*types.Package
+	checking  map[string]bool
+	reflected *reflectedGoTypes
+	info      *types.Info
+	errs      comm.ErrorGroup
+}
+
+func newExternalGoImporter(fset *token.FileSet, exports interp.Exports, info *types.Info, errs comm.ErrorGroup) *externalGoImporter {
+	r := &externalGoImporter{
+		fset:      fset,
+		sources:   map[string][]*ast.File{},
+		binaries:  map[string]externalGoBinaryPackage{},
+		checked:   map[string]*types.Package{},
+		checking:  map[string]bool{},
+		reflected: newReflectedGoTypes(),
+		info:      info,
+		errs:      errs,
+	}
+	for key, symbols := range exports {
+		i := strings.LastIndexByte(key, '/')
+		if i < 0 {
+			continue
+		}
+		r.binaries[key[:i]] = externalGoBinaryPackage{name: key[i+1:], symbols: symbols}
+	}
+	return r
+}
+
+func (me *externalGoImporter) Import(path string) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	if r := me.checked[path]; r != nil {
+		return r, nil
+	}
+
+	if bin, found := me.binaries[path]; found {
+		r := me.reflected.importPackage(path, bin.name, bin.symbols)
+		me.checked[path] = r
+		return r, nil
+	}
+
+	files := me.sources[me.sourceDir(path)]
+	if len(files) == 0 {
+		return nil, fmt.Errorf("package %s is not found", path)
+	}
+	if me.checking[path] {
+		return nil, fmt.Errorf("import cycle not allowed: %s", path)
+	}
+	me.checking[path] = true
+	defer delete(me.checking, path)
+
+	config := types.Config{
+		Importer: me,
+		Error: func(err error) {
+			if te, ok := err.(types.Error); ok && te.Soft {
+				return
+			}
+			me.errs.Add(err)
+		},
+	}
+	// the errors are collected by the Error function
+	r, _ := config.Check(path, me.fset, files, me.info)
+	me.checked[path] = r
+	return r, nil
+}
+
+// sourceDir returns the directory of the package in the plugin directory
+func (me *externalGoImporter) sourceDir(path string) string {
+	if path == me.pkg {
+		return me.pluginDir
+	}
+	if strings.HasPrefix(path, me.pkg+"/") {
+		return filepath.Join(me.pluginDir, filepath.FromSlash(strings.TrimPrefix(path, me.pkg+"/")))
+	}
+	return filepath.Join(me.pluginDir, "vendor", filepath.FromSlash(path))
+}
+
+// reflectedGoTypes converts the reflect types of the binary symbols to go/types. Each package and named type is
+// converted once, so that it's identical wherever it appears.
+type reflectedGoTypes struct {
+	pkgs  map[string]*types.Package
+	named map[reflect.Type]*types.Named
+}
+
+func newReflectedGoTypes() *reflectedGoTypes {
+	return &reflectedGoTypes{
+		pkgs:  map[string]*types.Package{},
+		named: map[reflect.Type]*types.Named{},
+	}
+}
+
+func (me *reflectedGoTypes) pkg(path string) *types.Package {
+	if r := me.pkgs[path]; r != nil {
+		return r
+	}
+	r := types.NewPackage(path, path[strings.LastIndexByte(path, '/')+1:])
+	me.pkgs[path] = r
+	return r
+}
+
+// importPackage declares the symbols in the package: the nil pointers of types are type names, the addressable
+// values are variables, the constant.Value and other values are constants
+func (me *reflectedGoTypes) importPackage(path string, name string, symbols map[string]reflect.Value) *types.Package {
+	pkg := me.pkg(path)
+	pkg.SetName(name)
+	scope := pkg.Scope()
+
+	for sym, v := range symbols {
+		// the wrappers of interfaces, generated by yaegi extract
+		if strings.HasPrefix(sym, "_") || !v.IsValid() {
+			continue
+		}
+
+		var obj types.Object
+		switch {
+		case v.CanAddr():
+			obj = types.NewVar(token.NoPos, pkg, sym, me.typeOf(v.Type()))
+		case v.Kind() == reflect.Func:
+			sig, ok := me.typeOf(v.Type()).(*types.Signature)
+			if !ok {
+				obj = types.NewVar(token.NoPos, pkg, sym, me.typeOf(v.Type()))
+				break
+			}
+			obj = types.NewFunc(token.NoPos, pkg, sym, sig)
+		case v.Kind() == reflect.Pointer && v.IsNil():
+			typ := me.typeOf(v.Type().Elem())
+			if named, ok := typ.(*types.Named); ok && named.Obj().Pkg() == pkg && named.Obj().Name() == sym {
+				// declared by typeOf already
+				continue
+			}
+			obj = types.NewTypeName(token.NoPos, pkg, sym, typ)
+		default:
+			if cv, ok := v.Interface().(constant.Value); ok {
+				obj = types.NewConst(token.NoPos, pkg, sym, untypedGoTypeOf(cv), cv)
+			} else if cv := constantOf(v); cv != nil {
+				obj = types.NewConst(token.NoPos, pkg, sym, me.typeOf(v.Type()), cv)
+			} else {
+				obj = types.NewVar(token.NoPos, pkg, sym, me.typeOf(v.Type()))
+			}
+		}
+		scope.Insert(obj)
+	}
+
+	pkg.MarkComplete()
+	return pkg
+}
+
+func untypedGoTypeOf(cv constant.Value) types.Type {
+	switch cv.Kind() {
+	case constant.Bool:
+		return types.Typ[types.UntypedBool]
+	case constant.String:
+		return types.Typ[types.UntypedString]
+	case constant.Float:
+		return types.Typ[types.UntypedFloat]
+	case constant.Complex:
+		return types.Typ[types.UntypedComplex]
+	}
+	return types.Typ[types.UntypedInt]
+}
+
+// constantOf returns the constant of a typed constant value, or nil if the value isn't of a basic kind
+func constantOf(v reflect.Value) constant.Value {
+	switch v.Kind() {
+	case reflect.Bool:
+		return constant.MakeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return constant.MakeInt64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return constant.MakeUint64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return constant.MakeFloat64(v.Float())
+	case reflect.String:
+		return constant.MakeString(v.String())
+	}
+	return nil
+}
+
+var basicGoTypeKinds = map[reflect.Kind]types.BasicKind{
+	reflect.Bool:          types.Bool,
+	reflect.Int:           types.Int,
+	reflect.Int8:          types.Int8,
+	reflect.Int16:         types.Int16,
+	reflect.Int32:         types.Int32,
+	reflect.Int64:         types.Int64,
+	reflect.Uint:          types.Uint,
+	reflect.Uint8:         types.Uint8,
+	reflect.Uint16:        types.Uint16,
+	reflect.Uint32:        types.Uint32,
+	reflect.Uint64:        types.Uint64,
+	reflect.Uintptr:       types.Uintptr,
+	reflect.Float32:       types.Float32,
+	reflect.Float64:       types.Float64,
+	reflect.Complex64:     types.Complex64,
+	reflect.Complex128:    types.Complex128,
+	reflect.String:        types.String,
+	reflect.UnsafePointer: types.UnsafePointer,
+}
+
+func (me *reflectedGoTypes) typeOf(t reflect.Type) types.Type {
+	if len(t.Name()) > 0 {
+		if len(t.PkgPath()) > 0 {
+			return me.namedOf(t)
+		}
+		if t == errorType {
+			return types.Universe.Lookup("error").Type()
+		}
+	}
+	return me.underlyingOf(t, nil)
+}
+
+// namedOf declares the named type in its package, with the methods of the type and of the pointer to it
+func (me *reflectedGoTypes) namedOf(t reflect.Type) types.Type {
+	if r := me.named[t]; r != nil {
+		return r
+	}
+
+	pkg := me.pkg(t.PkgPath())
+	obj := types.NewTypeName(token.NoPos, pkg, t.Name(), nil)
+	r := types.NewNamed(obj, nil, nil)
+	me.named[t] = r
+	pkg.Scope().Insert(obj)
+
+	r.SetUnderlying(me.underlyingOf(t, pkg))
+
+	if t.Kind() != reflect.Interface {
+		declared := map[string]bool{}
+		for i := 0; i < t.NumMethod(); i++ {
+			m := t.Method(i)
+			declared[m.Name] = true
+			r.AddMethod(me.methodOf(pkg, r, m))
+		}
+
+		pt := reflect.PointerTo(t)
+		for i := 0; i < pt.NumMethod(); i++ {
+			if m := pt.Method(i); !declared[m.Name] {
+				r.AddMethod(me.methodOf(pkg, types.NewPointer(r), m))
+			}
+		}
+	}
+	return r
+}
+
+func (me *reflectedGoTypes) methodOf(pkg *types.Package, recvType types.Type, m reflect.Method) *types.Func {
+	recv := types.NewVar(token.NoPos, pkg, "", recvType)
+	return types.NewFunc(token.NoPos, pkg, m.Name, me.signatureOf(m.Type, recv, 1))
+}
+
+// signatureOf converts the function type, the first skip parameters are the receiver if any
+func (me *reflectedGoTypes) signatureOf(t reflect.Type, recv *types.Var, skip int) *types.Signature {
+	params := make([]*types.Var, 0, t.NumIn())
+	for i := skip; i < t.NumIn(); i++ {
+		params = append(params, types.NewParam(token.NoPos, nil, "", me.typeOf(t.In(i))))
+	}
+	results := make([]*types.Var, 0, t.NumOut())
+	for i := 0; i < t.NumOut(); i++ {
+		results = append(results, types.NewParam(token.NoPos, nil, "", me.typeOf(t.Out(i))))
+	}
+	return types.NewSignatureType(recv, nil, nil, types.NewTuple(params...), types.NewTuple(results...), t.IsVariadic())
+}
+
+// underlyingOf converts the structure of the type, pkg is where the fields and methods are declared, nil if the
+// type isn't named
+func (me *reflectedGoTypes) underlyingOf(t reflect.Type, pkg *types.Package) types.Type {
+	if kind, found := basicGoTypeKinds[t.Kind()]; found {
+		return types.Typ[kind]
+	}
+
+	pkgOf := func(pkgPath string) *types.Package {
+		if len(pkgPath) > 0 {
+			return me.pkg(pkgPath)
+		}
+		return pkg
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return types.NewPointer(me.typeOf(t.Elem()))
+	case reflect.Slice:
+		return types.NewSlice(me.typeOf(t.Elem()))
+	case reflect.Array:
+		return types.NewArray(me.typeOf(t.Elem()), int64(t.Len()))
+	case reflect.Map:
+		return types.NewMap(me.typeOf(t.Key()), me.typeOf(t.Elem()))
+	case reflect.Chan:
+		dir := types.SendRecv
+		switch t.ChanDir() {
+		case reflect.SendDir:
+			dir = types.SendOnly
+		case reflect.RecvDir:
+			dir = types.RecvOnly
+		}
+		return types.NewChan(dir, me.typeOf(t.Elem()))
+	case reflect.Func:
+		return me.signatureOf(t, nil, 0)
+	case reflect.Struct:
+		fields := make([]*types.Var, 0, t.NumField())
+		tags := make([]string, 0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fields = append(fields, types.NewField(token.NoPos, pkgOf(f.PkgPath), f.Name, me.typeOf(f.Type), f.Anonymous))
+			tags = append(tags, string(f.Tag))
+		}
+		return types.NewStruct(fields, tags)
+	case reflect.Interface:
+		methods := make([]*types.Func, 0, t.NumMethod())
+		for i := 0; i < t.NumMethod(); i++ {
+			m := t.Method(i)
+			methods = append(methods, types.NewFunc(token.NoPos, pkgOf(m.PkgPath), m.Name, me.signatureOf(m.Type, nil, 0)))
+		}
+		return types.NewInterfaceType(methods, nil).Complete()
+	}
+	return types.Typ[types.Invalid]
+}
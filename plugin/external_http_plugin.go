@@ -0,0 +1,314 @@
+package qplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// The contract of a http plugin, relative to the base URL in the manifest. Requests and responses are JSON.
+//
+//	POST {base}/start            {"plugin_id": "...", "config": {...}}  -> 2xx
+//	POST {base}/stop             {"plugin_id": "..."}                   -> 2xx
+//	GET  {base}/health                                                  -> 2xx
+//	POST {base}/invoke/{function} {"args": [...]}                       -> 2xx {"results": [...]}
+//
+// A failure is responded with a non-2xx status and optionally {"error": "..."}. The host retries a request only if
+// it's never processed: the connection can't be established, or the status is 429 or 503. Other failures, ie.
+// timeouts and the other 5xx, are not retried, so that a function is never run twice by the host. The headers
+// configured in the manifest, ie. for authentication, are sent with every request.
+const (
+	DEFAULT_HTTP_PLUGIN_TIMEOUT     = 30 * time.Second
+	DEFAULT_HTTP_PLUGIN_RETRY_DELAY = 500 * time.Millisecond
+
+	httpPluginMaxResponseBytes = 16 * 1024 * 1024
+)
+
+type httpPluginStartRequest struct {
+	PluginId string         `json:"plugin_id,omitempty"`
+	Config   map[string]any `json:"config,omitempty"`
+}
+
+type httpPluginStopRequest struct {
+	PluginId string `json:"plugin_id,omitempty"`
+}
+
+type httpPluginInvokeRequest struct {
+	Args []any `json:"args"`
+}
+
+type httpPluginInvokeResponse struct {
+	Results []any `json:"results"`
+}
+
+type httpPluginErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// ExternalHttpPluginContextT is a plugin hosted by a remote service, see the contract above
+type ExternalHttpPluginContextT struct {
+	logger comm.Logger
+	host   HostPlugin
+
+	baseUrl           string
+	timeout           time.Duration
+	retries           int
+	retryDelay        time.Duration
+	headersFromConfig map[string]string
+
+	client *http.Client
+}
+
+type ExternalHttpPluginContext = *ExternalHttpPluginContextT
+
+func NewExternalHttpPluginContext() ExternalHttpPluginContext {
+	return &ExternalHttpPluginContextT{
+		logger: comm.NewDiscardLogger(),
+		host:   nil,
+
+		baseUrl:           "",
+		timeout:           DEFAULT_HTTP_PLUGIN_TIMEOUT,
+		retries:           0,
+		retryDelay:        DEFAULT_HTTP_PLUGIN_RETRY_DELAY,
+		headersFromConfig: map[string]string{},
+
+		client: &http.Client{},
+	}
+}
+
+// SetTimeout limits each attempt of a request. Non-positive means the default.
+func (me ExternalHttpPluginContext) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DEFAULT_HTTP_PLUGIN_TIMEOUT
+	}
+	me.timeout = timeout
+}
+
+// SetRetries sets how many times a failed request is retried, and the delay before the first retry, which doubles
+// for each next retry. Non-positive delay means the default.
+func (me ExternalHttpPluginContext) SetRetries(retries int, delay time.Duration) {
+	if retries < 0 {
+		retries = 0
+	}
+	if delay <= 0 {
+		delay = DEFAULT_HTTP_PLUGIN_RETRY_DELAY
+	}
+	me.retries = retries
+	me.retryDelay = delay
+}
+
+// SetHeadersFromConfig sets the headers sent with every request, mapping the header name to the key of the plugin
+// config holding the value, so that the secrets stay in the config
+func (me ExternalHttpPluginContext) SetHeadersFromConfig(headers map[string]string) {
+	me.headersFromConfig = headers
+}
+
+// SetClient replaces the http client, ie. for custom transport
+func (me ExternalHttpPluginContext) SetClient(client *http.Client) {
+	me.client = client
+}
+
+func checkHttpPluginBaseUrl(baseUrl string) error {
+	u, err := url.Parse(baseUrl)
+	if err != nil {
+		return errors.Wrapf(err, "invalid base url %s", baseUrl)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid base url %s: expect http or https", baseUrl)
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("invalid base url %s: host is required", baseUrl)
+	}
+	return nil
+}
+
+// Compile checks the base URL, which is the codeFile of a http plugin
+func (me ExternalHttpPluginContext) Compile(fs afero.Fs, codeFile string) error {
+	return checkHttpPluginBaseUrl(codeFile)
+}
+
+// Init checks the base URL, the remote service isn't requested until started
+func (me ExternalHttpPluginContext) Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string) {
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("baseUrl", codeFile)
+	me.logger = logger.NewSubLogger(logCtx)
+	me.host = host
+
+	if err := checkHttpPluginBaseUrl(codeFile); err != nil {
+		panic(err)
+	}
+	me.baseUrl = strings.TrimSuffix(codeFile, "/")
+}
+
+func (me ExternalHttpPluginContext) headers() (http.Header, error) {
+	r := http.Header{}
+	if len(me.headersFromConfig) == 0 {
+		return r, nil
+	}
+
+	var config map[string]any
+	if me.host != nil {
+		config = me.host.Config()
+	}
+	for header, key := range me.headersFromConfig {
+		v, found := config[key]
+		if !found {
+			return nil, fmt.Errorf("config %s of header %s not found", key, header)
+		}
+		r.Set(header, fmt.Sprint(v))
+	}
+	return r, nil
+}
+
+// retryableHttpStatus tells if the request is retried for the status, which means the request isn't processed
+func retryableHttpStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// retryableHttpError tells if the request is retried for the error, only if the connection can't be established,
+// since the request may be processed once it's sent
+func retryableHttpError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// attempt sends the request once, and tells if it's worth a retry when failed
+func (me ExternalHttpPluginContext) attempt(ctx context.Context, method string, u string, headers http.Header,
+	body []byte, result any) (retryable bool, err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, me.timeout)
+	defer cancel()
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bodyReader)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := me.client.Do(req)
+	if err != nil {
+		return retryableHttpError(err), err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, httpPluginMaxResponseBytes))
+	if err != nil {
+		return false, errors.Wrap(err, "read response")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errResp httpPluginErrorResponse
+		if json.Unmarshal(respBody, &errResp) == nil && len(errResp.Error) > 0 {
+			err = fmt.Errorf("%s: %s", resp.Status, errResp.Error)
+		} else {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		return retryableHttpStatus(resp.StatusCode), err
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(respBody, result); err != nil {
+			return false, errors.Wrap(err, "unmarshal response")
+		}
+	}
+	return false, nil
+}
+
+// request sends the request, and retries with the doubling delay if retryable
+func (me ExternalHttpPluginContext) request(ctx context.Context, method string, path string, payload any, result any) error {
+	if len(me.baseUrl) == 0 {
+		return fmt.Errorf("%s %s: plugin is not initialized", method, path)
+	}
+	u := me.baseUrl + path
+
+	headers, err := me.headers()
+	if err != nil {
+		return errors.Wrapf(err, "%s %s", method, u)
+	}
+
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return errors.Wrapf(err, "%s %s: marshal request", method, u)
+		}
+	}
+
+	delay := me.retryDelay
+	for i := 0; ; i++ {
+		retryable, err := me.attempt(ctx, method, u, headers, body, result)
+		if err == nil {
+			return nil
+		}
+		if !retryable || i >= me.retries {
+			return errors.Wrapf(err, "%s %s", method, u)
+		}
+
+		me.logger.Warn().Err(err).Int("retry", i+1).Msg("plugin request failed, retry")
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%s %s", method, u)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (me ExternalHttpPluginContext) pluginId() string {
+	if me.host != nil {
+		return me.host.Id()
+	}
+	return ""
+}
+
+func (me ExternalHttpPluginContext) Start(ctx context.Context) error {
+	req := &httpPluginStartRequest{PluginId: me.pluginId()}
+	if me.host != nil {
+		req.Config = me.host.Config()
+	}
+	return me.request(ctx, http.MethodPost, "/start", req, nil)
+}
+
+func (me ExternalHttpPluginContext) Stop(ctx context.Context) error {
+	return me.request(ctx, http.MethodPost, "/stop", &httpPluginStopRequest{PluginId: me.pluginId()}, nil)
+}
+
+// Health checks the remote service is healthy
+func (me ExternalHttpPluginContext) Health(ctx context.Context) error {
+	return me.request(ctx, http.MethodGet, "/health", nil, nil)
+}
+
+// Invoke posts the arguments to the function, the arguments and results are converted by JSON, ie. numbers are
+// float64
+func (me ExternalHttpPluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	if args == nil {
+		args = []any{}
+	}
+
+	var resp httpPluginInvokeResponse
+	if err := me.request(ctx, http.MethodPost, "/invoke/"+url.PathEscape(funcName),
+		&httpPluginInvokeRequest{Args: args}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
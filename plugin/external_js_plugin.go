@@ -0,0 +1,261 @@
+package qplugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	PLUGIN_JS_START = "pluginStart"
+	PLUGIN_JS_STOP  = "pluginStop"
+)
+
+// ExternalJsPluginContextT runs plugin.js by goja, a pure-Go JavaScript engine. The script exports the functions
+// in the CommonJS way (exports.pluginStart = ... or module.exports = {...}), or declares them as global functions.
+// The host API is the global 'host' object, with the same methods as the host package for Go scripts but the
+// names starting in lower case, ie. host.config(), host.logger().info().msg("..."). console.log/info/debug write to
+// the stdout, console.warn/error write to the stderr.
+type ExternalJsPluginContextT struct {
+	logger comm.Logger
+	host   HostPlugin
+
+	vm      *goja.Runtime
+	exports *goja.Object
+	vmMutex sync.Mutex
+
+	stdout              PluginOutput
+	stderr              PluginOutput
+	outputMaxLineBytes  int
+	outputMaxTotalBytes int64
+}
+
+type ExternalJsPluginContext = *ExternalJsPluginContextT
+
+func NewExternalJsPluginContext() ExternalJsPluginContext {
+	return &ExternalJsPluginContextT{
+		logger: comm.NewDiscardLogger(),
+		host:   nil,
+
+		vm:      nil,
+		exports: nil,
+		vmMutex: sync.Mutex{},
+
+		stdout:              nil,
+		stderr:              nil,
+		outputMaxLineBytes:  DEFAULT_PLUGIN_OUTPUT_MAX_LINE_BYTES,
+		outputMaxTotalBytes: DEFAULT_PLUGIN_OUTPUT_MAX_TOTAL_BYTES,
+	}
+}
+
+// SetOutputLimits limits the size of each line and the total size of each output stream.
+// It affects the Init afterwards.
+func (me ExternalJsPluginContext) SetOutputLimits(maxLineBytes int, maxTotalBytes int64) {
+	me.outputMaxLineBytes = maxLineBytes
+	me.outputMaxTotalBytes = maxTotalBytes
+}
+
+// Stdout returns the stdout of the script, or nil if not initialized yet
+func (me ExternalJsPluginContext) Stdout() PluginOutput {
+	return me.stdout
+}
+
+// Stderr returns the stderr of the script, or nil if not initialized yet
+func (me ExternalJsPluginContext) Stderr() PluginOutput {
+	return me.stderr
+}
+
+func compileExternalJsScript(fs afero.Fs, codeFile string) (*goja.Program, error) {
+	code, err := afero.ReadFile(fs, codeFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", codeFile)
+	}
+
+	r, err := goja.Compile(codeFile, string(code), false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compile %s", codeFile)
+	}
+	return r, nil
+}
+
+func (me ExternalJsPluginContext) Compile(fs afero.Fs, codeFile string) error {
+	_, err := compileExternalJsScript(fs, codeFile)
+	return err
+}
+
+// jsException converts the error thrown by the script, an exception keeps the stack trace
+func jsException(err error) error {
+	var ex *goja.Exception
+	if errors.As(err, &ex) {
+		return errors.New(strings.TrimSpace(ex.String()))
+	}
+	return err
+}
+
+func (me ExternalJsPluginContext) initConsole(vm *goja.Runtime) {
+	writer := func(out PluginOutput) func(goja.FunctionCall) goja.Value {
+		return func(call goja.FunctionCall) goja.Value {
+			parts := make([]string, 0, len(call.Arguments))
+			for _, arg := range call.Arguments {
+				parts = append(parts, arg.String())
+			}
+			out.Write([]byte(strings.Join(parts, " ") + "\n"))
+			return goja.Undefined()
+		}
+	}
+
+	console := vm.NewObject()
+	console.Set("log", writer(me.stdout))
+	console.Set("info", writer(me.stdout))
+	console.Set("debug", writer(me.stdout))
+	console.Set("warn", writer(me.stderr))
+	console.Set("error", writer(me.stderr))
+	vm.Set("console", console)
+}
+
+// Init runs the script, then the exported functions are called by Start, Stop and Invoke
+func (me ExternalJsPluginContext) Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string) {
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("codeFile", codeFile)
+	me.logger = logger.NewSubLogger(logCtx)
+	me.host = host
+
+	program, err := compileExternalJsScript(fs, codeFile)
+	if err != nil {
+		panic(err)
+	}
+
+	loggerOf := func() comm.Logger {
+		if host != nil {
+			return host.Logger()
+		}
+		return me.logger
+	}
+	me.stdout = NewPluginOutput(PLUGIN_OUTPUT_STDOUT, loggerOf, me.outputMaxLineBytes, me.outputMaxTotalBytes)
+	me.stderr = NewPluginOutput(PLUGIN_OUTPUT_STDERR, loggerOf, me.outputMaxLineBytes, me.outputMaxTotalBytes)
+	defer me.flushOutputs()
+
+	vm := goja.New()
+	vm.SetFieldNameMapper(goja.UncapFieldNameMapper())
+	me.initConsole(vm)
+
+	if host != nil {
+		vm.Set("host", host)
+	} else {
+		vm.Set("host", goja.Undefined())
+	}
+
+	module := vm.NewObject()
+	exports := vm.NewObject()
+	module.Set("exports", exports)
+	vm.Set("module", module)
+	vm.Set("exports", exports)
+
+	if _, err := vm.RunProgram(program); err != nil {
+		panic(errors.Wrapf(jsException(err), "run %s", codeFile))
+	}
+
+	me.vm = vm
+	me.exports = module.Get("exports").ToObject(vm)
+}
+
+func (me ExternalJsPluginContext) flushOutputs() {
+	if me.stdout != nil {
+		me.stdout.Flush()
+	}
+	if me.stderr != nil {
+		me.stderr.Flush()
+	}
+}
+
+// resolveFunc returns the exported function, or the global function if not exported, or nil if not found.
+// Must be called with the vm locked.
+func (me ExternalJsPluginContext) resolveFunc(funcName string) goja.Callable {
+	if f, ok := goja.AssertFunction(me.exports.Get(funcName)); ok {
+		return f
+	}
+	if f, ok := goja.AssertFunction(me.vm.Get(funcName)); ok {
+		return f
+	}
+	return nil
+}
+
+// call calls the function with the arguments converted to JavaScript values, the script is interrupted once the
+// context is done
+func (me ExternalJsPluginContext) call(ctx context.Context, funcName string, optional bool, args []any) (goja.Value, error) {
+	me.vmMutex.Lock()
+	defer me.vmMutex.Unlock()
+
+	if me.vm == nil {
+		return nil, fmt.Errorf("%s: plugin is not initialized", funcName)
+	}
+
+	f := me.resolveFunc(funcName)
+	if f == nil {
+		if optional {
+			return goja.Undefined(), nil
+		}
+		return nil, fmt.Errorf("function not found: %s", funcName)
+	}
+
+	jsArgs := make([]goja.Value, 0, len(args))
+	for _, arg := range args {
+		jsArgs = append(jsArgs, me.vm.ToValue(arg))
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			me.vm.Interrupt(ctx.Err())
+		case <-done:
+		}
+	}()
+	defer me.vm.ClearInterrupt()
+
+	r, err := f(goja.Undefined(), jsArgs...)
+	if err != nil {
+		return nil, errors.Wrapf(jsException(err), "%s failed", funcName)
+	}
+	return r, nil
+}
+
+// callLifecycle calls the lifecycle function with the host if the script exports it
+func (me ExternalJsPluginContext) callLifecycle(ctx context.Context, funcName string) error {
+	defer me.flushOutputs()
+
+	var args []any
+	if me.host != nil {
+		args = []any{me.host}
+	}
+	_, err := me.call(ctx, funcName, true, args)
+	return err
+}
+
+func (me ExternalJsPluginContext) Start(ctx context.Context) error {
+	return me.callLifecycle(ctx, PLUGIN_JS_START)
+}
+
+func (me ExternalJsPluginContext) Stop(ctx context.Context) error {
+	return me.callLifecycle(ctx, PLUGIN_JS_STOP)
+}
+
+// Invoke calls the function with the arguments converted to JavaScript values, and returns the result exported
+// as the Go value: undefined and null are nil, numbers are int64 or float64, objects are map[string]any, arrays
+// are []any.
+func (me ExternalJsPluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	defer me.flushOutputs()
+
+	r, err := me.call(ctx, funcName, false, args)
+	if err != nil {
+		return nil, err
+	}
+	return []any{r.Export()}, nil
+}
@@ -1,18 +1,73 @@
 package qplugin
 
 import (
+	"context"
 	"path/filepath"
 	"sync"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/fastgh/go-comm/v2"
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 )
 
 type ExternalPluginContext interface {
-	Init(logger comm.Logger, fs afero.Fs, codeFile string)
-	Start() any
-	Stop() any
+	Compile(fs afero.Fs, codeFile string) error
+	Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string)
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+	PluginInvoker
+}
+
+// externalPluginConstraintsT is what the registry requires of the plugins of a namespace, checked on the manifest
+// while discovering, so that a plugin violating them is never loaded
+type externalPluginConstraintsT struct {
+	namespace string
+
+	// nil means no cap
+	permissionCap []PluginPermission
+
+	// the host version and API level to check the compatibility with, not checked if nil or zero
+	hostVersion *semver.Version
+	apiLevel    int
+}
+
+type externalPluginConstraints = *externalPluginConstraintsT
+
+// sandboxed tells if the namespace has a permission cap
+func (me externalPluginConstraints) sandboxed() bool {
+	return me != nil && me.permissionCap != nil
+}
+
+// manifestVariables returns the variables the registry provides to the manifests, ie. MANIFEST_VAR_HOST_VERSION
+func (me externalPluginConstraints) manifestVariables() map[string]string {
+	r := map[string]string{}
+	if me != nil && me.hostVersion != nil {
+		r[MANIFEST_VAR_HOST_VERSION] = me.hostVersion.Original()
+	}
+	return r
+}
+
+// check returns the violations of the plugin, nil constraints means nothing to check
+func (me externalPluginConstraints) check(plugin ExternalPlugin) error {
+	if me == nil {
+		return nil
+	}
+
+	id := PluginId(me.namespace, plugin.name)
+	if err := checkPluginPermissions(plugin.Permissions(), me.permissionCap); err != nil {
+		return errors.Wrapf(err, "permissions of plugin %s", id)
+	}
+	if err := checkPluginCompatibility(plugin.manifest, me.hostVersion, me.apiLevel); err != nil {
+		return errors.Wrapf(err, "plugin %s is incompatible with the host", id)
+	}
+	return nil
+}
+
+// closablePluginContext is implemented by contexts holding resources since Init, ie. a runtime, which are closed
+// once the plugin won't run: stopped, failed to start, or dropped by the registry
+type closablePluginContext interface {
+	Close(ctx context.Context) error
 }
 
 type ExternalPluginT struct {
@@ -24,10 +79,18 @@ type ExternalPluginT struct {
 	versionMajor int
 	versionMinor int
 	codeFile     string
+	fs           afero.Fs
+
+	// the context is initialized, ie. the plugin code is loaded
+	initialized bool
+	started     bool
 
-	started bool
+	manifest PluginManifest
+	host     externalPluginHost
+	context  ExternalPluginContext
 
-	context ExternalPluginContext
+	// created by the plugin constructor if the kind has a declared interface
+	instance any
 
 	mutex sync.RWMutex
 }
@@ -38,6 +101,52 @@ func (me ExternalPlugin) Name() string {
 	return me.name
 }
 
+// Namespace returns the namespace the plugin is accepted in, or empty if not yet
+func (me ExternalPlugin) Namespace() string {
+	return me.host.Namespace()
+}
+
+func (me ExternalPlugin) Id() string {
+	return me.host.Id()
+}
+
+func (me ExternalPlugin) Manifest() PluginManifest {
+	return me.manifest
+}
+
+// Permissions returns the permissions declared in the manifest, or all permissions for a native or process plugin
+// which can't be sandboxed, or for an unsandboxed plugin without the permissions section
+func (me ExternalPlugin) Permissions() []PluginPermission {
+	if me.language == PLUGIN_LANG_GO_NATIVE || me.language == PLUGIN_LANG_PROCESS || me.manifest.Permissions == nil {
+		return pluginPermissions
+	}
+	return me.manifest.Permissions
+}
+
+// Host returns what the plugin code sees of itself and the host
+func (me ExternalPlugin) Host() HostPlugin {
+	return me.host
+}
+
+// Instance returns the value implementing the interface declared for the kind, or nil if the kind has no declared
+// interface
+func (me ExternalPlugin) Instance() any {
+	return me.instance
+}
+
+// Contributions returns the data contributed by the plugin, ie. a declarative plugin, or nil if the plugin code
+// contributes nothing
+func (me ExternalPlugin) Contributions() []PluginContribution {
+	if c, ok := me.context.(ContributingPlugin); ok {
+		return c.Contributions()
+	}
+	return nil
+}
+
+func (me ExternalPlugin) bindRegistry(namespace string, registry PluginRegistry) {
+	me.host.bind(namespace, registry)
+}
+
 func (me ExternalPlugin) IsStarted() bool {
 	me.mutex.RLock()
 	defer me.mutex.RUnlock()
@@ -53,11 +162,55 @@ func (me ExternalPlugin) Start(logger comm.Logger) {
 		return
 	}
 
-	me.context.Start()
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("pluginId", me.Id())
+	me.host.setLogger(logger.NewSubLogger(logCtx))
+
+	if err := me.init(logger); err != nil {
+		panic(err)
+	}
+
+	if err := me.context.Start(context.Background()); err != nil {
+		me.close(logger)
+		panic(err)
+	}
 
 	me.started = true
 }
 
+// Init initializes the context, which loads the plugin code, then creates the instance if the kind has a declared
+// interface. It's done once, by the registry after the plugin is accepted, or by Start at the latest.
+func (me ExternalPlugin) Init(logger comm.Logger) error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.init(logger)
+}
+
+func (me ExternalPlugin) init(logger comm.Logger) (err error) {
+	if me.initialized {
+		return nil
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = panicToError(p)
+		}
+	}()
+
+	me.context.Init(logger, me.host, me.fs, me.codeFile)
+	me.initialized = true
+
+	instance, err := NewPluginInstance(context.Background(), me.context, me.kind)
+	if err != nil {
+		me.close(logger)
+		return errors.Wrapf(err, "create instance of plugin %s", me.name)
+	}
+	me.instance = instance
+
+	return nil
+}
+
 func (me ExternalPlugin) Kind() PluginKind {
 	return me.kind
 }
@@ -70,9 +223,45 @@ func (me ExternalPlugin) Stop(logger comm.Logger) {
 		return
 	}
 
-	me.context.Stop()
-
 	me.started = false
+	defer me.close(logger)
+
+	if err := me.context.Stop(context.Background()); err != nil {
+		panic(err)
+	}
+}
+
+// release closes the context of the plugin which won't start, ie. its loader failed; it's initialized again if the
+// plugin starts later
+func (me ExternalPlugin) release(logger comm.Logger) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	if !me.started {
+		me.close(logger)
+	}
+}
+
+func (me ExternalPlugin) close(logger comm.Logger) {
+	if !me.initialized {
+		return
+	}
+
+	if c, ok := me.context.(closablePluginContext); ok {
+		if err := c.Close(context.Background()); err != nil {
+			logger.Error(err).Str("pluginId", me.Id()).Msg("failed to close plugin")
+		}
+		me.initialized = false
+	}
+}
+
+// Invoke calls the function defined by the plugin code, see PluginInvoker
+func (me ExternalPlugin) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	results, err := me.context.Invoke(ctx, funcName, args...)
+	if err != nil {
+		return results, errors.Wrapf(err, "invoke plugin %s", me.Id())
+	}
+	return results, nil
 }
 
 func (me ExternalPlugin) Version() (major int, minor int) {
@@ -87,75 +276,115 @@ func (me ExternalPlugin) Dir() string {
 	return me.dir
 }
 
+// CodeFile returns the code file, or the plugin directory if the plugin is a package
 func (me ExternalPlugin) CodeFile() string {
 	return me.codeFile
 }
 
-func ResolveExternalPlugin(logger comm.Logger, fs afero.Fs, pluginDir string) (result ExternalPlugin) {
-	defer func() {
-		if p := recover(); p != nil {
-			logger.Error(p).Str("pluginDir", pluginDir).Msg("failed to resolve external plugin")
-			result = nil
-		}
-	}()
-
-	var mf PluginManifest
-
-	yamlF := filepath.Join(pluginDir, "plugin.manifest.yml")
-	if comm.FileExistsP(fs, yamlF) {
-		mf = PluginManifestWithYamlFile(fs, yamlF)
-	} else {
-		yamlF = filepath.Join(pluginDir, "plugin.manifest.yaml")
-		if comm.FileExistsP(fs, yamlF) {
-			mf = PluginManifestWithYamlFile(fs, yamlF)
-		} else {
-			jsonF := filepath.Join(pluginDir, "plugin.manifest.json")
-			if comm.FileExistsP(fs, jsonF) {
-				mf = PluginManifestWithJsonFile(fs, jsonF)
-			}
-		}
-	}
-
-	if mf == nil {
+// newExternalPlugin creates the plugin with the manifest in pluginDir, without initializing its context. pluginDir
+// is the source file for single-file plugin, whose directory is the plugins directory containing it. The manifest
+// substitutes the variables provided by the constraints. A manifest without the permissions section grants nothing
+// if sandboxed, ie. the namespace has a permission cap, otherwise everything as before the permissions were
+// introduced.
+// Returns nil if pluginDir has no manifest.
+func newExternalPlugin(fs afero.Fs, pluginDir string, constraints externalPluginConstraints) ExternalPlugin {
+	manifestFile := FindPluginManifestFile(fs, pluginDir)
+	if len(manifestFile) == 0 {
 		return nil
 	}
+	if manifestFile == pluginDir {
+		pluginDir = filepath.Dir(pluginDir)
+	}
+	mf := pluginManifestWithFile(fs, manifestFile, constraints.manifestVariables())
 
-	language := PLUGIN_LANG_GO
-	context := NewExternalGoPluginContext()
-	codeFile := filepath.Join(pluginDir, "plugin.go")
-	if exists, err := comm.FileExists(fs, codeFile); err != nil || !exists {
-		return nil
+	if len(mf.Language) == 0 {
+		mf.Language = PLUGIN_LANG_GO
+	}
+	if mf.Permissions == nil && constraints.sandboxed() {
+		mf.Permissions = []PluginPermission{}
 	}
 
-	context.Init(logger, fs, codeFile)
+	codeFile, context, err := newExternalPluginContext(fs, pluginDir, mf)
+	if err != nil {
+		panic(err)
+	}
 
-	result = &ExternalPluginT{
+	return &ExternalPluginT{
+		manifest:     mf,
+		host:         newExternalPluginHost(comm.NewDiscardLogger(), mf),
 		kind:         mf.Kind,
 		name:         mf.Name,
-		language:     language,
+		language:     mf.Language,
 		dir:          pluginDir,
 		versionMajor: mf.VersionMajor,
 		versionMinor: mf.VersionMinor,
 		codeFile:     codeFile,
+		fs:           fs,
+		initialized:  false,
 		started:      false,
 		context:      context,
 		mutex:        sync.RWMutex{},
 	}
+}
+
+// ResolveExternalPlugin creates and initializes the plugin in pluginDir by the runtime of its manifest language.
+// Returns nil if pluginDir has no manifest or the plugin fails to resolve, which is logged.
+func ResolveExternalPlugin(logger comm.Logger, fs afero.Fs, pluginDir string) ExternalPlugin {
+	r, err := resolveExternalPlugin(logger, fs, pluginDir, nil)
+	if err == nil && r != nil {
+		err = r.Init(logger)
+	}
+	if err != nil {
+		logger.Error(err).Str("pluginDir", pluginDir).Msg("failed to resolve external plugin")
+		return nil
+	}
+	return r
+}
+
+// resolveExternalPlugin reads the manifest only, the plugin code isn't loaded until Init. The plugin is rejected if
+// it violates the constraints, ie. requests permissions beyond the cap or is incompatible with the host.
+// Returns nil without error if pluginDir has no manifest.
+func resolveExternalPlugin(logger comm.Logger, fs afero.Fs, pluginDir string, constraints externalPluginConstraints) (result ExternalPlugin, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = panicToError(p)
+			result = nil
+		}
+	}()
+
+	result = newExternalPlugin(fs, pluginDir, constraints)
+	if result == nil {
+		return nil, nil
+	}
+
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("pluginDir", pluginDir)
+	result.host.setLogger(logger.NewSubLogger(logCtx))
+
+	logOutdatedPluginManifest(logger, pluginDir, result.manifest)
+
+	if err := constraints.check(result); err != nil {
+		panic(err)
+	}
 
 	return
 }
 
-func ListExternalPlugins(logger comm.Logger, afs afero.Fs, baseDir string) []ExternalPlugin {
+// listExternalPluginDirs returns the sub directories of baseDir, and the source files which may be single-file
+// plugins, each of them is a candidate plugin
+func listExternalPluginDirs(afs afero.Fs, baseDir string) ([]string, error) {
 	pluginDirOrFiles, err := afero.ReadDir(afs, baseDir)
 	if err != nil {
-		panic(errors.Wrapf(err, "read plugins directories: %s", baseDir))
+		return nil, errors.Wrapf(err, "read plugins directories: %s", baseDir)
 	}
 
-	r := comm.NewOrderedMap[ExternalPlugin](nil)
+	r := make([]string, 0, len(pluginDirOrFiles))
 
 	for _, dirOrFile := range pluginDirOrFiles {
 		if !dirOrFile.IsDir() {
-			continue
+			if _, embedded := embeddedManifestSyntaxes[filepath.Ext(dirOrFile.Name())]; !embedded {
+				continue
+			}
 		}
 
 		fName := dirOrFile.Name()
@@ -164,8 +393,46 @@ func ListExternalPlugins(logger comm.Logger, afs afero.Fs, baseDir string) []Ext
 			continue
 		}
 
-		pluginDir := filepath.Join(baseDir, fName)
-		p := ResolveExternalPlugin(logger, afs, pluginDir)
+		r = append(r, filepath.Join(baseDir, fName))
+	}
+
+	return r, nil
+}
+
+// ListExternalPlugins resolves and initializes the plugins under baseDir, the ones failed to resolve or initialize
+// are logged and skipped
+func ListExternalPlugins(logger comm.Logger, afs afero.Fs, baseDir string) []ExternalPlugin {
+	plugins, _ := listExternalPlugins(logger, afs, baseDir, nil)
+
+	r := make([]ExternalPlugin, 0, len(plugins))
+	for _, p := range plugins {
+		if err := p.Init(logger); err != nil {
+			logger.Error(err).Str("pluginDir", p.Dir()).Msg("failed to initialize external plugin")
+			continue
+		}
+		r = append(r, p)
+	}
+	return r
+}
+
+// listExternalPlugins returns the resolved plugins without initializing them, and a diagnostic for each plugin
+// directory failed to resolve
+func listExternalPlugins(logger comm.Logger, afs afero.Fs, baseDir string, constraints externalPluginConstraints) ([]ExternalPlugin, []PluginDiagnostic) {
+	pluginDirs, err := listExternalPluginDirs(afs, baseDir)
+	if err != nil {
+		panic(err)
+	}
+
+	r := comm.NewOrderedMap[ExternalPlugin](nil)
+	diagnostics := []PluginDiagnostic{}
+
+	for _, pluginDir := range pluginDirs {
+		p, err := resolveExternalPlugin(logger, afs, pluginDir, constraints)
+		if err != nil {
+			logger.Error(err).Str("pluginDir", pluginDir).Msg("failed to resolve external plugin")
+			diagnostics = append(diagnostics, NewPluginDiagnostic(pluginDir, err))
+			continue
+		}
 		if p == nil {
 			continue
 		}
@@ -181,5 +448,5 @@ func ListExternalPlugins(logger comm.Logger, afs afero.Fs, baseDir string) []Ext
 		}
 	}
 
-	return r.Values()
+	return r.Values(), diagnostics
 }
@@ -0,0 +1,474 @@
+package qplugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	DEFAULT_PROCESS_PLUGIN_TIMEOUT   = 30 * time.Second
+	DEFAULT_PROCESS_PLUGIN_HEARTBEAT = 10 * time.Second
+)
+
+// ExternalProcessPluginContextT spawns the executable of the plugin, and talks to it over the protocol described in
+// process_plugin_protocol.go. The child process is killed if a request times out, or a heartbeat fails, or it
+// doesn't exit in time after stopped. Unlike a script plugin, the code is not sandboxed.
+type ExternalProcessPluginContextT struct {
+	logger comm.Logger
+	host   HostPlugin
+
+	args      []string
+	env       map[string]string
+	dir       string
+	timeout   time.Duration
+	heartbeat time.Duration
+
+	codeFile   string
+	executable string
+	workDir    string
+
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	stdinMutex   sync.Mutex
+	stderr       PluginOutput
+	nextId       int64
+	pending      map[int64]chan *processPluginResponse
+	pendingMutex sync.Mutex
+
+	// closed once the child process exits and is reaped
+	exited  chan struct{}
+	exitErr error
+
+	heartbeatStop chan struct{}
+	heartbeatDone chan struct{}
+}
+
+type ExternalProcessPluginContext = *ExternalProcessPluginContextT
+
+func NewExternalProcessPluginContext() ExternalProcessPluginContext {
+	return &ExternalProcessPluginContextT{
+		logger: comm.NewDiscardLogger(),
+		host:   nil,
+
+		args:      nil,
+		env:       map[string]string{},
+		dir:       "",
+		timeout:   DEFAULT_PROCESS_PLUGIN_TIMEOUT,
+		heartbeat: DEFAULT_PROCESS_PLUGIN_HEARTBEAT,
+
+		codeFile:   "",
+		executable: "",
+		workDir:    "",
+
+		cmd:          nil,
+		stdin:        nil,
+		stdinMutex:   sync.Mutex{},
+		stderr:       nil,
+		nextId:       0,
+		pending:      map[int64]chan *processPluginResponse{},
+		pendingMutex: sync.Mutex{},
+
+		exited:  nil,
+		exitErr: nil,
+
+		heartbeatStop: nil,
+		heartbeatDone: nil,
+	}
+}
+
+// SetArgs sets the arguments passed to the executable. It affects the Start afterwards.
+func (me ExternalProcessPluginContext) SetArgs(args []string) {
+	me.args = args
+}
+
+// SetEnv sets the environment variables in addition to the environment of the host process.
+// It affects the Start afterwards.
+func (me ExternalProcessPluginContext) SetEnv(env map[string]string) {
+	me.env = env
+}
+
+// SetDir sets the working directory of the process, relative to the plugin directory, default to the plugin
+// directory. It affects the Init afterwards.
+func (me ExternalProcessPluginContext) SetDir(dir string) {
+	me.dir = dir
+}
+
+// SetTimeout sets how long a request waits for the response, and how long the process is given to exit after
+// stopped. Non-positive means the default.
+func (me ExternalProcessPluginContext) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DEFAULT_PROCESS_PLUGIN_TIMEOUT
+	}
+	me.timeout = timeout
+}
+
+// SetHeartbeat sets the interval of the health requests once started. Non-positive means the default.
+func (me ExternalProcessPluginContext) SetHeartbeat(interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_PROCESS_PLUGIN_HEARTBEAT
+	}
+	me.heartbeat = interval
+}
+
+// Stderr returns the stderr of the process, or nil if not spawned yet
+func (me ExternalProcessPluginContext) Stderr() PluginOutput {
+	return me.stderr
+}
+
+// Pid returns the process id of the child process, or 0 if not spawned yet
+func (me ExternalProcessPluginContext) Pid() int {
+	if me.cmd == nil || me.cmd.Process == nil {
+		return 0
+	}
+	return me.cmd.Process.Pid
+}
+
+// Exited tells if the child process has exited and been reaped
+func (me ExternalProcessPluginContext) Exited() bool {
+	if me.exited == nil {
+		return false
+	}
+	select {
+	case <-me.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// processPluginExecutable returns the path of the executable, which is either in the plugin directory or found in PATH
+func processPluginExecutable(fs afero.Fs, codeFile string) (string, error) {
+	if filepath.IsAbs(codeFile) || strings.ContainsRune(codeFile, filepath.Separator) {
+		if exists, err := comm.FileExists(fs, codeFile); err != nil {
+			return "", err
+		} else if !exists {
+			return "", fmt.Errorf("executable not found: %s", codeFile)
+		}
+		if r, ok := externalPluginRealPath(fs, codeFile); ok {
+			return r, nil
+		}
+		return "", fmt.Errorf("executable %s is not on the OS filesystem", codeFile)
+	}
+
+	r, err := exec.LookPath(codeFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "executable not found: %s", codeFile)
+	}
+	return r, nil
+}
+
+// Compile checks the executable is found
+func (me ExternalProcessPluginContext) Compile(fs afero.Fs, codeFile string) error {
+	_, err := processPluginExecutable(fs, codeFile)
+	return err
+}
+
+// Init checks the executable and the working directory, the process is spawned by Start. codeFile is the
+// executable, either a path or a command found in PATH, in which case the working directory is the current one of
+// the host.
+func (me ExternalProcessPluginContext) Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string) {
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("codeFile", codeFile)
+	me.logger = logger.NewSubLogger(logCtx)
+	me.host = host
+
+	executable, err := processPluginExecutable(fs, codeFile)
+	if err != nil {
+		panic(err)
+	}
+
+	workDir := me.dir
+	if strings.ContainsRune(codeFile, filepath.Separator) {
+		dir := filepath.Join(filepath.Dir(codeFile), me.dir)
+		if workDir, _ = externalPluginRealPath(fs, dir); len(workDir) == 0 {
+			panic(fmt.Errorf("working directory %s is not on the OS filesystem", dir))
+		}
+	}
+
+	me.codeFile = codeFile
+	me.executable = executable
+	me.workDir = workDir
+}
+
+// spawn starts the process and does the handshake, so that the plugin gets its id once bound to the namespace
+func (me ExternalProcessPluginContext) spawn(ctx context.Context) error {
+	if len(me.executable) == 0 {
+		return fmt.Errorf("%s: plugin is not initialized", PROCESS_PLUGIN_METHOD_HANDSHAKE)
+	}
+
+	cmd := exec.Command(me.executable, me.args...)
+	cmd.Dir = me.workDir
+	setProcessPluginGroup(cmd)
+
+	cmd.Env = os.Environ()
+	for k, v := range me.env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	host := me.host
+	loggerOf := func() comm.Logger {
+		if host != nil {
+			return host.Logger()
+		}
+		return me.logger
+	}
+	me.stderr = NewPluginOutput(PLUGIN_OUTPUT_STDERR, loggerOf, 0, 0)
+	cmd.Stderr = me.stderr
+
+	var err error
+	if me.stdin, err = cmd.StdinPipe(); err != nil {
+		return errors.Wrapf(err, "spawn %s", me.codeFile)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrapf(err, "spawn %s", me.codeFile)
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "spawn %s", me.codeFile)
+	}
+	me.cmd = cmd
+	me.exitErr = nil
+	me.exited = make(chan struct{})
+
+	go me.receive(stdout)
+
+	handshake := &ProcessPluginHandshakeT{ProtocolVersion: PROCESS_PLUGIN_PROTOCOL_VERSION}
+	if host != nil {
+		handshake.PluginId = host.Id()
+		handshake.Config = host.Config()
+	}
+
+	var reply ProcessPluginHandshakeT
+	if err := me.call(ctx, PROCESS_PLUGIN_METHOD_HANDSHAKE, handshake, &reply); err != nil {
+		return errors.Wrapf(err, "handshake with %s", me.codeFile)
+	}
+	if reply.ProtocolVersion != PROCESS_PLUGIN_PROTOCOL_VERSION {
+		return fmt.Errorf("%s speaks protocol version %d, but the host speaks %d",
+			me.codeFile, reply.ProtocolVersion, PROCESS_PLUGIN_PROTOCOL_VERSION)
+	}
+	return nil
+}
+
+// receive dispatches the responses to the pending requests until the stdout is closed, then reaps the process
+func (me ExternalProcessPluginContext) receive(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var resp processPluginResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			me.logger.Warn().Err(err).Str("line", scanner.Text()).Msg("invalid message from the plugin process")
+			continue
+		}
+
+		me.pendingMutex.Lock()
+		ch, found := me.pending[resp.Id]
+		delete(me.pending, resp.Id)
+		me.pendingMutex.Unlock()
+
+		if found {
+			ch <- &resp
+		} else {
+			me.logger.Warn().Int64("id", resp.Id).Msg("unexpected response from the plugin process")
+		}
+	}
+
+	me.exitErr = me.cmd.Wait()
+	me.stderr.Flush()
+
+	if me.exitErr != nil {
+		me.logger.Warn().Err(me.exitErr).Msg("plugin process exited")
+	} else {
+		me.logger.Info().Msg("plugin process exited")
+	}
+
+	// the last access, the process may be spawned again afterwards
+	close(me.exited)
+}
+
+func (me ExternalProcessPluginContext) kill() {
+	if me.cmd != nil && me.cmd.Process != nil {
+		killProcessPluginGroup(me.cmd)
+	}
+}
+
+// call sends the request and waits for the response, the process is killed if it doesn't respond in time
+func (me ExternalProcessPluginContext) call(ctx context.Context, method string, params any, result any) error {
+	if me.cmd == nil {
+		return fmt.Errorf("%s: plugin is not initialized", method)
+	}
+	if me.Exited() {
+		return fmt.Errorf("%s: plugin process exited: %v", method, me.exitErr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, me.timeout)
+	defer cancel()
+
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		return errors.Wrapf(err, "%s: marshal params", method)
+	}
+
+	ch := make(chan *processPluginResponse, 1)
+
+	me.stdinMutex.Lock()
+	me.nextId++
+	id := me.nextId
+
+	me.pendingMutex.Lock()
+	me.pending[id] = ch
+	me.pendingMutex.Unlock()
+
+	req := processPluginRequest{JsonRpc: processPluginJsonRpcVersion, Id: id, Method: method, Params: paramsJson}
+	err = json.NewEncoder(me.stdin).Encode(&req)
+	me.stdinMutex.Unlock()
+
+	defer func() {
+		me.pendingMutex.Lock()
+		delete(me.pending, id)
+		me.pendingMutex.Unlock()
+	}()
+
+	if err != nil {
+		return errors.Wrapf(err, "%s: send request", method)
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return errors.Wrapf(resp.Error, "%s failed", method)
+		}
+		if result != nil && len(resp.Result) > 0 {
+			if err := json.Unmarshal(resp.Result, result); err != nil {
+				return errors.Wrapf(err, "%s: unmarshal result", method)
+			}
+		}
+		return nil
+	case <-me.exited:
+		return fmt.Errorf("%s: plugin process exited: %v", method, me.exitErr)
+	case <-ctx.Done():
+		me.kill()
+		return errors.Wrapf(ctx.Err(), "%s: no response, the plugin process is killed", method)
+	}
+}
+
+// runHeartbeat sends the health requests until stopped, the process is killed once a health request fails. done is
+// closed once it returns.
+func (me ExternalProcessPluginContext) runHeartbeat(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(me.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-me.exited:
+			return
+		case <-ticker.C:
+			var health processPluginHealthResult
+			if err := me.call(context.Background(), PROCESS_PLUGIN_METHOD_HEALTH, struct{}{}, &health); err != nil {
+				me.logger.Error(err).Msg("heartbeat failed, kill the plugin process")
+				me.kill()
+				return
+			}
+		}
+	}
+}
+
+// stopHeartbeat stops the health requests and waits for them to end
+func (me ExternalProcessPluginContext) stopHeartbeat() {
+	if me.heartbeatStop == nil {
+		return
+	}
+
+	close(me.heartbeatStop)
+	<-me.heartbeatDone
+	me.heartbeatStop = nil
+	me.heartbeatDone = nil
+}
+
+// Start spawns the process, then asks it to start; the process is killed if either fails
+func (me ExternalProcessPluginContext) Start(ctx context.Context) error {
+	if err := me.spawn(ctx); err != nil {
+		me.Close(ctx)
+		return err
+	}
+	if err := me.call(ctx, PROCESS_PLUGIN_METHOD_START, struct{}{}, nil); err != nil {
+		me.Close(ctx)
+		return err
+	}
+
+	me.stderr.Flush()
+
+	me.heartbeatStop = make(chan struct{})
+	me.heartbeatDone = make(chan struct{})
+	go me.runHeartbeat(me.heartbeatStop, me.heartbeatDone)
+	return nil
+}
+
+// Stop asks the process to stop then closes its stdin, the process is killed if it doesn't exit in time
+func (me ExternalProcessPluginContext) Stop(ctx context.Context) error {
+	me.stopHeartbeat()
+	if me.cmd == nil {
+		return nil
+	}
+
+	err := me.call(ctx, PROCESS_PLUGIN_METHOD_STOP, struct{}{}, nil)
+
+	me.stdinMutex.Lock()
+	me.stdin.Close()
+	me.stdinMutex.Unlock()
+
+	select {
+	case <-me.exited:
+	case <-time.After(me.timeout):
+		me.logger.Warn().Msg("plugin process doesn't exit in time, kill it")
+		me.kill()
+		<-me.exited
+	}
+	return err
+}
+
+// Close kills the process if it's still running, and waits for it to be reaped
+func (me ExternalProcessPluginContext) Close(ctx context.Context) error {
+	me.stopHeartbeat()
+	if me.exited == nil {
+		return nil
+	}
+
+	me.kill()
+	<-me.exited
+	return nil
+}
+
+// Invoke sends the invoke request, the arguments and results are converted by JSON, ie. numbers are float64
+func (me ExternalProcessPluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	if args == nil {
+		args = []any{}
+	}
+
+	if me.stderr != nil {
+		defer me.stderr.Flush()
+	}
+
+	var result processPluginInvokeResult
+	params := &processPluginInvokeParams{Function: funcName, Args: args}
+	if err := me.call(ctx, PROCESS_PLUGIN_METHOD_INVOKE, params, &result); err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
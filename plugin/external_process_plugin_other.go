@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package qplugin
+
+import (
+	"os/exec"
+)
+
+// setProcessPluginGroup does nothing, process groups are not supported
+func setProcessPluginGroup(cmd *exec.Cmd) {}
+
+// killProcessPluginGroup kills the process only, process groups are not supported
+func killProcessPluginGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package qplugin
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessPluginGroup starts the process in its own process group, so that the processes it spawns are killed
+// together with it
+func setProcessPluginGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessPluginGroup kills the process group of the process
+func killProcessPluginGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
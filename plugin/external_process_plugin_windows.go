@@ -0,0 +1,19 @@
+//go:build windows
+
+package qplugin
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessPluginGroup starts the process in a new process group, which doesn't receive the console signals of
+// the host
+func setProcessPluginGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessPluginGroup kills the process only, a process group can't be killed as a whole on windows
+func killProcessPluginGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,376 @@
+package qplugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const (
+	PLUGIN_SHELL_START = "plugin_start"
+	PLUGIN_SHELL_STOP  = "plugin_stop"
+
+	// how long an external command is given to exit after interrupted, before it's killed
+	pluginShellKillTimeout = 2 * time.Second
+)
+
+// ExternalShellPluginContextT runs plugin.sh in-process by the mvdan.cc/sh interpreter. The script defines the
+// plugin_start / plugin_stop functions and the functions to invoke; each call runs in a subshell, so an exit or a
+// variable set by the call doesn't affect the others. A non-zero exit status is a failure.
+type ExternalShellPluginContextT struct {
+	logger comm.Logger
+	host   HostPlugin
+
+	runner      *interp.Runner
+	runnerMutex sync.Mutex
+
+	env         map[string]string
+	dir         string
+	permissions []PluginPermission
+
+	stdout              PluginOutput
+	stderr              PluginOutput
+	outputMaxLineBytes  int
+	outputMaxTotalBytes int64
+}
+
+type ExternalShellPluginContext = *ExternalShellPluginContextT
+
+func NewExternalShellPluginContext() ExternalShellPluginContext {
+	return &ExternalShellPluginContextT{
+		logger: comm.NewDiscardLogger(),
+		host:   nil,
+
+		runner:      nil,
+		runnerMutex: sync.Mutex{},
+
+		env:         map[string]string{},
+		dir:         "",
+		permissions: nil,
+
+		stdout:              nil,
+		stderr:              nil,
+		outputMaxLineBytes:  DEFAULT_PLUGIN_OUTPUT_MAX_LINE_BYTES,
+		outputMaxTotalBytes: DEFAULT_PLUGIN_OUTPUT_MAX_TOTAL_BYTES,
+	}
+}
+
+// SetEnv sets the environment variables of the script. It affects the Init afterwards.
+func (me ExternalShellPluginContext) SetEnv(env map[string]string) {
+	me.env = env
+}
+
+// SetDir sets the working directory of the script, relative to the plugin directory, default to the plugin
+// directory. It affects the Init afterwards.
+func (me ExternalShellPluginContext) SetDir(dir string) {
+	me.dir = dir
+}
+
+func (me ExternalShellPluginContext) Permissions() []PluginPermission {
+	return me.permissions
+}
+
+// SetPermissions restricts the script: external commands require the exec permission, reading and writing files
+// by redirections require fs.read and fs.write, and the environment of the host process is inherited only with
+// the env permission. nil means unrestricted. It affects the Init afterwards.
+func (me ExternalShellPluginContext) SetPermissions(permissions []PluginPermission) {
+	me.permissions = permissions
+}
+
+// SetOutputLimits limits the size of each line and the total size of each output stream, and the total size is
+// also the limit of the result of each Invoke. It affects the Init afterwards.
+func (me ExternalShellPluginContext) SetOutputLimits(maxLineBytes int, maxTotalBytes int64) {
+	me.outputMaxLineBytes = maxLineBytes
+	me.outputMaxTotalBytes = maxTotalBytes
+}
+
+// Stdout returns the stdout of the script, or nil if not initialized yet
+func (me ExternalShellPluginContext) Stdout() PluginOutput {
+	return me.stdout
+}
+
+// Stderr returns the stderr of the script, or nil if not initialized yet
+func (me ExternalShellPluginContext) Stderr() PluginOutput {
+	return me.stderr
+}
+
+func (me ExternalShellPluginContext) allows(permission PluginPermission) bool {
+	return me.permissions == nil || hasPluginPermission(me.permissions, permission)
+}
+
+func parseExternalShellScript(fs afero.Fs, codeFile string) (*syntax.File, error) {
+	code, err := afero.ReadFile(fs, codeFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", codeFile)
+	}
+
+	r, err := syntax.NewParser().Parse(bytes.NewReader(code), codeFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", codeFile)
+	}
+	return r, nil
+}
+
+func (me ExternalShellPluginContext) Compile(fs afero.Fs, codeFile string) error {
+	_, err := parseExternalShellScript(fs, codeFile)
+	return err
+}
+
+// externalPluginRealPath returns the path on the OS filesystem, or false if the filesystem isn't backed by it
+func externalPluginRealPath(fs afero.Fs, path string) (string, bool) {
+	switch f := fs.(type) {
+	case *afero.OsFs:
+		return path, true
+	case *afero.BasePathFs:
+		if r, err := f.RealPath(path); err == nil {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+// environ returns the environment of the script, sorted by name
+func (me ExternalShellPluginContext) environ() []string {
+	vars := map[string]string{}
+	if me.allows(PLUGIN_PERMISSION_ENV) {
+		for _, kv := range os.Environ() {
+			if k, v, found := strings.Cut(kv, "="); found {
+				vars[k] = v
+			}
+		}
+	} else if me.allows(PLUGIN_PERMISSION_EXEC) {
+		// external commands are not found without PATH
+		vars["PATH"] = os.Getenv("PATH")
+	}
+	for k, v := range me.env {
+		vars[k] = v
+	}
+
+	r := make([]string, 0, len(vars))
+	for k, v := range vars {
+		r = append(r, k+"="+v)
+	}
+	sort.Strings(r)
+	return r
+}
+
+func (me ExternalShellPluginContext) execHandler() interp.ExecHandlerFunc {
+	if me.allows(PLUGIN_PERMISSION_EXEC) {
+		return interp.DefaultExecHandler(pluginShellKillTimeout)
+	}
+
+	return func(ctx context.Context, args []string) error {
+		return fmt.Errorf("%s: command requires permission %s", args[0], PLUGIN_PERMISSION_EXEC)
+	}
+}
+
+func (me ExternalShellPluginContext) openHandler() interp.OpenHandlerFunc {
+	open := interp.DefaultOpenHandler()
+
+	return func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+		if path != "/dev/null" {
+			if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+				if !me.allows(PLUGIN_PERMISSION_FS_WRITE) {
+					return nil, fmt.Errorf("%s: write requires permission %s", path, PLUGIN_PERMISSION_FS_WRITE)
+				}
+			} else if !me.allows(PLUGIN_PERMISSION_FS_READ) {
+				return nil, fmt.Errorf("%s: read requires permission %s", path, PLUGIN_PERMISSION_FS_READ)
+			}
+		}
+		return open(ctx, path, flag, perm)
+	}
+}
+
+// readDirHandler requires fs.read to read directories, ie. for globbing
+func (me ExternalShellPluginContext) readDirHandler() interp.ReadDirHandlerFunc {
+	readDir := interp.DefaultReadDirHandler()
+
+	return func(ctx context.Context, path string) ([]os.FileInfo, error) {
+		if !me.allows(PLUGIN_PERMISSION_FS_READ) {
+			return nil, fmt.Errorf("%s: read requires permission %s", path, PLUGIN_PERMISSION_FS_READ)
+		}
+		return readDir(ctx, path)
+	}
+}
+
+// statHandler requires fs.read to get the file stat, ie. for 'test -e' and 'cd'
+func (me ExternalShellPluginContext) statHandler() interp.StatHandlerFunc {
+	stat := interp.DefaultStatHandler()
+
+	return func(ctx context.Context, name string, followSymlinks bool) (os.FileInfo, error) {
+		if !me.allows(PLUGIN_PERMISSION_FS_READ) {
+			return nil, fmt.Errorf("%s: stat requires permission %s", name, PLUGIN_PERMISSION_FS_READ)
+		}
+		return stat(ctx, name, followSymlinks)
+	}
+}
+
+// Init runs the script, which defines the functions, then the functions are called by Start, Stop and Invoke
+func (me ExternalShellPluginContext) Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string) {
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("codeFile", codeFile)
+	me.logger = logger.NewSubLogger(logCtx)
+	me.host = host
+
+	script, err := parseExternalShellScript(fs, codeFile)
+	if err != nil {
+		panic(err)
+	}
+
+	loggerOf := func() comm.Logger {
+		if host != nil {
+			return host.Logger()
+		}
+		return me.logger
+	}
+	me.stdout = NewPluginOutput(PLUGIN_OUTPUT_STDOUT, loggerOf, me.outputMaxLineBytes, me.outputMaxTotalBytes)
+	me.stderr = NewPluginOutput(PLUGIN_OUTPUT_STDERR, loggerOf, me.outputMaxLineBytes, me.outputMaxTotalBytes)
+
+	opts := []interp.RunnerOption{
+		interp.Params("-e"),
+		interp.Env(expand.ListEnviron(me.environ()...)),
+		interp.ExecHandler(me.execHandler()),
+		interp.OpenHandler(me.openHandler()),
+		interp.ReadDirHandler(me.readDirHandler()),
+		interp.StatHandler(me.statHandler()),
+		interp.StdIO(bytes.NewReader(nil), me.stdout, me.stderr),
+	}
+
+	dir := filepath.Join(filepath.Dir(codeFile), me.dir)
+	if realDir, ok := externalPluginRealPath(fs, dir); ok {
+		opts = append(opts, interp.Dir(realDir))
+	} else if len(me.dir) > 0 {
+		panic(fmt.Errorf("working directory %s is not on the OS filesystem", dir))
+	}
+
+	runner, err := interp.New(opts...)
+	if err != nil {
+		panic(errors.Wrapf(err, "create shell runner for %s", codeFile))
+	}
+
+	defer me.flushOutputs()
+
+	// runs statement by statement, since running the whole file implies an exit
+	for _, stmt := range script.Stmts {
+		if err := runner.Run(context.Background(), stmt); err != nil {
+			panic(errors.Wrapf(err, "run %s", codeFile))
+		}
+		if runner.Exited() {
+			panic(fmt.Errorf("%s exits during initialization", codeFile))
+		}
+	}
+
+	me.runner = runner
+}
+
+func (me ExternalShellPluginContext) flushOutputs() {
+	if me.stdout != nil {
+		me.stdout.Flush()
+	}
+	if me.stderr != nil {
+		me.stderr.Flush()
+	}
+}
+
+// HasFunc tells if the script defines the function
+func (me ExternalShellPluginContext) HasFunc(funcName string) bool {
+	me.runnerMutex.Lock()
+	defer me.runnerMutex.Unlock()
+
+	if me.runner == nil {
+		return false
+	}
+	_, found := me.runner.Funcs[funcName]
+	return found
+}
+
+// call runs the function in a subshell of the script, with the stdout redirected if specified
+func (me ExternalShellPluginContext) call(ctx context.Context, stdout io.Writer, funcName string, args []string) error {
+	me.runnerMutex.Lock()
+	if me.runner == nil {
+		me.runnerMutex.Unlock()
+		return fmt.Errorf("%s: plugin is not initialized", funcName)
+	}
+	if _, found := me.runner.Funcs[funcName]; !found {
+		me.runnerMutex.Unlock()
+		return fmt.Errorf("function not found: %s", funcName)
+	}
+	subshell := me.runner.Subshell()
+	me.runnerMutex.Unlock()
+
+	if stdout == nil {
+		stdout = me.stdout
+	}
+	if err := interp.StdIO(bytes.NewReader(nil), stdout, me.stderr)(subshell); err != nil {
+		return err
+	}
+
+	words := make([]*syntax.Word, 0, len(args)+1)
+	for _, s := range append([]string{funcName}, args...) {
+		words = append(words, &syntax.Word{Parts: []syntax.WordPart{&syntax.SglQuoted{Value: s, Dollar: false}}})
+	}
+	stmt := &syntax.Stmt{Cmd: &syntax.CallExpr{Args: words}}
+
+	if err := subshell.Run(ctx, stmt); err != nil {
+		return errors.Wrapf(err, "%s failed", funcName)
+	}
+	return nil
+}
+
+// callLifecycle calls the lifecycle function if the script defines it
+func (me ExternalShellPluginContext) callLifecycle(ctx context.Context, funcName string) error {
+	if !me.HasFunc(funcName) {
+		return nil
+	}
+
+	defer me.flushOutputs()
+	return me.call(ctx, nil, funcName, nil)
+}
+
+func (me ExternalShellPluginContext) Start(ctx context.Context) error {
+	return me.callLifecycle(ctx, PLUGIN_SHELL_START)
+}
+
+func (me ExternalShellPluginContext) Stop(ctx context.Context) error {
+	return me.callLifecycle(ctx, PLUGIN_SHELL_STOP)
+}
+
+// Invoke calls the shell function with the arguments formatted as strings, and returns its stdout as the only
+// result, without the trailing line break. The stderr goes to the logger.
+func (me ExternalShellPluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	strArgs := make([]string, 0, len(args))
+	for _, arg := range args {
+		strArgs = append(strArgs, fmt.Sprint(arg))
+	}
+
+	defer me.flushOutputs()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := newPluginResultBuffer(me.outputMaxTotalBytes, cancel)
+	if err := me.call(ctx, out, funcName, strArgs); err != nil {
+		if limitErr := out.err(); limitErr != nil {
+			return nil, errors.Wrapf(limitErr, "%s failed", funcName)
+		}
+		return nil, err
+	}
+	if err := out.err(); err != nil {
+		return nil, errors.Wrapf(err, "%s failed", funcName)
+	}
+	return []any{strings.TrimSuffix(out.String(), "\n")}, nil
+}
@@ -0,0 +1,504 @@
+package qplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	// 64KB per page
+	DEFAULT_WASM_PLUGIN_MAX_MEMORY_PAGES = 1024
+	DEFAULT_WASM_PLUGIN_TIMEOUT          = 30 * time.Second
+
+	PLUGIN_WASM_START = "plugin_start"
+	PLUGIN_WASM_STOP  = "plugin_stop"
+
+	// the module of the host ABI imported by the plugin:
+	//
+	//	log(level i32, ptr i32, len i32)
+	//	  logs the string, level is 0 debug, 1 info, 2 warn, 3 error
+	//	config_get(key_ptr i32, key_len i32, buf_ptr i32, buf_cap i32) -> i32
+	//	  writes the config value as JSON to the buffer, returns its length, or -1 if not found
+	//	call_host(name_ptr i32, name_len i32, args_ptr i32, args_len i32, buf_ptr i32, buf_cap i32) -> i32
+	//	  calls the host function with the args in JSON, writes the result as JSON to the buffer, returns its
+	//	  length; on failure, writes the error message instead and returns -1 - its length
+	//
+	// Nothing is written if the buffer is smaller than the length, so that the plugin retries with a larger one.
+	WASM_HOST_MODULE = "qplugin"
+)
+
+// WasmHostFunction is called by a wasm plugin via call_host, args is the JSON from the plugin, and the result is
+// returned to the plugin as JSON
+type WasmHostFunction = func(ctx context.Context, host HostPlugin, args json.RawMessage) (any, error)
+
+var (
+	wasmHostFunctions      = map[string]WasmHostFunction{}
+	wasmHostFunctionsMutex sync.RWMutex
+)
+
+// RegisterWasmHostFunction adds the function for wasm plugins to call via call_host
+func RegisterWasmHostFunction(name string, f WasmHostFunction) {
+	wasmHostFunctionsMutex.Lock()
+	defer wasmHostFunctionsMutex.Unlock()
+
+	wasmHostFunctions[name] = f
+}
+
+func wasmHostFunction(name string) WasmHostFunction {
+	wasmHostFunctionsMutex.RLock()
+	defer wasmHostFunctionsMutex.RUnlock()
+
+	return wasmHostFunctions[name]
+}
+
+// ExternalWasmPluginContextT runs plugin.wasm by wazero, a pure-Go WebAssembly runtime. The plugin imports the host
+// ABI described by WASM_HOST_MODULE, and exports plugin_start / plugin_stop and the functions to invoke, whose
+// parameters and results are numbers. WASI is available only with the wasi permission; the environment variables
+// require the env permission, and the plugin directory is mounted as / with fs.read (read-only) or fs.write.
+type ExternalWasmPluginContextT struct {
+	logger comm.Logger
+	host   HostPlugin
+
+	permissions    []PluginPermission
+	maxMemoryPages uint32
+	timeout        time.Duration
+
+	runtime     wazero.Runtime
+	module      api.Module
+	moduleMutex sync.Mutex
+
+	stdout PluginOutput
+	stderr PluginOutput
+}
+
+type ExternalWasmPluginContext = *ExternalWasmPluginContextT
+
+func NewExternalWasmPluginContext() ExternalWasmPluginContext {
+	return &ExternalWasmPluginContextT{
+		logger: comm.NewDiscardLogger(),
+		host:   nil,
+
+		permissions:    nil,
+		maxMemoryPages: DEFAULT_WASM_PLUGIN_MAX_MEMORY_PAGES,
+		timeout:        DEFAULT_WASM_PLUGIN_TIMEOUT,
+
+		runtime:     nil,
+		module:      nil,
+		moduleMutex: sync.Mutex{},
+
+		stdout: nil,
+		stderr: nil,
+	}
+}
+
+func (me ExternalWasmPluginContext) Permissions() []PluginPermission {
+	return me.permissions
+}
+
+// SetPermissions sets what the plugin may access via WASI, nil means unrestricted. It affects the Init afterwards.
+func (me ExternalWasmPluginContext) SetPermissions(permissions []PluginPermission) {
+	me.permissions = permissions
+}
+
+// SetMaxMemoryPages limits the memory of the plugin, in 64KB pages. Zero means the default.
+// It affects the Init afterwards.
+func (me ExternalWasmPluginContext) SetMaxMemoryPages(pages uint32) {
+	if pages == 0 {
+		pages = DEFAULT_WASM_PLUGIN_MAX_MEMORY_PAGES
+	}
+	me.maxMemoryPages = pages
+}
+
+// SetTimeout limits the execution time of each call, the module is closed once a call times out.
+// Non-positive means the default.
+func (me ExternalWasmPluginContext) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DEFAULT_WASM_PLUGIN_TIMEOUT
+	}
+	me.timeout = timeout
+}
+
+func (me ExternalWasmPluginContext) allows(permission PluginPermission) bool {
+	return me.permissions == nil || hasPluginPermission(me.permissions, permission)
+}
+
+func (me ExternalWasmPluginContext) newRuntime(ctx context.Context) wazero.Runtime {
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(me.maxMemoryPages).
+		WithCloseOnContextDone(true)
+	return wazero.NewRuntimeWithConfig(ctx, config)
+}
+
+// compile compiles the module and checks it imports WASI only if permitted
+func (me ExternalWasmPluginContext) compile(ctx context.Context, runtime wazero.Runtime, fs afero.Fs, codeFile string) (wazero.CompiledModule, error) {
+	code, err := afero.ReadFile(fs, codeFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", codeFile)
+	}
+
+	r, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compile %s", codeFile)
+	}
+
+	if !me.allows(PLUGIN_PERMISSION_WASI) {
+		for _, f := range r.ImportedFunctions() {
+			if moduleName, name, _ := f.Import(); moduleName == wasi_snapshot_preview1.ModuleName {
+				return nil, fmt.Errorf("%s: import %s.%s requires permission %s",
+					codeFile, moduleName, name, PLUGIN_PERMISSION_WASI)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (me ExternalWasmPluginContext) Compile(fs afero.Fs, codeFile string) error {
+	ctx := context.Background()
+
+	runtime := me.newRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	_, err := me.compile(ctx, runtime, fs, codeFile)
+	return err
+}
+
+func (me ExternalWasmPluginContext) pluginLogger() comm.Logger {
+	if me.host != nil {
+		return me.host.Logger()
+	}
+	return me.logger
+}
+
+// readWasmString reads the string from the memory of the plugin, panics if out of range, which traps the plugin
+func readWasmString(mod api.Module, ptr uint32, length uint32) string {
+	b, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		panic(fmt.Errorf("memory access out of range: %d+%d", ptr, length))
+	}
+	return string(b)
+}
+
+// writeWasmBuffer writes the data to the buffer of the plugin if it fits, and returns the length of the data
+func writeWasmBuffer(mod api.Module, ptr uint32, capacity uint32, data []byte) int32 {
+	if uint32(len(data)) <= capacity && !mod.Memory().Write(ptr, data) {
+		panic(fmt.Errorf("memory access out of range: %d+%d", ptr, len(data)))
+	}
+	return int32(len(data))
+}
+
+func (me ExternalWasmPluginContext) hostLog(ctx context.Context, mod api.Module, level uint32, ptr uint32, length uint32) {
+	msg := readWasmString(mod, ptr, length)
+
+	logger := me.pluginLogger()
+	switch level {
+	case 0:
+		logger.Debug().Msg(msg)
+	case 1:
+		logger.Info().Msg(msg)
+	case 2:
+		logger.Warn().Msg(msg)
+	default:
+		logger.Error(nil).Msg(msg)
+	}
+}
+
+func (me ExternalWasmPluginContext) hostConfigGet(ctx context.Context, mod api.Module, keyPtr, keyLen, bufPtr, bufCap uint32) int32 {
+	key := readWasmString(mod, keyPtr, keyLen)
+
+	if me.host == nil {
+		return -1
+	}
+	v, found := me.host.Config()[key]
+	if !found {
+		return -1
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(errors.Wrapf(err, "marshal config %s", key))
+	}
+	return writeWasmBuffer(mod, bufPtr, bufCap, data)
+}
+
+func (me ExternalWasmPluginContext) hostCall(ctx context.Context, mod api.Module, namePtr, nameLen, argsPtr, argsLen, bufPtr, bufCap uint32) int32 {
+	name := readWasmString(mod, namePtr, nameLen)
+	args := readWasmString(mod, argsPtr, argsLen)
+
+	fail := func(err error) int32 {
+		return -1 - writeWasmBuffer(mod, bufPtr, bufCap, []byte(err.Error()))
+	}
+
+	f := wasmHostFunction(name)
+	if f == nil {
+		return fail(fmt.Errorf("host function not found: %s", name))
+	}
+
+	result, err := f(ctx, me.host, json.RawMessage(args))
+	if err != nil {
+		return fail(err)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fail(errors.Wrapf(err, "marshal result of %s", name))
+	}
+	return writeWasmBuffer(mod, bufPtr, bufCap, data)
+}
+
+func (me ExternalWasmPluginContext) instantiateHostModule(ctx context.Context, runtime wazero.Runtime) error {
+	_, err := runtime.NewHostModuleBuilder(WASM_HOST_MODULE).
+		NewFunctionBuilder().WithFunc(me.hostLog).Export("log").
+		NewFunctionBuilder().WithFunc(me.hostConfigGet).Export("config_get").
+		NewFunctionBuilder().WithFunc(me.hostCall).Export("call_host").
+		Instantiate(ctx)
+	return err
+}
+
+// moduleConfig configures WASI if permitted: stdio goes to the logger, the environment and the plugin directory
+// follow the permissions
+func (me ExternalWasmPluginContext) moduleConfig(fs afero.Fs, codeFile string) wazero.ModuleConfig {
+	r := wazero.NewModuleConfig().
+		WithName(filepath.Base(filepath.Dir(codeFile))).
+		WithStartFunctions("_initialize", "_start")
+
+	if !me.allows(PLUGIN_PERMISSION_WASI) {
+		return r
+	}
+
+	r = r.WithStdout(me.stdout).WithStderr(me.stderr).
+		WithSysWalltime().WithSysNanotime().WithSysNanosleep().
+		WithArgs(filepath.Base(codeFile))
+
+	if me.allows(PLUGIN_PERMISSION_ENV) {
+		for _, kv := range os.Environ() {
+			if k, v, found := strings.Cut(kv, "="); found {
+				r = r.WithEnv(k, v)
+			}
+		}
+	}
+
+	if dir, ok := externalPluginRealPath(fs, filepath.Dir(codeFile)); ok {
+		if me.allows(PLUGIN_PERMISSION_FS_WRITE) {
+			r = r.WithFSConfig(wazero.NewFSConfig().WithDirMount(dir, "/"))
+		} else if me.allows(PLUGIN_PERMISSION_FS_READ) {
+			r = r.WithFSConfig(wazero.NewFSConfig().WithReadOnlyDirMount(dir, "/"))
+		}
+	}
+	return r
+}
+
+// Init instantiates the module, which runs its _initialize or _start function if exported
+func (me ExternalWasmPluginContext) Init(logger comm.Logger, host HostPlugin, fs afero.Fs, codeFile string) {
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("codeFile", codeFile)
+	me.logger = logger.NewSubLogger(logCtx)
+	me.host = host
+
+	me.stdout = NewPluginOutput(PLUGIN_OUTPUT_STDOUT, me.pluginLogger, 0, 0)
+	me.stderr = NewPluginOutput(PLUGIN_OUTPUT_STDERR, me.pluginLogger, 0, 0)
+	defer me.flushOutputs()
+
+	ctx := context.Background()
+	runtime := me.newRuntime(ctx)
+
+	ok := false
+	defer func() {
+		if !ok {
+			runtime.Close(ctx)
+		}
+	}()
+
+	compiled, err := me.compile(ctx, runtime, fs, codeFile)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := me.instantiateHostModule(ctx, runtime); err != nil {
+		panic(errors.Wrapf(err, "instantiate host module for %s", codeFile))
+	}
+	if me.allows(PLUGIN_PERMISSION_WASI) {
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+			panic(errors.Wrapf(err, "instantiate WASI for %s", codeFile))
+		}
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, me.timeout)
+	defer cancel()
+
+	module, err := runtime.InstantiateModule(callCtx, compiled, me.moduleConfig(fs, codeFile))
+	if err != nil {
+		panic(errors.Wrapf(err, "instantiate %s", codeFile))
+	}
+
+	me.runtime = runtime
+	me.module = module
+	ok = true
+}
+
+func (me ExternalWasmPluginContext) flushOutputs() {
+	if me.stdout != nil {
+		me.stdout.Flush()
+	}
+	if me.stderr != nil {
+		me.stderr.Flush()
+	}
+}
+
+// wasmValueTypes maps the wasm value types to the Go types which the arguments convert to
+var wasmValueTypes = map[api.ValueType]reflect.Type{
+	api.ValueTypeI32: reflect.TypeOf(int32(0)),
+	api.ValueTypeI64: reflect.TypeOf(int64(0)),
+	api.ValueTypeF32: reflect.TypeOf(float32(0)),
+	api.ValueTypeF64: reflect.TypeOf(float64(0)),
+}
+
+func encodeWasmValue(funcName string, index int, t api.ValueType, arg any) (uint64, error) {
+	goType, supported := wasmValueTypes[t]
+	if !supported {
+		return 0, fmt.Errorf("argument %d of %s: unsupported type %s", index, funcName, api.ValueTypeName(t))
+	}
+
+	v, err := reflectInvokeArg(funcName, index, goType, arg)
+	if err != nil {
+		return 0, err
+	}
+
+	switch t {
+	case api.ValueTypeI32:
+		return api.EncodeI32(int32(v.Int())), nil
+	case api.ValueTypeI64:
+		return api.EncodeI64(v.Int()), nil
+	case api.ValueTypeF32:
+		return api.EncodeF32(float32(v.Float())), nil
+	default:
+		return api.EncodeF64(v.Float()), nil
+	}
+}
+
+func decodeWasmValue(t api.ValueType, v uint64) any {
+	switch t {
+	case api.ValueTypeI32:
+		return api.DecodeI32(v)
+	case api.ValueTypeI64:
+		return int64(v)
+	case api.ValueTypeF32:
+		return api.DecodeF32(v)
+	case api.ValueTypeF64:
+		return api.DecodeF64(v)
+	default:
+		return v
+	}
+}
+
+// call calls the exported function within the timeout, the module is closed if it times out
+func (me ExternalWasmPluginContext) call(ctx context.Context, funcName string, optional bool, args []any) ([]any, error) {
+	me.moduleMutex.Lock()
+	defer me.moduleMutex.Unlock()
+
+	if me.module == nil {
+		return nil, fmt.Errorf("%s: plugin is not initialized", funcName)
+	}
+
+	f := me.module.ExportedFunction(funcName)
+	if f == nil {
+		if optional {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("function not found: %s", funcName)
+	}
+
+	def := f.Definition()
+	paramTypes := def.ParamTypes()
+	if len(args) != len(paramTypes) {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", funcName, len(paramTypes), len(args))
+	}
+
+	params := make([]uint64, 0, len(args))
+	for i, arg := range args {
+		v, err := encodeWasmValue(funcName, i, paramTypes[i], arg)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, me.timeout)
+	defer cancel()
+
+	out, err := f.Call(ctx, params...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s failed", funcName)
+	}
+
+	results := make([]any, 0, len(out))
+	for i, t := range def.ResultTypes() {
+		results = append(results, decodeWasmValue(t, out[i]))
+	}
+	return results, nil
+}
+
+// callLifecycle calls the lifecycle function if exported, a non-zero result is a failure
+func (me ExternalWasmPluginContext) callLifecycle(ctx context.Context, funcName string) error {
+	defer me.flushOutputs()
+
+	results, err := me.call(ctx, funcName, true, nil)
+	if err != nil {
+		return err
+	}
+	if len(results) > 0 && results[0] != int32(0) && results[0] != int64(0) {
+		return fmt.Errorf("%s returns %v", funcName, results[0])
+	}
+	return nil
+}
+
+func (me ExternalWasmPluginContext) Start(ctx context.Context) error {
+	return me.callLifecycle(ctx, PLUGIN_WASM_START)
+}
+
+// Stop calls plugin_stop, then closes the module and the runtime even if plugin_stop fails
+func (me ExternalWasmPluginContext) Stop(ctx context.Context) error {
+	err := me.callLifecycle(ctx, PLUGIN_WASM_STOP)
+	if closeErr := me.Close(ctx); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close closes the module and the runtime, the calls afterwards fail until Init again
+func (me ExternalWasmPluginContext) Close(ctx context.Context) error {
+	me.moduleMutex.Lock()
+	defer me.moduleMutex.Unlock()
+
+	errs := comm.NewErrorGroup(false)
+	if me.module != nil {
+		errs.Add(me.module.Close(ctx))
+		me.module = nil
+	}
+	if me.runtime != nil {
+		errs.Add(me.runtime.Close(ctx))
+		me.runtime = nil
+	}
+	return errs.MayError()
+}
+
+// Invoke calls the exported function, the arguments are converted to the parameter types if no loss, and the
+// results are int32, int64, float32 or float64 as the result types
+func (me ExternalWasmPluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	defer me.flushOutputs()
+
+	return me.call(ctx, funcName, false, args)
+}
@@ -12,6 +12,12 @@ type FsPluginLoaderT struct {
 
 	fs  afero.Fs
 	dir string
+
+	// nil means no constraint
+	constraints externalPluginConstraints
+
+	// the plugin directories failed to resolve in the last discovery
+	diagnostics []PluginDiagnostic
 }
 
 type FsPluginLoader = *FsPluginLoaderT
@@ -32,32 +38,54 @@ func NewFsPluginLoader(logger comm.Logger, fs afero.Fs, dir string, namespace st
 	}
 }
 
-func (me FsPluginLoader) Start(logger comm.Logger) error {
+func (me FsPluginLoader) Dir() string {
+	return me.dir
+}
+
+func (me FsPluginLoader) constrain(constraints externalPluginConstraints) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
 
-	if me.started {
-		logger.Info().Msg("started, already")
-		return nil
-	}
+	me.constraints = constraints
+}
 
-	errs := comm.NewErrorGroup(false)
-	ns := me.Namespace()
+// Diagnostics returns the plugin directories failed to resolve in the last discovery, ie. an unknown language or
+// an incompatible host
+func (me FsPluginLoader) Diagnostics() []PluginDiagnostic {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
 
-	for _, plugin := range ListExternalPlugins(logger, me.fs, filepath.Join(me.dir, me.namespace)) {
-		me.Register(plugin)
-	}
+	return me.diagnostics
+}
 
-	for _, plugin := range me.plugins {
-		if err := StartPlugin(ns, plugin, logger); err != nil {
-			errs.Add(err)
+// Discover lists the external plugins under the namespace directory, together with the registered ones as
+// candidates. Only the manifests are read, the registry decides which of them to accept, then initialize and start.
+func (me FsPluginLoader) Discover(logger comm.Logger) (result []Plugin, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = panicToError(p)
+			result = nil
 		}
-	}
+	}()
+
+	me.mutex.RLock()
+	constraints := me.constraints
+	me.mutex.RUnlock()
+
+	externalPlugins, diagnostics := listExternalPlugins(logger, me.fs, me.dir, constraints)
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
 
-	if errs.HasError() {
-		return errs
+	me.diagnostics = diagnostics
+
+	for _, plugin := range externalPlugins {
+		// discovered already
+		if _, found := me.plugins[plugin.Name()]; found {
+			continue
+		}
+		me.register(plugin)
 	}
 
-	me.started = true
-	return nil
+	return sortedPlugins(me.plugins), nil
 }
@@ -8,8 +8,15 @@ type PluginLang = string
 
 const (
 	PLUGIN_LANG_GO         = "go"
+	PLUGIN_LANG_GO_NATIVE  = "go-native"
 	PLUGIN_LANG_JAVASCRIPT = "javascript"
 	PLUGIN_LANG_SHELL      = "shell"
+	PLUGIN_LANG_PROCESS    = "process"
+	PLUGIN_LANG_WASM       = "wasm"
+	PLUGIN_LANG_HTTP       = "http"
+
+	// no code but the contributions in the manifest
+	PLUGIN_LANG_DECLARATIVE = "declarative"
 )
 
 type PluginKind = string
@@ -22,8 +29,104 @@ type Plugin interface {
 	Version() (major int, minor int)
 }
 
+// OptionalPlugin is implemented by plugins whose start failure should not fail the others
+type OptionalPlugin interface {
+	Optional() bool
+}
+
+func IsOptionalPlugin(plugin Plugin) bool {
+	if p, ok := plugin.(OptionalPlugin); ok {
+		return p.Optional()
+	}
+	return false
+}
+
+// PermissionedPlugin is implemented by plugins which run with the permissions declared in their manifest
+type PermissionedPlugin interface {
+	Permissions() []PluginPermission
+}
+
+// ManifestedPlugin is implemented by plugins described by a manifest, ie. external plugins
+type ManifestedPlugin interface {
+	Manifest() PluginManifest
+}
+
+// PluginManifestOf returns the manifest of the plugin, or nil if the plugin has no manifest
+func PluginManifestOf(plugin Plugin) PluginManifest {
+	if p, ok := plugin.(ManifestedPlugin); ok {
+		return p.Manifest()
+	}
+	return nil
+}
+
+// ContributingPlugin is implemented by plugins which contribute data declared in their manifest
+type ContributingPlugin interface {
+	Contributions() []PluginContribution
+}
+
+// constrainedPluginLoader is implemented by loaders which check the manifests against the constraints of the
+// registry while discovering plugins, ie. the permission cap of their namespace and the host compatibility
+type constrainedPluginLoader interface {
+	constrain(constraints externalPluginConstraints)
+}
+
+// DiagnosedPluginLoader is implemented by loaders which skip the broken plugins while discovering, the registry
+// reports the diagnostics of the last discovery as errors
+type DiagnosedPluginLoader interface {
+	Diagnostics() []PluginDiagnostic
+}
+
+// registryBoundPlugin is implemented by plugins which need to know their namespace and registry
+type registryBoundPlugin interface {
+	bindRegistry(namespace string, registry PluginRegistry)
+}
+
+// initializablePlugin is implemented by plugins whose code is loaded only after the registry accepts them, so that
+// nothing of a rejected or shadowed plugin runs
+type initializablePlugin interface {
+	Init(logger comm.Logger) error
+}
+
+// releasablePlugin is implemented by plugins holding resources since initialized, the registry releases the ones
+// which won't start
+type releasablePlugin interface {
+	release(logger comm.Logger)
+}
+
+// PluginStartMode decides the scope that a plugin start failure rolls back
+type PluginStartMode int
+
+const (
+	// a required plugin fails to start, then the plugins started by the same loader are stopped
+	PLUGIN_START_PER_LOADER PluginStartMode = iota
+
+	// a loader fails to start, then the other loaders started by the same registry are stopped as well
+	PLUGIN_START_PER_REGISTRY
+)
+
+// PluginShadowPolicy decides how to handle plugins of the same kind and name from different namespaces
+type PluginShadowPolicy int
+
+const (
+	// only the plugin from the namespace of the highest priority is accepted, the others are rejected as error
+	PLUGIN_SHADOW_REJECT PluginShadowPolicy = iota
+
+	// the plugin from the namespace of the highest priority overrides the others, with a warning
+	PLUGIN_SHADOW_OVERRIDE
+
+	// all of them are accepted and started, lookup by name returns the one of the highest priority
+	PLUGIN_SHADOW_COEXIST
+)
+
 type PluginLoader interface {
 	Namespace() string
+
+	// Discover returns the candidate plugins, none of them is started yet
+	Discover(logger comm.Logger) ([]Plugin, error)
+
+	// Accept keeps the candidates validated and indexed by the registry, only they are to be started
+	Accept(plugins []Plugin)
+
 	Plugins() map[string]Plugin
 	Start(logger comm.Logger) error
 	Stop(logger comm.Logger) error
@@ -0,0 +1,52 @@
+package qplugin
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+)
+
+// parseHostVersion parses the version of the host application, ie. 2.3, 2.3.1, 2.4.0-rc.1
+func parseHostVersion(version string) (*semver.Version, error) {
+	r, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid host version '%s'", version)
+	}
+	return r, nil
+}
+
+// checkPluginCompatibility checks the requirements of the manifest against the host version and API level. A
+// requirement is skipped if the host doesn't tell, ie. nil hostVersion or zero apiLevel. A prerelease of the host,
+// ie. 2.4.0-rc.1, is taken as its release, so that it satisfies the ranges like >=2.3.
+func checkPluginCompatibility(manifest PluginManifest, hostVersion *semver.Version, apiLevel int) error {
+	errs := comm.NewErrorGroup(false)
+
+	if hostVersion != nil {
+		release, _ := hostVersion.SetPrerelease("")
+
+		if r := manifest.Requires.Host; len(r) > 0 {
+			if constraint, err := semver.NewConstraint(r); err != nil {
+				errs.Add(errors.Wrapf(err, "requires.host '%s'", r))
+			} else if !constraint.Check(&release) {
+				errs.Add(fmt.Errorf("supports host versions %s, but the host is %s", r, hostVersion.Original()))
+			}
+		}
+
+		if v := manifest.MinHostVersion; len(v) > 0 {
+			if min, err := semver.NewVersion(v); err != nil {
+				errs.Add(errors.Wrapf(err, "min_host_version '%s'", v))
+			} else if release.LessThan(min) {
+				errs.Add(fmt.Errorf("supports host versions >=%s, but the host is %s", v, hostVersion.Original()))
+			}
+		}
+	}
+
+	if apiLevel > 0 && manifest.Requires.ApiLevel > apiLevel {
+		errs.Add(fmt.Errorf("requires host API level %d or later, but the host is at %d",
+			manifest.Requires.ApiLevel, apiLevel))
+	}
+
+	return errs.MayError()
+}
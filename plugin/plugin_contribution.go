@@ -0,0 +1,177 @@
+package qplugin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	// a text/template rendered with the hermetic sprig functions, declared as the template text or file; env and
+	// expandenv are available only with the env permission
+	PLUGIN_CONTRIBUTION_TEMPLATE = "template"
+
+	// key/values, ie. default config or static mappings
+	PLUGIN_CONTRIBUTION_CONFIG = "config"
+
+	// a file in the plugin directory, ie. an image or UI metadata
+	PLUGIN_CONTRIBUTION_ASSET = "asset"
+)
+
+// PluginContributionT is the data contributed by a plugin. Types other than PLUGIN_CONTRIBUTION_* are defined by
+// the host application, carrying the values and / or the file.
+type PluginContributionT struct {
+	host HostPlugin
+
+	typ    string
+	name   string
+	values map[string]any
+
+	tmpl *template.Template
+
+	fs   afero.Fs
+	file string
+}
+
+type PluginContribution = *PluginContributionT
+
+// newPluginContribution checks the declaration, loads the template, and resolves the file in pluginDir. allowEnv
+// tells if the template may read the environment of the host process.
+func newPluginContribution(host HostPlugin, fs afero.Fs, pluginDir string, decl PluginManifestContributionT, allowEnv bool) (PluginContribution, error) {
+	if len(decl.Type) == 0 {
+		return nil, fmt.Errorf("type of contribution %s is required", decl.Name)
+	}
+	if len(decl.Name) == 0 {
+		return nil, fmt.Errorf("name of %s contribution is required", decl.Type)
+	}
+
+	r := &PluginContributionT{
+		host:   host,
+		typ:    decl.Type,
+		name:   decl.Name,
+		values: decl.Values,
+		tmpl:   nil,
+		fs:     fs,
+		file:   "",
+	}
+	if r.values == nil {
+		r.values = map[string]any{}
+	}
+
+	if len(decl.File) > 0 {
+		file, err := pluginContributionFile(fs, pluginDir, decl.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s contribution %s", decl.Type, decl.Name)
+		}
+		r.file = file
+	}
+
+	switch decl.Type {
+	case PLUGIN_CONTRIBUTION_TEMPLATE:
+		text := decl.Template
+		if len(r.file) > 0 {
+			if len(text) > 0 {
+				return nil, fmt.Errorf("template contribution %s: expect either template or file, not both", decl.Name)
+			}
+			content, err := afero.ReadFile(fs, r.file)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read template contribution %s", decl.Name)
+			}
+			text = string(content)
+		}
+
+		tmpl, err := template.New(decl.Name).Funcs(pluginTemplateFuncs(allowEnv)).Parse(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse template contribution %s", decl.Name)
+		}
+		r.tmpl = tmpl
+	case PLUGIN_CONTRIBUTION_ASSET:
+		if len(r.file) == 0 {
+			return nil, fmt.Errorf("file of asset contribution %s is required", decl.Name)
+		}
+	}
+
+	return r, nil
+}
+
+// pluginTemplateFuncs returns the sprig functions which are repeatable, plus env and expandenv if allowEnv
+func pluginTemplateFuncs(allowEnv bool) template.FuncMap {
+	r := sprig.HermeticTxtFuncMap()
+	if allowEnv {
+		all := sprig.TxtFuncMap()
+		r["env"] = all["env"]
+		r["expandenv"] = all["expandenv"]
+	}
+	return r
+}
+
+// pluginContributionFile resolves the file in pluginDir, which must not escape pluginDir
+func pluginContributionFile(fs afero.Fs, pluginDir string, file string) (string, error) {
+	r := filepath.Join(pluginDir, file)
+	if rel, err := filepath.Rel(pluginDir, r); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %s is out of the plugin directory", file)
+	}
+	return checkExternalPluginCodeFile(fs, r)
+}
+
+// PluginId returns the id of the contributing plugin
+func (me PluginContribution) PluginId() string {
+	if me.host == nil {
+		return ""
+	}
+	return me.host.Id()
+}
+
+func (me PluginContribution) Type() string {
+	return me.typ
+}
+
+func (me PluginContribution) Name() string {
+	return me.name
+}
+
+// Values returns the key/values, the map is shared and must not be modified
+func (me PluginContribution) Values() map[string]any {
+	return me.values
+}
+
+// File returns the path of the file, or empty if the contribution has no file
+func (me PluginContribution) File() string {
+	return me.file
+}
+
+// Render renders the template with the data
+func (me PluginContribution) Render(data any) (string, error) {
+	if me.tmpl == nil {
+		return "", fmt.Errorf("%s contribution %s is not a template", me.typ, me.name)
+	}
+
+	var buf bytes.Buffer
+	if err := me.tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "render template contribution %s of plugin %s", me.name, me.PluginId())
+	}
+	return buf.String(), nil
+}
+
+// Open opens the file for read
+func (me PluginContribution) Open() (io.ReadCloser, error) {
+	if len(me.file) == 0 {
+		return nil, fmt.Errorf("%s contribution %s has no file", me.typ, me.name)
+	}
+	return me.fs.Open(me.file)
+}
+
+// Read reads the whole file
+func (me PluginContribution) Read() ([]byte, error) {
+	if len(me.file) == 0 {
+		return nil, fmt.Errorf("%s contribution %s has no file", me.typ, me.name)
+	}
+	return afero.ReadFile(me.fs, me.file)
+}
@@ -0,0 +1,179 @@
+package qplugin
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/traefik/yaegi/interp"
+)
+
+// PLUGIN_CONSTRUCTOR is the function a script plugin exports to create the value implementing the interface
+// declared for its kind
+const PLUGIN_CONSTRUCTOR = "New"
+
+// PluginInstanceProvider is implemented by plugins which provide a separate value implementing the interface
+// declared for its kind, ie. script plugins
+type PluginInstanceProvider interface {
+	Instance() any
+}
+
+var (
+	pluginInterfaces      = map[PluginKind]reflect.Type{}
+	pluginInterfacesMutex sync.RWMutex
+)
+
+// RegisterPluginInterface declares the interface which the plugins of the kind implement. iface is a nil pointer to
+// the interface, ie. (*Greeter)(nil); wrapper is a nil pointer to its yaegi wrapper struct, as generated by
+// 'yaegi extract', ie. (*_pkg_Greeter)(nil). The interface is then available to script plugins to import as
+// <package path>, the plugin constructor declares the interface as its result type.
+func RegisterPluginInterface(kind PluginKind, iface any, wrapper any) {
+	ifaceType := reflect.TypeOf(iface)
+	if ifaceType == nil || ifaceType.Kind() != reflect.Pointer || ifaceType.Elem().Kind() != reflect.Interface {
+		panic(fmt.Errorf("plugin interface of kind %s must be a nil pointer to interface, got %T", kind, iface))
+	}
+	ifaceType = ifaceType.Elem()
+	if len(ifaceType.PkgPath()) == 0 || len(ifaceType.Name()) == 0 {
+		panic(fmt.Errorf("plugin interface of kind %s must be a named type, got %s", kind, ifaceType))
+	}
+
+	wrapperType := reflect.TypeOf(wrapper)
+	if wrapperType == nil || wrapperType.Kind() != reflect.Pointer || wrapperType.Elem().Kind() != reflect.Struct {
+		panic(fmt.Errorf("wrapper of %s must be a nil pointer to struct, got %T", ifaceType, wrapper))
+	}
+	if err := checkPluginInterfaceWrapper(ifaceType, wrapperType.Elem()); err != nil {
+		panic(err)
+	}
+
+	registerPluginInterfaceExports(ifaceType, iface, wrapper)
+
+	pluginInterfacesMutex.Lock()
+	defer pluginInterfacesMutex.Unlock()
+
+	pluginInterfaces[kind] = ifaceType
+}
+
+// checkPluginInterfaceWrapper verifies the wrapper follows the yaegi convention: the first field keeps the value,
+// each method M of the interface has a function field WM, and the wrapper implements the interface
+func checkPluginInterfaceWrapper(ifaceType reflect.Type, wrapperType reflect.Type) error {
+	if wrapperType.NumField() == 0 || wrapperType.Field(0).Type.Kind() != reflect.Interface {
+		return fmt.Errorf("wrapper %s of %s must have the value as the first field", wrapperType, ifaceType)
+	}
+	if wrapperType.NumField()-1 != ifaceType.NumMethod() {
+		return fmt.Errorf("wrapper %s of %s must have a field for each method", wrapperType, ifaceType)
+	}
+	for i := 0; i < ifaceType.NumMethod(); i++ {
+		m := ifaceType.Method(i)
+		if f, found := wrapperType.FieldByName("W" + m.Name); !found || f.Type != m.Type {
+			return fmt.Errorf("wrapper %s of %s must have field W%s %s", wrapperType, ifaceType, m.Name, m.Type)
+		}
+	}
+	if !wrapperType.Implements(ifaceType) {
+		return fmt.Errorf("wrapper %s doesn't implement %s", wrapperType, ifaceType)
+	}
+	return nil
+}
+
+// registerPluginInterfaceExports exports the interface and its wrapper in the package of the interface, which
+// yaegi looks up the wrapper from. Merges into the package if it's already exported with a package name.
+func registerPluginInterfaceExports(ifaceType reflect.Type, iface any, wrapper any) {
+	pkgPath := ifaceType.PkgPath()
+	key := pkgPath + "/" + path.Base(pkgPath)
+	for existing := range HostExports() {
+		if path.Dir(existing) == pkgPath {
+			key = existing
+			break
+		}
+	}
+
+	RegisterHostExports(interp.Exports{
+		key: {
+			ifaceType.Name():       reflect.ValueOf(iface),
+			"_" + ifaceType.Name(): reflect.ValueOf(wrapper),
+		},
+	})
+}
+
+// PluginInterface returns the interface declared for the kind, or nil if not declared
+func PluginInterface(kind PluginKind) reflect.Type {
+	pluginInterfacesMutex.RLock()
+	defer pluginInterfacesMutex.RUnlock()
+
+	return pluginInterfaces[kind]
+}
+
+// PluginImplementation returns the plugin as T, either the plugin itself implements T (ie. a compiled plugin), or
+// the instance it provides does (ie. a script plugin)
+func PluginImplementation[T any](plugin Plugin) (T, bool) {
+	if r, ok := plugin.(T); ok {
+		return r, true
+	}
+	if provider, ok := plugin.(PluginInstanceProvider); ok {
+		if r, ok := provider.Instance().(T); ok {
+			return r, true
+		}
+	}
+
+	var r T
+	return r, false
+}
+
+// checkPluginInstance verifies the instance implements the interface, the error lists the missing methods
+func checkPluginInstance(ifaceType reflect.Type, instance any) error {
+	if instance == nil {
+		return fmt.Errorf("%s returns nil, expect %s", PLUGIN_CONSTRUCTOR, ifaceType)
+	}
+
+	v := reflect.ValueOf(instance)
+	if v.Type().Implements(ifaceType) {
+		return nil
+	}
+
+	missing := []string{}
+	for i := 0; i < ifaceType.NumMethod(); i++ {
+		m := ifaceType.Method(i)
+		if vm := v.MethodByName(m.Name); !vm.IsValid() {
+			missing = append(missing, m.Name)
+		} else if vm.Type() != m.Type {
+			missing = append(missing, fmt.Sprintf("%s (expect %s, got %s)", m.Name, m.Type, vm.Type()))
+		}
+	}
+	return fmt.Errorf("%s returns %T which doesn't implement %s, missing methods: %s",
+		PLUGIN_CONSTRUCTOR, instance, ifaceType, strings.Join(missing, ", "))
+}
+
+// pluginInstanceConstructor is implemented by the plugin contexts which know more about the constructor than its
+// results, ie. the yaegi interpreter
+type pluginInstanceConstructor interface {
+	newInstance(ctx context.Context, kind PluginKind, ifaceType reflect.Type) (any, error)
+}
+
+// NewPluginInstance calls the constructor of the plugin and verifies the result implements the interface declared
+// for the kind. Returns nil if the kind has no declared interface.
+func NewPluginInstance(ctx context.Context, invoker PluginInvoker, kind PluginKind) (any, error) {
+	ifaceType := PluginInterface(kind)
+	if ifaceType == nil {
+		return nil, nil
+	}
+
+	if c, ok := invoker.(pluginInstanceConstructor); ok {
+		return c.newInstance(ctx, kind, ifaceType)
+	}
+
+	results, err := invoker.Invoke(ctx, PLUGIN_CONSTRUCTOR)
+	if err != nil {
+		return nil, errors.Wrapf(err, "plugin of kind %s must export the constructor %s", kind, PLUGIN_CONSTRUCTOR)
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("%s returns %d values, expect 1", PLUGIN_CONSTRUCTOR, len(results))
+	}
+
+	if err := checkPluginInstance(ifaceType, results[0]); err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
@@ -0,0 +1,256 @@
+package qplugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// PluginInvoker calls the functions defined by the plugin code, such as handlers, transforms and hooks
+type PluginInvoker interface {
+	// Invoke calls the function with the arguments, and returns its results except the trailing error, which is
+	// returned as the error
+	Invoke(ctx context.Context, funcName string, args ...any) ([]any, error)
+}
+
+// Call invokes the function which returns one value (and optionally an error), and returns the value as R. A
+// number is converted to R if no loss, since a dynamic language may not return the exact number type.
+func Call[R any](ctx context.Context, invoker PluginInvoker, funcName string, args ...any) (R, error) {
+	var r R
+
+	results, err := invoker.Invoke(ctx, funcName, args...)
+	if err != nil {
+		return r, err
+	}
+	if len(results) != 1 {
+		return r, fmt.Errorf("%s returns %d values, expect 1", funcName, len(results))
+	}
+
+	if results[0] == nil {
+		return r, nil
+	}
+	r, ok := results[0].(R)
+	if !ok {
+		rType := reflect.TypeOf(&r).Elem()
+		if converted, ok := convertNumber(reflect.ValueOf(results[0]), rType); ok {
+			return converted.Interface().(R), nil
+		}
+		return r, fmt.Errorf("%s returns %T, expect %s", funcName, results[0], rType)
+	}
+	return r, nil
+}
+
+// number kinds
+const (
+	numberKindNone = iota
+	numberKindInt
+	numberKindUint
+	numberKindFloat
+)
+
+// numberKindOf tells if the kind is a signed integer, an unsigned integer, or a float
+func numberKindOf(k reflect.Kind) int {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return numberKindInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return numberKindUint
+	case reflect.Float32, reflect.Float64:
+		return numberKindFloat
+	default:
+		return numberKindNone
+	}
+}
+
+// isNumberKind tells if the kind is an integer or float
+func isNumberKind(k reflect.Kind) bool {
+	return numberKindOf(k) != numberKindNone
+}
+
+// convertNumber converts the number to the type if both are numbers and no loss: a negative number is never an
+// unsigned integer, a float with fraction is never an integer, and the value must be in the range of the type
+func convertNumber(v reflect.Value, t reflect.Type) (reflect.Value, bool) {
+	from, to := numberKindOf(v.Kind()), numberKindOf(t.Kind())
+	if from == numberKindNone || to == numberKindNone {
+		return reflect.Value{}, false
+	}
+
+	r := reflect.New(t).Elem()
+	switch to {
+	case numberKindInt:
+		var i int64
+		switch from {
+		case numberKindInt:
+			i = v.Int()
+		case numberKindUint:
+			if v.Uint() > math.MaxInt64 {
+				return reflect.Value{}, false
+			}
+			i = int64(v.Uint())
+		case numberKindFloat:
+			f := v.Float()
+			if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return reflect.Value{}, false
+			}
+			i = int64(f)
+		}
+		if r.OverflowInt(i) {
+			return reflect.Value{}, false
+		}
+		r.SetInt(i)
+	case numberKindUint:
+		var u uint64
+		switch from {
+		case numberKindInt:
+			if v.Int() < 0 {
+				return reflect.Value{}, false
+			}
+			u = uint64(v.Int())
+		case numberKindUint:
+			u = v.Uint()
+		case numberKindFloat:
+			f := v.Float()
+			if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return reflect.Value{}, false
+			}
+			u = uint64(f)
+		}
+		if r.OverflowUint(u) {
+			return reflect.Value{}, false
+		}
+		r.SetUint(u)
+	case numberKindFloat:
+		var f float64
+		switch from {
+		case numberKindInt:
+			f = float64(v.Int())
+			if f >= math.MaxInt64 || int64(f) != v.Int() {
+				return reflect.Value{}, false
+			}
+		case numberKindUint:
+			f = float64(v.Uint())
+			if f >= math.MaxUint64 || uint64(f) != v.Uint() {
+				return reflect.Value{}, false
+			}
+		case numberKindFloat:
+			f = v.Float()
+		}
+		if r.OverflowFloat(f) {
+			return reflect.Value{}, false
+		}
+		r.SetFloat(f)
+		// float32 may not keep the precision
+		if r.Float() != f && !math.IsNaN(f) {
+			return reflect.Value{}, false
+		}
+	}
+	return r, true
+}
+
+// reflectInvokeArg converts the argument to the parameter type. nil is the zero value for types could be nil,
+// numbers are converted each other if no loss, otherwise the argument must be assignable to the parameter type.
+func reflectInvokeArg(funcName string, index int, paramType reflect.Type, arg any) (reflect.Value, error) {
+	if arg == nil {
+		switch paramType.Kind() {
+		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice:
+			return reflect.Zero(paramType), nil
+		default:
+			return reflect.Value{}, fmt.Errorf("argument %d of %s: expect %s, got nil", index, funcName, paramType)
+		}
+	}
+
+	v := reflect.ValueOf(arg)
+	if v.Type().AssignableTo(paramType) {
+		return v, nil
+	}
+	if isNumberKind(v.Kind()) && isNumberKind(paramType.Kind()) {
+		converted, ok := convertNumber(v, paramType)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("argument %d of %s: %v can't be %s without loss", index, funcName, arg, paramType)
+		}
+		return converted, nil
+	}
+	return reflect.Value{}, fmt.Errorf("argument %d of %s: expect %s, got %T", index, funcName, paramType, arg)
+}
+
+func firstInvokeArg(args []any) any {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[0]
+}
+
+// reflectInvokeArgs converts the arguments to the parameter types of the function. The context is passed as the
+// first argument if the function accepts context.Context as the first parameter but the arguments don't start
+// with it.
+func reflectInvokeArgs(ctx context.Context, funcName string, t reflect.Type, args []any) ([]reflect.Value, error) {
+	if t.NumIn() > 0 && t.In(0) == contextType {
+		if _, isCtx := firstInvokeArg(args).(context.Context); !isCtx {
+			args = append([]any{ctx}, args...)
+		}
+	}
+
+	fixed := t.NumIn()
+	if t.IsVariadic() {
+		fixed--
+		if len(args) < fixed {
+			return nil, fmt.Errorf("%s expects at least %d arguments, got %d", funcName, fixed, len(args))
+		}
+	} else if len(args) != fixed {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", funcName, fixed, len(args))
+	}
+
+	r := make([]reflect.Value, 0, len(args))
+	for i, arg := range args {
+		var paramType reflect.Type
+		if i < fixed {
+			paramType = t.In(i)
+		} else {
+			paramType = t.In(fixed).Elem()
+		}
+
+		v, err := reflectInvokeArg(funcName, i, paramType, arg)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, v)
+	}
+	return r, nil
+}
+
+// invokeFunc calls the function with the arguments converted, a trailing error result or panic is returned as
+// error
+func invokeFunc(ctx context.Context, funcName string, f reflect.Value, args []any) (results []any, err error) {
+	t := f.Type()
+
+	in, err := reflectInvokeArgs(ctx, funcName, t, args)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			results = nil
+			err = errors.Wrapf(panicToError(p), "%s panicked", funcName)
+		}
+	}()
+
+	out := f.Call(in)
+
+	if t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType {
+		last := out[len(out)-1]
+		out = out[:len(out)-1]
+		if !last.IsNil() {
+			err = errors.Wrapf(last.Interface().(error), "%s failed", funcName)
+		}
+	}
+
+	results = make([]any, 0, len(out))
+	for _, v := range out {
+		results = append(results, v.Interface())
+	}
+	return results, err
+}
@@ -0,0 +1,232 @@
+package qplugin
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/spf13/afero"
+)
+
+// LanguageRuntimeFactory creates the context running the plugin code of a language, with the manifest found in
+// pluginDir. It returns the codeFile passed to the context, usually the entry file resolved by ExternalPluginEntry.
+// Nothing is initialized until the context is Init.
+type LanguageRuntimeFactory = func(fs afero.Fs, pluginDir string, manifest PluginManifest) (codeFile string,
+	context ExternalPluginContext, err error)
+
+var (
+	languageRuntimes      = map[PluginLang]LanguageRuntimeFactory{}
+	languageRuntimesMutex sync.RWMutex
+)
+
+func init() {
+	RegisterLanguageRuntime(PLUGIN_LANG_GO, newExternalGoRuntime)
+	RegisterLanguageRuntime(PLUGIN_LANG_GO_NATIVE, newExternalGoNativeRuntime)
+	RegisterLanguageRuntime(PLUGIN_LANG_JAVASCRIPT, newExternalJsRuntime)
+	RegisterLanguageRuntime(PLUGIN_LANG_SHELL, newExternalShellRuntime)
+	RegisterLanguageRuntime(PLUGIN_LANG_PROCESS, newExternalProcessRuntime)
+	RegisterLanguageRuntime(PLUGIN_LANG_WASM, newExternalWasmRuntime)
+	RegisterLanguageRuntime(PLUGIN_LANG_HTTP, newExternalHttpRuntime)
+	RegisterLanguageRuntime(PLUGIN_LANG_DECLARATIVE, newExternalDeclarativeRuntime)
+}
+
+// RegisterLanguageRuntime adds the runtime for the plugins declaring the language in their manifest, or replaces
+// the registered one, including the builtin ones. It affects the plugins discovered afterwards.
+func RegisterLanguageRuntime(lang PluginLang, factory LanguageRuntimeFactory) {
+	if len(lang) == 0 {
+		panic(fmt.Errorf("language of the runtime is required"))
+	}
+	if factory == nil {
+		panic(fmt.Errorf("factory of language runtime %s is required", lang))
+	}
+
+	languageRuntimesMutex.Lock()
+	defer languageRuntimesMutex.Unlock()
+
+	languageRuntimes[lang] = factory
+}
+
+// LanguageRuntime returns the runtime registered for the language, or nil if not found
+func LanguageRuntime(lang PluginLang) LanguageRuntimeFactory {
+	languageRuntimesMutex.RLock()
+	defer languageRuntimesMutex.RUnlock()
+
+	return languageRuntimes[lang]
+}
+
+// LanguageRuntimes returns the languages having a registered runtime, sorted
+func LanguageRuntimes() []PluginLang {
+	languageRuntimesMutex.RLock()
+	defer languageRuntimesMutex.RUnlock()
+
+	r := make([]PluginLang, 0, len(languageRuntimes))
+	for lang := range languageRuntimes {
+		r = append(r, lang)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// newExternalPluginContext creates the context by the runtime of the manifest language
+func newExternalPluginContext(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	factory := LanguageRuntime(mf.Language)
+	if factory == nil {
+		return "", nil, fmt.Errorf("unknown plugin language %s, expect one of: %s",
+			mf.Language, strings.Join(LanguageRuntimes(), ", "))
+	}
+
+	codeFile, context, err := factory(fs, pluginDir, mf)
+	if err != nil {
+		return "", nil, err
+	}
+	if context == nil {
+		return "", nil, fmt.Errorf("runtime of language %s created no context", mf.Language)
+	}
+	return codeFile, context, nil
+}
+
+// ExternalPluginEntry returns the path of the entry file declared in the manifest, or defaultEntry if not
+// declared, relative to the plugin directory. It fails if the file doesn't exist.
+func ExternalPluginEntry(fs afero.Fs, pluginDir string, manifest PluginManifest, defaultEntry string) (string, error) {
+	entry := manifest.Entry
+	if len(entry) == 0 {
+		entry = defaultEntry
+	}
+	if !filepath.IsAbs(entry) {
+		entry = filepath.Join(pluginDir, entry)
+	}
+	return checkExternalPluginCodeFile(fs, entry)
+}
+
+// checkExternalPluginCodeFile fails if the code file doesn't exist
+func checkExternalPluginCodeFile(fs afero.Fs, codeFile string) (string, error) {
+	if exists, err := comm.FileExists(fs, codeFile); err != nil {
+		return "", err
+	} else if !exists {
+		return "", fmt.Errorf("code file not found: %s", codeFile)
+	}
+	return codeFile, nil
+}
+
+// newExternalGoRuntime interprets the package declared in the manifest, or the single entry file, default to plugin.go
+func newExternalGoRuntime(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	var codeFile string
+	var r ExternalGoPluginContext
+
+	if len(mf.Go.Package) > 0 {
+		codeFile = pluginDir
+		r = NewExternalGoPackagePluginContext(mf.Go.Package)
+	} else {
+		var err error
+		if codeFile, err = ExternalPluginEntry(fs, pluginDir, mf, "plugin.go"); err != nil {
+			return "", nil, err
+		}
+		r = NewExternalGoPluginContext()
+	}
+
+	r.SetPermissions(mf.Permissions)
+	return codeFile, r, nil
+}
+
+// newExternalGoNativeRuntime loads the library, default to plugin.so
+func newExternalGoNativeRuntime(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	codeFile, err := ExternalPluginEntry(fs, pluginDir, mf, "plugin.so")
+	if err != nil {
+		return "", nil, err
+	}
+	return codeFile, NewExternalGoNativePluginContext(), nil
+}
+
+func newExternalJsRuntime(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	codeFile, err := ExternalPluginEntry(fs, pluginDir, mf, "plugin.js")
+	if err != nil {
+		return "", nil, err
+	}
+	return codeFile, NewExternalJsPluginContext(), nil
+}
+
+func newExternalShellRuntime(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	codeFile, err := ExternalPluginEntry(fs, pluginDir, mf, "plugin.sh")
+	if err != nil {
+		return "", nil, err
+	}
+
+	r := NewExternalShellPluginContext()
+	r.SetEnv(mf.Shell.Env)
+	r.SetDir(mf.Shell.Dir)
+	r.SetPermissions(mf.Permissions)
+	return codeFile, r, nil
+}
+
+// newExternalProcessRuntime runs process.command, or the entry if not specified
+func newExternalProcessRuntime(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	command := mf.Process.Command
+	if len(command) == 0 {
+		command = mf.Entry
+	}
+	if len(command) == 0 {
+		return "", nil, fmt.Errorf("process.command is required for %s plugin", PLUGIN_LANG_PROCESS)
+	}
+
+	// a bare command is found in PATH, unless it's in the plugin directory
+	codeFile := command
+	var err error
+	if filepath.IsAbs(command) {
+		codeFile, err = checkExternalPluginCodeFile(fs, command)
+	} else if inPluginDir := filepath.Join(pluginDir, command); strings.ContainsRune(command, filepath.Separator) ||
+		comm.FileExistsP(fs, inPluginDir) {
+		codeFile, err = checkExternalPluginCodeFile(fs, inPluginDir)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	r := NewExternalProcessPluginContext()
+	r.SetArgs(mf.Process.Args)
+	r.SetEnv(mf.Process.Env)
+	r.SetDir(mf.Process.Dir)
+	r.SetTimeout(time.Duration(mf.Process.Timeout) * time.Second)
+	r.SetHeartbeat(time.Duration(mf.Process.Heartbeat) * time.Second)
+	return codeFile, r, nil
+}
+
+func newExternalWasmRuntime(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	codeFile, err := ExternalPluginEntry(fs, pluginDir, mf, "plugin.wasm")
+	if err != nil {
+		return "", nil, err
+	}
+
+	r := NewExternalWasmPluginContext()
+	r.SetPermissions(mf.Permissions)
+	r.SetMaxMemoryPages(mf.Wasm.MaxMemoryPages)
+	r.SetTimeout(time.Duration(mf.Wasm.Timeout) * time.Second)
+	return codeFile, r, nil
+}
+
+// newExternalHttpRuntime requests http.base_url, or the entry if not specified
+func newExternalHttpRuntime(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	codeFile := mf.Http.BaseUrl
+	if len(codeFile) == 0 {
+		codeFile = mf.Entry
+	}
+	if len(codeFile) == 0 {
+		return "", nil, fmt.Errorf("http.base_url is required for %s plugin", PLUGIN_LANG_HTTP)
+	}
+
+	r := NewExternalHttpPluginContext()
+	r.SetTimeout(time.Duration(mf.Http.Timeout) * time.Second)
+	r.SetRetries(mf.Http.Retries, time.Duration(mf.Http.RetryDelay)*time.Millisecond)
+	r.SetHeadersFromConfig(mf.Http.HeadersFromConfig)
+	return codeFile, r, nil
+}
+
+// newExternalDeclarativeRuntime has no code file but the plugin directory
+func newExternalDeclarativeRuntime(fs afero.Fs, pluginDir string, mf PluginManifest) (string, ExternalPluginContext, error) {
+	r := NewExternalDeclarativePluginContext(mf.Contributes)
+	r.SetPermissions(mf.Permissions)
+	return pluginDir, r, nil
+}
@@ -1,22 +1,192 @@
 package qplugin
 
 import (
+	"path/filepath"
 	"strings"
 
 	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 )
 
 type PluginManifestT struct {
-	Kind         PluginKind `mapstructure:"kind" yaml:"kind"`
-	Name         string     `mapstructure:"name" yaml:"name"`
-	VersionMajor int        `mapstructure:"version_major" yaml:"version_major"`
-	VersionMinor int        `mapstructure:"version_minor" yaml:"version_minor"`
+	// format of the manifest, see PLUGIN_MANIFEST_VERSION; an older manifest is migrated while loading
+	ManifestVersion int `mapstructure:"manifest_version" yaml:"manifest_version"`
+
+	Kind         PluginKind `mapstructure:"kind" yaml:"kind" validate:"required"`
+	Name         string     `mapstructure:"name" yaml:"name" validate:"required,plugin_name"`
+	VersionMajor int        `mapstructure:"version_major" yaml:"version_major" validate:"gte=0"`
+	VersionMinor int        `mapstructure:"version_minor" yaml:"version_minor" validate:"gte=0"`
+
+	Description string                  `mapstructure:"description" yaml:"description"`
+	Authors     []PluginManifestAuthorT `mapstructure:"authors" yaml:"authors" validate:"dive"`
+
+	// SPDX license expression, ie. MIT, Apache-2.0 OR MIT
+	License    string `mapstructure:"license" yaml:"license" validate:"omitempty,spdx"`
+	Homepage   string `mapstructure:"homepage" yaml:"homepage" validate:"omitempty,url"`
+	Repository string `mapstructure:"repository" yaml:"repository" validate:"omitempty,url"`
+
+	Tags   []string          `mapstructure:"tags" yaml:"tags" validate:"dive,required"`
+	Labels map[string]string `mapstructure:"labels" yaml:"labels" validate:"dive,keys,required,endkeys"`
+
+	// the lowest version of the host application the plugin works with, as semantic version
+	MinHostVersion string `mapstructure:"min_host_version" yaml:"min_host_version" validate:"omitempty,semver"`
+
+	// what the plugin requires of the host application, checked by the registry when the plugin is discovered
+	Requires PluginManifestRequiresT `mapstructure:"requires" yaml:"requires"`
+
+	// path of the icon, relative to the plugin directory
+	Icon string `mapstructure:"icon" yaml:"icon" validate:"omitempty,plugin_path"`
+
+	// plugin specific configuration, available to the plugin code via the host API
+	Config map[string]any `mapstructure:"config" yaml:"config"`
+
+	// whether to substitute the variables in the manifest values, see PLUGIN_SUBSTITUTION_*
+	Substitute PluginSubstitution `mapstructure:"substitute" yaml:"substitute" validate:"omitempty,oneof=none lenient strict"`
+
+	// what the plugin code may access beyond the interpreter, see PLUGIN_PERMISSION_*. If not specified, nothing in
+	// a namespace with a permission cap, otherwise everything.
+	Permissions []PluginPermission `mapstructure:"permissions" yaml:"permissions"`
+
+	// language of the plugin code, see PLUGIN_LANG_*, default to go
+	Language PluginLang `mapstructure:"language" yaml:"language"`
+
+	// entry of the plugin code, relative to the plugin directory, default by the language, ie. plugin.go, plugin.js.
+	// It's the command of a process plugin, and the base URL of a http plugin, if the language section doesn't
+	// specify them.
+	Entry string `mapstructure:"entry" yaml:"entry"`
+
+	Go      PluginManifestGoT      `mapstructure:"go" yaml:"go"`
+	Shell   PluginManifestShellT   `mapstructure:"shell" yaml:"shell"`
+	Process PluginManifestProcessT `mapstructure:"process" yaml:"process"`
+	Wasm    PluginManifestWasmT    `mapstructure:"wasm" yaml:"wasm"`
+	Http    PluginManifestHttpT    `mapstructure:"http" yaml:"http"`
+
+	// data contributed by the plugin, see PLUGIN_CONTRIBUTION_*; the only content of a declarative plugin
+	Contributes []PluginManifestContributionT `mapstructure:"contributes" yaml:"contributes"`
+
+	// the manifest_version before migrated, equals to ManifestVersion if not migrated
+	migratedFrom int
+}
+
+type PluginManifestAuthorT struct {
+	Name  string `mapstructure:"name" yaml:"name" validate:"required"`
+	Email string `mapstructure:"email" yaml:"email" validate:"omitempty,email"`
+	Url   string `mapstructure:"url" yaml:"url" validate:"omitempty,url"`
+}
+
+// PluginManifestRequiresT is the manifest section for the compatibility with the host application, see
+// PluginRegistry.SetHostVersion and PluginRegistry.SetApiLevel
+type PluginManifestRequiresT struct {
+	// range of the host versions the plugin supports, ie. ">=2.3 <3", "~2.4", "^2 || ^3"
+	Host string `mapstructure:"host" yaml:"host" validate:"omitempty,semver_constraint"`
+
+	// the lowest API level of the host the plugin works with
+	ApiLevel int `mapstructure:"api_level" yaml:"api_level" validate:"gte=0"`
+}
+
+// PluginManifestGoT is the manifest section for plugins interpreted by yaegi
+type PluginManifestGoT struct {
+	// import path of the entry package, whose source is the plugin directory; the plugin imports its sub packages
+	// as <package>/xxx, and its dependencies from the vendor directory. If not specified, the plugin is a single
+	// plugin.go file.
+	Package string `mapstructure:"package" yaml:"package"`
+}
+
+// PluginManifestShellT is the manifest section for plugin.sh interpreted by mvdan.cc/sh
+type PluginManifestShellT struct {
+	// environment variables of the script, in addition to the environment of the host process if the env
+	// permission is granted
+	Env map[string]string `mapstructure:"env" yaml:"env"`
+
+	// working directory of the script, relative to the plugin directory, default to the plugin directory
+	Dir string `mapstructure:"dir" yaml:"dir"`
+}
+
+// PluginManifestProcessT is the manifest section for plugins run as a child process, see
+// process_plugin_protocol.go
+type PluginManifestProcessT struct {
+	// the executable, relative to the plugin directory, or a command found in PATH, ie. python3
+	Command string   `mapstructure:"command" yaml:"command"`
+	Args    []string `mapstructure:"args" yaml:"args"`
+
+	// environment variables in addition to the environment of the host process
+	Env map[string]string `mapstructure:"env" yaml:"env"`
+
+	// working directory of the process, relative to the plugin directory, default to the plugin directory
+	Dir string `mapstructure:"dir" yaml:"dir"`
+
+	// seconds to wait for a response, and for the process to exit after stopped, default to 30
+	Timeout int `mapstructure:"timeout" yaml:"timeout"`
+
+	// seconds between the heartbeats, default to 10
+	Heartbeat int `mapstructure:"heartbeat" yaml:"heartbeat"`
+}
+
+// PluginManifestWasmT is the manifest section for plugin.wasm run by wazero
+type PluginManifestWasmT struct {
+	// memory limit in 64KB pages, default to 1024 (64MB)
+	MaxMemoryPages uint32 `mapstructure:"max_memory_pages" yaml:"max_memory_pages"`
+
+	// seconds each call may run, default to 30
+	Timeout int `mapstructure:"timeout" yaml:"timeout"`
+}
+
+// PluginManifestHttpT is the manifest section for plugins hosted by a remote service, see external_http_plugin.go
+type PluginManifestHttpT struct {
+	BaseUrl string `mapstructure:"base_url" yaml:"base_url"`
+
+	// seconds each attempt of a request may take, default to 30
+	Timeout int `mapstructure:"timeout" yaml:"timeout"`
+
+	// how many times a failed request is retried, default to 0
+	Retries int `mapstructure:"retries" yaml:"retries"`
+
+	// milliseconds before the first retry, doubled for each next retry, default to 500
+	RetryDelay int `mapstructure:"retry_delay" yaml:"retry_delay"`
+
+	// headers sent with every request, mapping the header name to the config key holding the value, ie.
+	// Authorization: api_token
+	HeadersFromConfig map[string]string `mapstructure:"headers_from_config" yaml:"headers_from_config"`
+}
+
+// PluginManifestContributionT is an entry of the contributes section
+type PluginManifestContributionT struct {
+	// see PLUGIN_CONTRIBUTION_*, or a type defined by the host application
+	Type string `mapstructure:"type" yaml:"type"`
+
+	// unique for the type in the plugin
+	Name string `mapstructure:"name" yaml:"name"`
+
+	// text of a template
+	Template string `mapstructure:"template" yaml:"template"`
+
+	// file of a template or an asset, relative to the plugin directory
+	File string `mapstructure:"file" yaml:"file"`
+
+	// key/values of a config, or of a type defined by the host application
+	Values map[string]any `mapstructure:"values" yaml:"values"`
 }
 
 type PluginManifest = *PluginManifestT
 
+// Outdated tells if the manifest was migrated from an older manifest_version while loading
+func (me PluginManifest) Outdated() bool {
+	return me.migratedFrom < PLUGIN_MANIFEST_VERSION
+}
+
+// MigratedFrom returns the manifest_version before migrated
+func (me PluginManifest) MigratedFrom() int {
+	return me.migratedFrom
+}
+
+// PluginManifestWithMap migrates the manifest map to PLUGIN_MANIFEST_VERSION then decodes it
 func PluginManifestWithMap(manifestMap map[string]any) PluginManifest {
+	manifestMap, fromVersion, err := MigratePluginManifestMap(manifestMap)
+	if err != nil {
+		panic(err)
+	}
+
 	r, _ := comm.DecodeWithMapP(manifestMap, &comm.ConfigConfig{
 		ErrorUnused:          true,
 		ErrorUnset:           false,
@@ -27,16 +197,75 @@ func PluginManifestWithMap(manifestMap map[string]any) PluginManifest {
 	}, &PluginManifestT{}, nil)
 
 	r.Name = strings.ToLower(r.Name)
+	r.migratedFrom = fromVersion
 
 	return r
 }
 
 func PluginManifestWithJsonFile(fs afero.Fs, manifestJsonFile string) PluginManifest {
 	manifestMap := comm.MapFromJsonFileP(fs, manifestJsonFile, false)
-	return PluginManifestWithMap(manifestMap)
+	return pluginManifestWithFileMap(fs, manifestJsonFile, manifestMap, nil)
 }
 
 func PluginManifestWithYamlFile(fs afero.Fs, manifestYamlFile string) PluginManifest {
 	manifestMap := comm.MapFromYamlFileP(fs, manifestYamlFile, false)
+	return pluginManifestWithFileMap(fs, manifestYamlFile, manifestMap, nil)
+}
+
+// pluginManifestWithFileMap substitutes the variables if the manifest opts in, then decodes it. vars are the
+// variables provided by the registry, see pluginManifestVariables.
+func pluginManifestWithFileMap(fs afero.Fs, manifestFile string, manifestMap map[string]any, vars map[string]string) PluginManifest {
+	manifestMap, err := substitutePluginManifestMap(fs, filepath.Dir(manifestFile), manifestMap, vars)
+	if err != nil {
+		panic(errors.Wrap(err, "substitute variables"))
+	}
 	return PluginManifestWithMap(manifestMap)
 }
+
+var pluginManifestFileNames = []string{"plugin.manifest.yml", "plugin.manifest.yaml", "plugin.manifest.json"}
+
+// FindPluginManifestFile returns the manifest file in the plugin directory, or the path itself if it's a single-file
+// plugin, or empty string if there is no manifest
+func FindPluginManifestFile(fs afero.Fs, pluginDir string) string {
+	if IsSingleFilePlugin(fs, pluginDir) {
+		return pluginDir
+	}
+	if isDir, err := afero.IsDir(fs, pluginDir); err != nil || !isDir {
+		return ""
+	}
+
+	for _, fName := range pluginManifestFileNames {
+		f := filepath.Join(pluginDir, fName)
+		if comm.FileExistsP(fs, f) {
+			return f
+		}
+	}
+	return ""
+}
+
+// PluginManifestWithFile loads then validates the manifest, the errors are prefixed with the manifest file
+func PluginManifestWithFile(fs afero.Fs, manifestFile string) PluginManifest {
+	return pluginManifestWithFile(fs, manifestFile, nil)
+}
+
+// pluginManifestWithFile is PluginManifestWithFile with the variables provided by the registry
+func pluginManifestWithFile(fs afero.Fs, manifestFile string, vars map[string]string) (result PluginManifest) {
+	defer func() {
+		if p := recover(); p != nil {
+			panic(errors.Wrapf(panicToError(p), "manifest %s", manifestFile))
+		}
+	}()
+
+	if _, embedded := embeddedManifestSyntaxes[filepath.Ext(manifestFile)]; embedded {
+		result = pluginManifestWithSourceFile(fs, manifestFile, vars)
+	} else if filepath.Ext(manifestFile) == ".json" {
+		result = pluginManifestWithFileMap(fs, manifestFile, comm.MapFromJsonFileP(fs, manifestFile, false), vars)
+	} else {
+		result = pluginManifestWithFileMap(fs, manifestFile, comm.MapFromYamlFileP(fs, manifestFile, false), vars)
+	}
+
+	if err := ValidatePluginManifest(result); err != nil {
+		panic(err)
+	}
+	return result
+}
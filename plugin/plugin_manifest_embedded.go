@@ -0,0 +1,230 @@
+package qplugin
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+// A single-file plugin is a source file in the plugins directory, with the manifest embedded as YAML in its
+// leading comment block, between the fences:
+//
+//	// --- qplugin
+//	// kind: tool
+//	// name: hello
+//	// version_major: 1
+//	// version_minor: 0
+//	// ---
+//	package plugin
+//
+// The comment prefix is '#' for shell scripts, and the shebang line is allowed before the block. The language is
+// implied by the file extension, and the entry is the file itself.
+const (
+	EMBEDDED_MANIFEST_BEGIN = "--- qplugin"
+	EMBEDDED_MANIFEST_END   = "---"
+)
+
+type embeddedManifestSyntax struct {
+	lang          PluginLang
+	commentPrefix string
+}
+
+// embeddedManifestSyntaxes is keyed by the file extension of single-file plugins
+var embeddedManifestSyntaxes = map[string]embeddedManifestSyntax{
+	".go": {lang: PLUGIN_LANG_GO, commentPrefix: "//"},
+	".js": {lang: PLUGIN_LANG_JAVASCRIPT, commentPrefix: "//"},
+	".sh": {lang: PLUGIN_LANG_SHELL, commentPrefix: "#"},
+}
+
+// IsSingleFilePlugin tells if the file is a source file with an embedded manifest. An unclosed manifest counts, so
+// that it's reported when loaded rather than silently skipped.
+func IsSingleFilePlugin(fs afero.Fs, file string) bool {
+	syntax, ok := embeddedManifestSyntaxes[filepath.Ext(file)]
+	if !ok {
+		return false
+	}
+	if isDir, err := afero.IsDir(fs, file); err != nil || isDir {
+		return false
+	}
+
+	source, err := afero.ReadFile(fs, file)
+	if err != nil {
+		return false
+	}
+	_, found, err := findEmbeddedManifest(string(source), syntax.commentPrefix)
+	return found || err != nil
+}
+
+// embeddedManifestBlock is the position of the embedded manifest in the lines of the source, the fences excluded
+type embeddedManifestBlock struct {
+	lines []string
+	begin int
+	end   int
+}
+
+// findEmbeddedManifest looks for the fenced manifest in the leading comment block of the source
+func findEmbeddedManifest(source string, commentPrefix string) (block embeddedManifestBlock, found bool, err error) {
+	lines := strings.Split(source, "\n")
+	block.lines = lines
+
+	uncomment := func(line string) (string, bool) {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimLeft(line, " \t")
+		if !strings.HasPrefix(trimmed, commentPrefix) {
+			return "", false
+		}
+		return strings.TrimPrefix(trimmed, commentPrefix), true
+	}
+
+	for i, line := range lines {
+		if i == 0 && strings.HasPrefix(line, "#!") {
+			continue
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		text, isComment := uncomment(line)
+		if !isComment {
+			// out of the leading comment block
+			return block, false, nil
+		}
+		if strings.TrimSpace(text) != EMBEDDED_MANIFEST_BEGIN {
+			continue
+		}
+
+		block.begin = i + 1
+		for j := block.begin; j < len(lines); j++ {
+			text, isComment := uncomment(lines[j])
+			if !isComment {
+				return block, false, fmt.Errorf("line %d: embedded manifest is not closed by '%s %s'", j+1,
+					commentPrefix, EMBEDDED_MANIFEST_END)
+			}
+			if strings.TrimSpace(text) == EMBEDDED_MANIFEST_END {
+				block.end = j
+				return block, true, nil
+			}
+		}
+		return block, false, fmt.Errorf("embedded manifest is not closed by '%s %s'", commentPrefix, EMBEDDED_MANIFEST_END)
+	}
+	return block, false, nil
+}
+
+// yaml returns the YAML text of the embedded manifest, the comment prefix and the space after it are removed
+func (me embeddedManifestBlock) yaml(commentPrefix string) string {
+	var b strings.Builder
+	for _, line := range me.lines[me.begin:me.end] {
+		text := strings.TrimPrefix(strings.TrimLeft(strings.TrimRight(line, "\r"), " \t"), commentPrefix)
+		b.WriteString(strings.TrimPrefix(text, " "))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// replace returns the source with the embedded manifest replaced by the YAML text
+func (me embeddedManifestBlock) replace(commentPrefix string, yamlText string) string {
+	r := make([]string, 0, len(me.lines))
+	r = append(r, me.lines[:me.begin]...)
+	for _, line := range strings.Split(strings.TrimRight(yamlText, "\n"), "\n") {
+		r = append(r, strings.TrimRight(commentPrefix+" "+line, " "))
+	}
+	r = append(r, me.lines[me.end:]...)
+	return strings.Join(r, "\n")
+}
+
+// embeddedManifestMapWithFile returns the manifest map embedded in the source file, as is
+func embeddedManifestMapWithFile(fs afero.Fs, file string) (manifestMap map[string]any, block embeddedManifestBlock, err error) {
+	syntax, ok := embeddedManifestSyntaxes[filepath.Ext(file)]
+	if !ok {
+		return nil, block, fmt.Errorf("%s doesn't support embedded manifest", file)
+	}
+
+	source, err := comm.ReadFileText(fs, file)
+	if err != nil {
+		return nil, block, err
+	}
+
+	block, found, err := findEmbeddedManifest(source, syntax.commentPrefix)
+	if err != nil {
+		return nil, block, err
+	}
+	if !found {
+		return nil, block, fmt.Errorf("no embedded manifest found")
+	}
+
+	manifestMap = map[string]any{}
+	if err := yaml.Unmarshal([]byte(block.yaml(syntax.commentPrefix)), &manifestMap); err != nil {
+		return nil, block, errors.Wrap(err, "parse embedded manifest")
+	}
+	return manifestMap, block, nil
+}
+
+// PluginManifestWithSourceFile loads the manifest embedded in the source file of a single-file plugin, whose
+// language is implied by the file extension and entry is the file itself
+func PluginManifestWithSourceFile(fs afero.Fs, sourceFile string) PluginManifest {
+	return pluginManifestWithSourceFile(fs, sourceFile, nil)
+}
+
+func pluginManifestWithSourceFile(fs afero.Fs, sourceFile string, vars map[string]string) PluginManifest {
+	manifestMap, _, err := embeddedManifestMapWithFile(fs, sourceFile)
+	if err != nil {
+		panic(err)
+	}
+
+	syntax := embeddedManifestSyntaxes[filepath.Ext(sourceFile)]
+	if lang, found := manifestMap["language"]; found && lang != syntax.lang {
+		panic(fmt.Errorf("language %v doesn't match the file extension, expect %s", lang, syntax.lang))
+	}
+	if _, found := manifestMap["entry"]; found {
+		panic(fmt.Errorf("entry is the source file itself, must not be specified"))
+	}
+	if goSection, ok := manifestMap["go"].(map[string]any); ok && goSection["package"] != nil {
+		panic(fmt.Errorf("go.package is not supported by single-file plugin"))
+	}
+
+	manifestMap["language"] = syntax.lang
+	manifestMap["entry"] = filepath.Base(sourceFile)
+
+	return pluginManifestWithFileMap(fs, sourceFile, manifestMap, vars)
+}
+
+// migrateEmbeddedPluginManifest rewrites the embedded manifest of the source file, see MigratePluginManifestFile
+func migrateEmbeddedPluginManifest(fs afero.Fs, sourceFile string) (fromVersion int, err error) {
+	manifestMap, block, err := embeddedManifestMapWithFile(fs, sourceFile)
+	if err != nil {
+		return 0, errors.Wrapf(err, "read manifest %s", sourceFile)
+	}
+
+	migrated, fromVersion, err := MigratePluginManifestMap(manifestMap)
+	if err != nil {
+		return fromVersion, errors.Wrapf(err, "manifest %s", sourceFile)
+	}
+	if fromVersion == PLUGIN_MANIFEST_VERSION {
+		return fromVersion, nil
+	}
+	if err := checkPluginManifestMap(migrated); err != nil {
+		return fromVersion, errors.Wrapf(err, "manifest %s", sourceFile)
+	}
+
+	yamlText, err := comm.ToYaml(sourceFile, migrated)
+	if err != nil {
+		return fromVersion, err
+	}
+
+	info, err := fs.Stat(sourceFile)
+	if err != nil {
+		return fromVersion, err
+	}
+
+	syntax := embeddedManifestSyntaxes[filepath.Ext(sourceFile)]
+	source := block.replace(syntax.commentPrefix, yamlText)
+	if err := afero.WriteFile(fs, sourceFile, []byte(source), info.Mode().Perm()); err != nil {
+		return fromVersion, errors.Wrapf(err, "write manifest %s", sourceFile)
+	}
+	return fromVersion, nil
+}
@@ -0,0 +1,210 @@
+package qplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	// the latest format of the manifest, a manifest without manifest_version is of version 1
+	PLUGIN_MANIFEST_VERSION = 2
+
+	pluginManifestVersionKey = "manifest_version"
+)
+
+// pluginManifestMigration upgrades the manifest map by one version. The input map must not be modified, but
+// copied if to change.
+type pluginManifestMigration = func(manifestMap map[string]any) (map[string]any, error)
+
+// pluginManifestMigrations is keyed by the version the migration upgrades from, every version before
+// PLUGIN_MANIFEST_VERSION has one
+var pluginManifestMigrations = map[int]pluginManifestMigration{
+	1: migratePluginManifestV1,
+}
+
+// migratePluginManifestV1 moves go_native.library to entry, the go_native section is removed
+func migratePluginManifestV1(manifestMap map[string]any) (map[string]any, error) {
+	r := copyManifestMap(manifestMap)
+
+	section, found := r["go_native"]
+	if !found {
+		return r, nil
+	}
+	delete(r, "go_native")
+
+	if section == nil {
+		return r, nil
+	}
+	goNative, ok := section.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("go_native: expect a map, got %T", section)
+	}
+
+	for k, v := range goNative {
+		if k != "library" {
+			return nil, fmt.Errorf("go_native.%s is unknown", k)
+		}
+		if _, found := r["entry"]; found {
+			return nil, fmt.Errorf("go_native.library conflicts with entry")
+		}
+		r["entry"] = v
+	}
+	return r, nil
+}
+
+func copyManifestMap(manifestMap map[string]any) map[string]any {
+	r := make(map[string]any, len(manifestMap))
+	for k, v := range manifestMap {
+		r[k] = v
+	}
+	return r
+}
+
+// pluginManifestVersionOf returns the manifest_version, or 1 if not specified
+func pluginManifestVersionOf(manifestMap map[string]any) (int, error) {
+	v, found := manifestMap[pluginManifestVersionKey]
+	if !found || v == nil {
+		return 1, nil
+	}
+
+	var r int
+	switch t := v.(type) {
+	case int:
+		r = t
+	case int64:
+		r = int(t)
+	case uint64:
+		r = int(t)
+	case float64:
+		if t != float64(int(t)) {
+			return 0, fmt.Errorf("%s %v is not an integer", pluginManifestVersionKey, v)
+		}
+		r = int(t)
+	case string:
+		i, err := strconv.Atoi(t)
+		if err != nil {
+			return 0, errors.Wrapf(err, "%s %s is not an integer", pluginManifestVersionKey, t)
+		}
+		r = i
+	default:
+		return 0, fmt.Errorf("%s %v is not an integer", pluginManifestVersionKey, v)
+	}
+
+	if r < 1 {
+		return 0, fmt.Errorf("%s %d must be positive", pluginManifestVersionKey, r)
+	}
+	if r > PLUGIN_MANIFEST_VERSION {
+		return 0, fmt.Errorf("%s %d is newer than the supported %d, upgrade the host application",
+			pluginManifestVersionKey, r, PLUGIN_MANIFEST_VERSION)
+	}
+	return r, nil
+}
+
+// logOutdatedPluginManifest warns the deprecated manifest format
+func logOutdatedPluginManifest(logger comm.Logger, pluginDir string, manifest PluginManifest) {
+	if !manifest.Outdated() {
+		return
+	}
+	logger.Warn().Str("pluginDir", pluginDir).Int("manifestVersion", manifest.MigratedFrom()).
+		Int("latestManifestVersion", PLUGIN_MANIFEST_VERSION).
+		Msg("plugin manifest format is deprecated, run 'qplugin migrate' to upgrade")
+}
+
+// MigratePluginManifestMap upgrades the manifest map to PLUGIN_MANIFEST_VERSION, and returns the version it was.
+// The input map isn't modified.
+func MigratePluginManifestMap(manifestMap map[string]any) (result map[string]any, fromVersion int, err error) {
+	fromVersion, err = pluginManifestVersionOf(manifestMap)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if fromVersion == PLUGIN_MANIFEST_VERSION {
+		return manifestMap, fromVersion, nil
+	}
+
+	result = manifestMap
+	for v := fromVersion; v < PLUGIN_MANIFEST_VERSION; v++ {
+		migration := pluginManifestMigrations[v]
+		if migration == nil {
+			return nil, fromVersion, fmt.Errorf("no migration from %s %d", pluginManifestVersionKey, v)
+		}
+		if result, err = migration(result); err != nil {
+			return nil, fromVersion, errors.Wrapf(err, "migrate from %s %d", pluginManifestVersionKey, v)
+		}
+	}
+
+	// the migrations return copies, so it's not the input map
+	result[pluginManifestVersionKey] = PLUGIN_MANIFEST_VERSION
+	return result, fromVersion, nil
+}
+
+// MigratePluginManifestFile rewrites the manifest file, or the manifest embedded in the source file of a single-file
+// plugin, in place to PLUGIN_MANIFEST_VERSION, in the same format.
+// Returns the version it was, nothing is written if it's the latest already. The comments and the key order of a
+// YAML manifest are not kept.
+func MigratePluginManifestFile(fs afero.Fs, manifestFile string) (fromVersion int, err error) {
+	if _, embedded := embeddedManifestSyntaxes[filepath.Ext(manifestFile)]; embedded {
+		return migrateEmbeddedPluginManifest(fs, manifestFile)
+	}
+
+	isJson := filepath.Ext(manifestFile) == ".json"
+
+	var manifestMap map[string]any
+	if isJson {
+		manifestMap, err = comm.MapFromJsonFile(fs, manifestFile, false)
+	} else {
+		manifestMap, err = comm.MapFromYamlFile(fs, manifestFile, false)
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "read manifest %s", manifestFile)
+	}
+
+	migrated, fromVersion, err := MigratePluginManifestMap(manifestMap)
+	if err != nil {
+		return fromVersion, errors.Wrapf(err, "manifest %s", manifestFile)
+	}
+	if fromVersion == PLUGIN_MANIFEST_VERSION {
+		return fromVersion, nil
+	}
+
+	// never writes a manifest which fails to load
+	if err := checkPluginManifestMap(migrated); err != nil {
+		return fromVersion, errors.Wrapf(err, "manifest %s", manifestFile)
+	}
+
+	var content []byte
+	if isJson {
+		if content, err = json.MarshalIndent(migrated, "", "  "); err != nil {
+			return fromVersion, errors.Wrapf(err, "marshal manifest %s", manifestFile)
+		}
+		content = append(content, '\n')
+	} else {
+		text, err := comm.ToYaml(manifestFile, migrated)
+		if err != nil {
+			return fromVersion, err
+		}
+		content = []byte(text)
+	}
+
+	if err := afero.WriteFile(fs, manifestFile, content, 0o644); err != nil {
+		return fromVersion, errors.Wrapf(err, "write manifest %s", manifestFile)
+	}
+	return fromVersion, nil
+}
+
+// checkPluginManifestMap decodes then validates the manifest map
+func checkPluginManifestMap(manifestMap map[string]any) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = panicToError(p)
+		}
+	}()
+
+	return ValidatePluginManifest(PluginManifestWithMap(manifestMap))
+}
@@ -0,0 +1,275 @@
+package qplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+type PluginSubstitution = string
+
+// The manifest opts in the substitution of ${NAME} and ${NAME:-default} in its values, including the config, by
+// the top-level 'substitute' field. The variables are, in the order of precedence:
+//
+//   - the builtin ones, see MANIFEST_VAR_*
+//   - the ones provided by the registry, ie. MANIFEST_VAR_HOST_VERSION by PluginRegistry.SetHostVersion
+//   - the ones set by the host application, see SetManifestVariable
+//   - the environment variables of the host process, if the plugin has the env permission
+//
+// $${NAME} is the escape of the literal ${NAME}. manifest_version, substitute and permissions are never
+// substituted.
+const (
+	// no substitution, the default
+	PLUGIN_SUBSTITUTION_NONE = "none"
+
+	// an undefined variable is substituted by empty
+	PLUGIN_SUBSTITUTION_LENIENT = "lenient"
+
+	// an undefined variable without default is an error
+	PLUGIN_SUBSTITUTION_STRICT = "strict"
+)
+
+const (
+	// the plugin directory, where the plugin is installed
+	MANIFEST_VAR_PLUGIN_DIR = "PLUGIN_DIR"
+
+	// runtime.GOOS and runtime.GOARCH of the host
+	MANIFEST_VAR_HOST_OS   = "HOST_OS"
+	MANIFEST_VAR_HOST_ARCH = "HOST_ARCH"
+
+	// the version of the host application, provided by PluginRegistry.SetHostVersion, or set by SetManifestVariable
+	MANIFEST_VAR_HOST_VERSION = "HOST_VERSION"
+)
+
+var pluginSubstitutionSkippedKeys = []string{pluginManifestVersionKey, "substitute", "permissions"}
+
+var (
+	manifestVariables      = map[string]string{}
+	manifestVariablesMutex sync.RWMutex
+)
+
+// SetManifestVariable sets the variable for the manifests to substitute, ie. MANIFEST_VAR_HOST_VERSION or a
+// deployment specific one. It affects the manifests loaded afterwards.
+func SetManifestVariable(name string, value string) {
+	if !isManifestVariableName(name) {
+		panic(fmt.Errorf("invalid manifest variable name: '%s'", name))
+	}
+
+	manifestVariablesMutex.Lock()
+	defer manifestVariablesMutex.Unlock()
+
+	manifestVariables[name] = value
+}
+
+// ManifestVariables returns the variables set by the host application
+func ManifestVariables() map[string]string {
+	manifestVariablesMutex.RLock()
+	defer manifestVariablesMutex.RUnlock()
+
+	r := make(map[string]string, len(manifestVariables))
+	for k, v := range manifestVariables {
+		r[k] = v
+	}
+	return r
+}
+
+func isManifestVariableName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, c := range name {
+		if c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// substitutePluginManifestMap substitutes the variables in the manifest map if it opts in, the input map isn't
+// modified
+func substitutePluginManifestMap(fs afero.Fs, pluginDir string, manifestMap map[string]any, vars map[string]string) (map[string]any, error) {
+	mode := PLUGIN_SUBSTITUTION_NONE
+	if v, found := manifestMap["substitute"]; found && v != nil {
+		mode = fmt.Sprint(v)
+	}
+
+	switch mode {
+	case PLUGIN_SUBSTITUTION_NONE, "":
+		return manifestMap, nil
+	case PLUGIN_SUBSTITUTION_LENIENT, PLUGIN_SUBSTITUTION_STRICT:
+	default:
+		return nil, fmt.Errorf("invalid substitute '%s', expect one of: %s, %s, %s", mode,
+			PLUGIN_SUBSTITUTION_NONE, PLUGIN_SUBSTITUTION_LENIENT, PLUGIN_SUBSTITUTION_STRICT)
+	}
+
+	s := &manifestSubstitutor{
+		vars:   pluginManifestVariables(fs, pluginDir, manifestMap, vars),
+		strict: mode == PLUGIN_SUBSTITUTION_STRICT,
+	}
+
+	r := make(map[string]any, len(manifestMap))
+	for k, v := range manifestMap {
+		if containsString(pluginSubstitutionSkippedKeys, k) {
+			r[k] = v
+			continue
+		}
+
+		substituted, err := s.value(k, v)
+		if err != nil {
+			return nil, err
+		}
+		r[k] = substituted
+	}
+	return r, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pluginManifestVariables returns the variables visible to the manifest, vars are the ones provided by the registry
+func pluginManifestVariables(fs afero.Fs, pluginDir string, manifestMap map[string]any, vars map[string]string) map[string]string {
+	r := map[string]string{}
+
+	if pluginManifestMapAllows(manifestMap, PLUGIN_PERMISSION_ENV) {
+		for _, kv := range os.Environ() {
+			if k, v, found := strings.Cut(kv, "="); found {
+				r[k] = v
+			}
+		}
+	}
+
+	for k, v := range ManifestVariables() {
+		r[k] = v
+	}
+	for k, v := range vars {
+		r[k] = v
+	}
+
+	if realDir, ok := externalPluginRealPath(fs, pluginDir); ok {
+		pluginDir = realDir
+	}
+	r[MANIFEST_VAR_PLUGIN_DIR] = filepath.Clean(pluginDir)
+	r[MANIFEST_VAR_HOST_OS] = runtime.GOOS
+	r[MANIFEST_VAR_HOST_ARCH] = runtime.GOARCH
+
+	return r
+}
+
+// pluginManifestMapAllows tells if the manifest map grants the permission, go-native and process plugins have all
+// permissions
+func pluginManifestMapAllows(manifestMap map[string]any, permission PluginPermission) bool {
+	switch manifestMap["language"] {
+	case PLUGIN_LANG_GO_NATIVE, PLUGIN_LANG_PROCESS:
+		return true
+	}
+
+	switch t := manifestMap["permissions"].(type) {
+	case string:
+		return t == permission
+	case []any:
+		for _, p := range t {
+			if p == permission {
+				return true
+			}
+		}
+	case []string:
+		return containsString(t, permission)
+	}
+	return false
+}
+
+type manifestSubstitutor struct {
+	vars   map[string]string
+	strict bool
+}
+
+// value substitutes the strings in the value recursively, path is the position of the value for the errors
+func (me *manifestSubstitutor) value(path string, v any) (any, error) {
+	switch t := v.(type) {
+	case string:
+		r, err := me.text(t)
+		if err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+		return r, nil
+	case map[string]any:
+		r := make(map[string]any, len(t))
+		for k, e := range t {
+			substituted, err := me.value(path+"."+k, e)
+			if err != nil {
+				return nil, err
+			}
+			r[k] = substituted
+		}
+		return r, nil
+	case []any:
+		r := make([]any, len(t))
+		for i, e := range t {
+			substituted, err := me.value(fmt.Sprintf("%s[%d]", path, i), e)
+			if err != nil {
+				return nil, err
+			}
+			r[i] = substituted
+		}
+		return r, nil
+	}
+	return v, nil
+}
+
+// text substitutes ${NAME} and ${NAME:-default}, and unescapes $${
+func (me *manifestSubstitutor) text(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+
+		// $${ is the escape of ${
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i])
+			b.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+
+		b.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated '${' in '%s'", s)
+		}
+		expr := s[i+2 : i+end]
+		s = s[i+end+1:]
+
+		name, def, hasDefault := strings.Cut(expr, ":-")
+		if !isManifestVariableName(name) {
+			return "", fmt.Errorf("invalid variable name '%s'", name)
+		}
+
+		if v, found := me.vars[name]; found {
+			b.WriteString(v)
+		} else if hasDefault {
+			b.WriteString(def)
+		} else if me.strict {
+			return "", fmt.Errorf("variable %s is undefined", name)
+		}
+	}
+}
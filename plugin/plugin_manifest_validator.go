@@ -0,0 +1,228 @@
+package qplugin
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/fastgh/go-comm/v2"
+	"github.com/go-playground/validator/v10"
+	"github.com/pkg/errors"
+)
+
+var (
+	pluginNamePattern    = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]*[a-z0-9])?$`)
+	spdxLicenseIdPattern = regexp.MustCompile(`^(DocumentRef-[A-Za-z0-9.-]+:)?[A-Za-z0-9][A-Za-z0-9.-]*\+?$`)
+
+	pluginManifestValidator = newPluginManifestValidator()
+)
+
+func newPluginManifestValidator() *validator.Validate {
+	r := validator.New()
+
+	// the field names in the errors are the ones in the manifest file
+	r.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("mapstructure"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	mustRegister := func(tag string, f func(s string) bool) {
+		if err := r.RegisterValidation(tag, func(fl validator.FieldLevel) bool {
+			return f(fl.Field().String())
+		}); err != nil {
+			panic(err)
+		}
+	}
+	mustRegister("plugin_name", pluginNamePattern.MatchString)
+	mustRegister("spdx", func(s string) bool { return CheckSpdxExpression(s) == nil })
+	mustRegister("plugin_path", isPluginRelativePath)
+	mustRegister("semver_constraint", func(s string) bool {
+		_, err := semver.NewConstraint(s)
+		return err == nil
+	})
+
+	return r
+}
+
+// isPluginRelativePath tells if the path is relative to and inside the plugin directory
+func isPluginRelativePath(path string) bool {
+	if filepath.IsAbs(path) {
+		return false
+	}
+	cleaned := filepath.Clean(path)
+	return cleaned != ".." && !strings.HasPrefix(cleaned, ".."+string(filepath.Separator))
+}
+
+// ValidatePluginManifest checks the manifest by the validate tags of its fields
+func ValidatePluginManifest(manifest PluginManifest) error {
+	err := pluginManifestValidator.Struct(manifest)
+	if err == nil {
+		return nil
+	}
+
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return err
+	}
+
+	errs := comm.NewErrorGroup(false)
+	for _, fe := range fieldErrs {
+		errs.Add(pluginManifestFieldError(fe))
+	}
+	return errs.MayError()
+}
+
+// pluginManifestFieldError describes the error with the field path in the manifest file, ie. authors[0].email
+func pluginManifestFieldError(fe validator.FieldError) error {
+	field := fe.Namespace()
+	if i := strings.IndexByte(field, '.'); i >= 0 {
+		field = field[i+1:]
+	}
+
+	switch fe.Tag() {
+	case "required":
+		return fmt.Errorf("%s is required", field)
+	case "plugin_name":
+		return fmt.Errorf("%s '%v' must match %s", field, fe.Value(), pluginNamePattern)
+	case "spdx":
+		return fmt.Errorf("%s '%v' is not a valid SPDX license expression: %v", field, fe.Value(),
+			CheckSpdxExpression(fmt.Sprint(fe.Value())))
+	case "plugin_path":
+		return fmt.Errorf("%s '%v' must be a relative path inside the plugin directory", field, fe.Value())
+	case "url":
+		return fmt.Errorf("%s '%v' is not a valid URL", field, fe.Value())
+	case "email":
+		return fmt.Errorf("%s '%v' is not a valid email", field, fe.Value())
+	case "semver":
+		return fmt.Errorf("%s '%v' is not a semantic version, ie. 1.2.3", field, fe.Value())
+	case "semver_constraint":
+		return fmt.Errorf("%s '%v' is not a valid version range, ie. >=2.3 <3", field, fe.Value())
+	case "oneof":
+		return fmt.Errorf("%s '%v' must be one of: %s", field, fe.Value(), fe.Param())
+	case "gte", "lte", "max", "min":
+		return fmt.Errorf("%s '%v' must be %s %s", field, fe.Value(), fe.Tag(), fe.Param())
+	}
+	return fmt.Errorf("%s '%v' fails on %s", field, fe.Value(), fe.Tag())
+}
+
+// CheckSpdxExpression checks the syntax of the SPDX license expression, ie. MIT, Apache-2.0 OR MIT,
+// GPL-2.0-or-later WITH Classpath-exception-2.0, LicenseRef-Proprietary. The license ids aren't checked against
+// the SPDX license list.
+func CheckSpdxExpression(expr string) error {
+	p := &spdxParser{tokens: tokenizeSpdxExpression(expr)}
+	if len(p.tokens) == 0 {
+		return fmt.Errorf("empty expression")
+	}
+	if err := p.parseOr(); err != nil {
+		return err
+	}
+	if p.pos < len(p.tokens) {
+		return fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	return nil
+}
+
+func tokenizeSpdxExpression(expr string) []string {
+	expr = strings.ReplaceAll(expr, "(", " ( ")
+	expr = strings.ReplaceAll(expr, ")", " ) ")
+	return strings.Fields(expr)
+}
+
+// spdxParser is a recursive descent parser of:
+//
+//	or   := and ("OR" and)*
+//	and  := with ("AND" with)*
+//	with := atom ("WITH" license-id)?
+//	atom := "(" or ")" | license-id
+type spdxParser struct {
+	tokens []string
+	pos    int
+}
+
+func (me *spdxParser) peek() string {
+	if me.pos < len(me.tokens) {
+		return me.tokens[me.pos]
+	}
+	return ""
+}
+
+// acceptOperator consumes the operator, which is either upper or lower case
+func (me *spdxParser) acceptOperator(op string) bool {
+	t := me.peek()
+	if t == op || t == strings.ToLower(op) {
+		me.pos++
+		return true
+	}
+	return false
+}
+
+func (me *spdxParser) parseOr() error {
+	if err := me.parseAnd(); err != nil {
+		return err
+	}
+	for me.acceptOperator("OR") {
+		if err := me.parseAnd(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *spdxParser) parseAnd() error {
+	if err := me.parseWith(); err != nil {
+		return err
+	}
+	for me.acceptOperator("AND") {
+		if err := me.parseWith(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *spdxParser) parseWith() error {
+	if err := me.parseAtom(); err != nil {
+		return err
+	}
+	if me.acceptOperator("WITH") {
+		return me.parseLicenseId()
+	}
+	return nil
+}
+
+func (me *spdxParser) parseAtom() error {
+	if me.peek() == "(" {
+		me.pos++
+		if err := me.parseOr(); err != nil {
+			return err
+		}
+		if me.peek() != ")" {
+			return fmt.Errorf("missing ')'")
+		}
+		me.pos++
+		return nil
+	}
+	return me.parseLicenseId()
+}
+
+func (me *spdxParser) parseLicenseId() error {
+	t := me.peek()
+	switch {
+	case len(t) == 0:
+		return fmt.Errorf("unexpected end, expect a license id")
+	case t == "(" || t == ")":
+		return fmt.Errorf("unexpected '%s', expect a license id", t)
+	case strings.EqualFold(t, "AND") || strings.EqualFold(t, "OR") || strings.EqualFold(t, "WITH"):
+		return fmt.Errorf("unexpected operator '%s', expect a license id", t)
+	case !spdxLicenseIdPattern.MatchString(t):
+		return fmt.Errorf("invalid license id '%s'", t)
+	}
+	me.pos++
+	return nil
+}
@@ -0,0 +1,215 @@
+package qplugin
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/fastgh/go-comm/v2"
+)
+
+const (
+	PLUGIN_OUTPUT_STDOUT = "stdout"
+	PLUGIN_OUTPUT_STDERR = "stderr"
+
+	// a longer line is split into multiple log entries
+	DEFAULT_PLUGIN_OUTPUT_MAX_LINE_BYTES = 4 * 1024
+
+	// output of a stream beyond the limit is dropped until the next Flush
+	DEFAULT_PLUGIN_OUTPUT_MAX_TOTAL_BYTES = 1024 * 1024
+)
+
+// PluginOutputT is the stdout or stderr of a script plugin, each line written to it is logged to the logger of the
+// plugin, tagged with the stream. The total limit applies to the output between two flushes, ie. of each call of
+// Start, Stop or Invoke.
+type PluginOutputT struct {
+	stream        string
+	logger        func() comm.Logger
+	maxLineBytes  int
+	maxTotalBytes int64
+
+	line     []byte
+	total    int64
+	exceeded bool
+	dropped  int64
+
+	mutex sync.Mutex
+}
+
+type PluginOutput = *PluginOutputT
+
+// NewPluginOutput creates the output of the stream, the logger is resolved at each line since the logger of a
+// plugin changes once it's bound to a namespace
+func NewPluginOutput(stream string, logger func() comm.Logger, maxLineBytes int, maxTotalBytes int64) PluginOutput {
+	if maxLineBytes <= 0 {
+		maxLineBytes = DEFAULT_PLUGIN_OUTPUT_MAX_LINE_BYTES
+	}
+	if maxTotalBytes <= 0 {
+		maxTotalBytes = DEFAULT_PLUGIN_OUTPUT_MAX_TOTAL_BYTES
+	}
+
+	return &PluginOutputT{
+		stream:        stream,
+		logger:        logger,
+		maxLineBytes:  maxLineBytes,
+		maxTotalBytes: maxTotalBytes,
+		line:          make([]byte, 0, 256),
+		total:         0,
+		exceeded:      false,
+		dropped:       0,
+		mutex:         sync.Mutex{},
+	}
+}
+
+func (me PluginOutput) Stream() string {
+	return me.stream
+}
+
+// Total returns the amount of bytes written since the last Flush, not including the dropped ones
+func (me PluginOutput) Total() int64 {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.total
+}
+
+// Write never fails, so the script isn't broken by the output beyond the limit, which is dropped
+func (me PluginOutput) Write(p []byte) (int, error) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	n := len(p)
+	if me.exceeded {
+		me.dropped += int64(n)
+		return n, nil
+	}
+
+	exceeded := false
+	if remaining := me.maxTotalBytes - me.total; int64(len(p)) > remaining {
+		me.dropped += int64(len(p)) - remaining
+		p = p[:remaining]
+		exceeded = true
+	}
+	me.total += int64(len(p))
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			me.appendLine(p)
+			break
+		}
+		me.appendLine(p[:i])
+		me.flushLine()
+		p = p[i+1:]
+	}
+
+	if exceeded {
+		me.flushLine()
+		me.exceeded = true
+		me.logger().Warn().Str("stream", me.stream).Int64("limit", me.maxTotalBytes).
+			Msg("plugin output exceeds the limit, the rest is dropped")
+	}
+
+	return n, nil
+}
+
+// appendLine appends to the pending line, which is flushed once it reaches the max line size
+func (me PluginOutput) appendLine(p []byte) {
+	for len(p) > 0 {
+		room := me.maxLineBytes - len(me.line)
+		if len(p) < room {
+			me.line = append(me.line, p...)
+			return
+		}
+		me.line = append(me.line, p[:room]...)
+		me.flushLine()
+		p = p[room:]
+	}
+}
+
+func (me PluginOutput) flushLine() {
+	line := bytes.TrimSuffix(me.line, []byte{'\r'})
+	if len(line) > 0 {
+		var entry comm.LogEntry
+		if me.stream == PLUGIN_OUTPUT_STDERR {
+			entry = me.logger().Warn()
+		} else {
+			entry = me.logger().Info()
+		}
+		entry.Str("stream", me.stream).Msg(string(line))
+	}
+	me.line = me.line[:0]
+}
+
+// Flush logs the pending line which has no line break yet, then resets the total limit. How many bytes were
+// dropped since the limit was exceeded is logged.
+func (me PluginOutput) Flush() {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	me.flushLine()
+
+	if me.exceeded {
+		me.logger().Warn().Str("stream", me.stream).Int64("limit", me.maxTotalBytes).Int64("dropped", me.dropped).
+			Msg("plugin output was beyond the limit, the limit is reset")
+	}
+	me.total = 0
+	me.exceeded = false
+	me.dropped = 0
+}
+
+// pluginResultBuffer collects the result a plugin writes to its stdout, ie. the result of a shell function. A
+// write beyond the limit fails and calls onExceeded once, so that the call is stopped rather than keeps producing
+// output which is dropped anyway.
+type pluginResultBuffer struct {
+	buf        bytes.Buffer
+	limit      int64
+	exceeded   bool
+	onExceeded func()
+	mutex      sync.Mutex
+}
+
+func newPluginResultBuffer(limit int64, onExceeded func()) *pluginResultBuffer {
+	if limit <= 0 {
+		limit = DEFAULT_PLUGIN_OUTPUT_MAX_TOTAL_BYTES
+	}
+	return &pluginResultBuffer{limit: limit, onExceeded: onExceeded}
+}
+
+func (me *pluginResultBuffer) Write(p []byte) (int, error) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	if !me.exceeded && int64(me.buf.Len())+int64(len(p)) > me.limit {
+		me.exceeded = true
+		if me.onExceeded != nil {
+			me.onExceeded()
+		}
+	}
+	if me.exceeded {
+		return 0, me.errLocked()
+	}
+	return me.buf.Write(p)
+}
+
+// err returns the error if the result exceeds the limit, or nil
+func (me *pluginResultBuffer) err() error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.errLocked()
+}
+
+func (me *pluginResultBuffer) errLocked() error {
+	if !me.exceeded {
+		return nil
+	}
+	return fmt.Errorf("result exceeds the limit of %d bytes", me.limit)
+}
+
+func (me *pluginResultBuffer) String() string {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.buf.String()
+}
@@ -0,0 +1,703 @@
+package qplugin
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/traefik/yaegi/interp"
+	"github.com/traefik/yaegi/stdlib"
+)
+
+// PluginPermission grants a script plugin access to the stdlib packages and functions reaching outside the
+// interpreter, declared in the permissions section of the plugin manifest
+type PluginPermission = string
+
+const (
+	PLUGIN_PERMISSION_FS_READ    = "fs.read"
+	PLUGIN_PERMISSION_FS_WRITE   = "fs.write"
+	PLUGIN_PERMISSION_NET_DIAL   = "net.dial"
+	PLUGIN_PERMISSION_NET_LISTEN = "net.listen"
+	PLUGIN_PERMISSION_EXEC       = "exec"
+
+	// process environment, ie. env variables, working directory, user and process ids
+	PLUGIN_PERMISSION_ENV = "env"
+
+	// process wide settings and low level access, ie. syscall, signals, runtime tuning
+	PLUGIN_PERMISSION_SYS = "sys"
+
+	// WASI for wasm plugins, ie. stdio, clocks, and the other WASI permissions apply within it
+	PLUGIN_PERMISSION_WASI = "wasi"
+)
+
+var pluginPermissions = []PluginPermission{
+	PLUGIN_PERMISSION_FS_READ,
+	PLUGIN_PERMISSION_FS_WRITE,
+	PLUGIN_PERMISSION_NET_DIAL,
+	PLUGIN_PERMISSION_NET_LISTEN,
+	PLUGIN_PERMISSION_EXEC,
+	PLUGIN_PERMISSION_ENV,
+	PLUGIN_PERMISSION_SYS,
+	PLUGIN_PERMISSION_WASI,
+}
+
+// pluginPermissionRules is the allowlist of the stdlib: maps the package, package.Symbol or package.Type.Method to
+// the permission it requires, empty if nothing is required. A symbol not listed follows its package, a method not
+// listed is allowed along with its type, and a stdlib package not listed is denied unless the sys permission is
+// granted.
+var pluginPermissionRules = map[string]PluginPermission{
+	"archive/tar":            "",
+	"archive/zip":            "",
+	"archive/zip.OpenReader": PLUGIN_PERMISSION_FS_READ,
+	"bufio":                  "",
+	"bytes":                  "",
+	"compress/bzip2":         "",
+	"compress/flate":         "",
+	"compress/gzip":          "",
+	"compress/lzw":           "",
+	"compress/zlib":          "",
+	"container/heap":         "",
+	"container/list":         "",
+	"container/ring":         "",
+	"context":                "",
+	"crypto":                 "",
+	"crypto/aes":             "",
+	"crypto/cipher":          "",
+	"crypto/des":             "",
+	"crypto/dsa":             "",
+	"crypto/ecdsa":           "",
+	"crypto/ed25519":         "",
+	"crypto/elliptic":        "",
+	"crypto/hmac":            "",
+	"crypto/md5":             "",
+	"crypto/rand":            "",
+	"crypto/rc4":             "",
+	"crypto/rsa":             "",
+	"crypto/sha1":            "",
+	"crypto/sha256":          "",
+	"crypto/sha512":          "",
+	"crypto/subtle":          "",
+
+	"crypto/tls":                 "",
+	"crypto/tls.Dial":            PLUGIN_PERMISSION_NET_DIAL,
+	"crypto/tls.DialWithDialer":  PLUGIN_PERMISSION_NET_DIAL,
+	"crypto/tls.Dialer":          PLUGIN_PERMISSION_NET_DIAL,
+	"crypto/tls.Listen":          PLUGIN_PERMISSION_NET_LISTEN,
+	"crypto/tls.LoadX509KeyPair": PLUGIN_PERMISSION_FS_READ,
+	"crypto/tls.NewListener":     PLUGIN_PERMISSION_NET_LISTEN,
+
+	"crypto/x509":                "",
+	"crypto/x509.SystemCertPool": PLUGIN_PERMISSION_FS_READ,
+	"crypto/x509/pkix":           "",
+	"database/sql":               "",
+	"database/sql/driver":        "",
+
+	"debug/buildinfo":          "",
+	"debug/buildinfo.ReadFile": PLUGIN_PERMISSION_FS_READ,
+	"debug/dwarf":              "",
+	"debug/elf":                "",
+	"debug/elf.Open":           PLUGIN_PERMISSION_FS_READ,
+	"debug/gosym":              "",
+	"debug/macho":              "",
+	"debug/macho.Open":         PLUGIN_PERMISSION_FS_READ,
+	"debug/macho.OpenFat":      PLUGIN_PERMISSION_FS_READ,
+	"debug/pe":                 "",
+	"debug/pe.Open":            PLUGIN_PERMISSION_FS_READ,
+	"debug/plan9obj":           "",
+	"debug/plan9obj.Open":      PLUGIN_PERMISSION_FS_READ,
+
+	"embed":            "",
+	"encoding":         "",
+	"encoding/ascii85": "",
+	"encoding/asn1":    "",
+	"encoding/base32":  "",
+	"encoding/base64":  "",
+	"encoding/binary":  "",
+	"encoding/csv":     "",
+	"encoding/gob":     "",
+	"encoding/hex":     "",
+	"encoding/json":    "",
+	"encoding/pem":     "",
+	"encoding/xml":     "",
+	"errors":           "",
+
+	// the package functions work on the command line of the host
+	"flag":                 PLUGIN_PERMISSION_SYS,
+	"flag.ContinueOnError": "",
+	"flag.ErrHelp":         "",
+	"flag.ErrorHandling":   "",
+	"flag.Flag":            "",
+	"flag.FlagSet":         "",
+	"flag.Getter":          "",
+	"flag.NewFlagSet":      "",
+	"flag.PanicOnError":    "",
+	"flag.UnquoteUsage":    "",
+	"flag.Value":           "",
+
+	"fmt":                  "",
+	"go/ast":               "",
+	"go/build/constraint":  "",
+	"go/constant":          "",
+	"go/doc":               "",
+	"go/format":            "",
+	"go/parser":            "",
+	"go/parser.ParseDir":   PLUGIN_PERMISSION_FS_READ,
+	"go/parser.ParseFile":  PLUGIN_PERMISSION_FS_READ,
+	"go/printer":           "",
+	"go/scanner":           "",
+	"go/token":             "",
+	"go/types":             "",
+	"hash":                 "",
+	"hash/adler32":         "",
+	"hash/crc32":           "",
+	"hash/crc64":           "",
+	"hash/fnv":             "",
+	"hash/maphash":         "",
+	"html":                 "",
+	"image":                "",
+	"image/color":          "",
+	"image/color/palette":  "",
+	"image/draw":           "",
+	"image/gif":            "",
+	"image/jpeg":           "",
+	"image/png":            "",
+	"index/suffixarray":    "",
+	"io":                   "",
+	"io/fs":                "",
+	"math":                 "",
+	"math/big":             "",
+	"math/bits":            "",
+	"math/cmplx":           "",
+	"math/rand":            "",
+	"mime/multipart":       "",
+	"mime/quotedprintable": "",
+	"path":                 "",
+	"regexp":               "",
+	"regexp/syntax":        "",
+	"runtime/metrics":      "",
+	"sort":                 "",
+	"strconv":              "",
+	"strings":              "",
+	"sync":                 "",
+	"sync/atomic":          "",
+	"testing/fstest":       "",
+	"testing/iotest":       "",
+	"testing/quick":        "",
+	"text/scanner":         "",
+	"text/tabwriter":       "",
+	"text/template/parse":  "",
+	"time":                 "",
+	"unicode":              "",
+	"unicode/utf16":        "",
+	"unicode/utf8":         "",
+
+	// a Template reads files by its ParseFiles and ParseGlob, so the type and whatever returns it are denied, as
+	// the methods can't be stopped from being called dynamically
+	"text/template":            "",
+	"text/template.Must":       PLUGIN_PERMISSION_FS_READ,
+	"text/template.New":        PLUGIN_PERMISSION_FS_READ,
+	"text/template.ParseFS":    PLUGIN_PERMISSION_FS_READ,
+	"text/template.ParseFiles": PLUGIN_PERMISSION_FS_READ,
+	"text/template.ParseGlob":  PLUGIN_PERMISSION_FS_READ,
+	"text/template.Template":   PLUGIN_PERMISSION_FS_READ,
+	"html/template":            "",
+	"html/template.Must":       PLUGIN_PERMISSION_FS_READ,
+	"html/template.New":        PLUGIN_PERMISSION_FS_READ,
+	"html/template.ParseFS":    PLUGIN_PERMISSION_FS_READ,
+	"html/template.ParseFiles": PLUGIN_PERMISSION_FS_READ,
+	"html/template.ParseGlob":  PLUGIN_PERMISSION_FS_READ,
+	"html/template.Template":   PLUGIN_PERMISSION_FS_READ,
+
+	"io/ioutil":           "",
+	"io/ioutil.ReadDir":   PLUGIN_PERMISSION_FS_READ,
+	"io/ioutil.ReadFile":  PLUGIN_PERMISSION_FS_READ,
+	"io/ioutil.TempDir":   PLUGIN_PERMISSION_FS_WRITE,
+	"io/ioutil.TempFile":  PLUGIN_PERMISSION_FS_WRITE,
+	"io/ioutil.WriteFile": PLUGIN_PERMISSION_FS_WRITE,
+
+	// Fatal is to exit the process, though the interpreter panics instead, and the others change the logger of
+	// the host
+	"log":               PLUGIN_PERMISSION_SYS,
+	"log.Flags":         "",
+	"log.LUTC":          "",
+	"log.Ldate":         "",
+	"log.Llongfile":     "",
+	"log.Lmicroseconds": "",
+	"log.Lmsgprefix":    "",
+	"log.Logger":        "",
+	"log.Lshortfile":    "",
+	"log.LstdFlags":     "",
+	"log.Ltime":         "",
+	"log.New":           "",
+	"log.Output":        "",
+	"log.Panic":         "",
+	"log.Panicf":        "",
+	"log.Panicln":       "",
+	"log.Prefix":        "",
+	"log.Print":         "",
+	"log.Printf":        "",
+	"log.Println":       "",
+	"log.Writer":        "",
+	"log/syslog":        PLUGIN_PERMISSION_NET_DIAL,
+
+	"mime":                  "",
+	"mime.AddExtensionType": PLUGIN_PERMISSION_SYS,
+
+	"os":                     PLUGIN_PERMISSION_SYS,
+	"os.Args":                PLUGIN_PERMISSION_ENV,
+	"os.Chmod":               PLUGIN_PERMISSION_FS_WRITE,
+	"os.Chown":               PLUGIN_PERMISSION_FS_WRITE,
+	"os.Chtimes":             PLUGIN_PERMISSION_FS_WRITE,
+	"os.Clearenv":            PLUGIN_PERMISSION_ENV,
+	"os.Create":              PLUGIN_PERMISSION_FS_WRITE,
+	"os.CreateTemp":          PLUGIN_PERMISSION_FS_WRITE,
+	"os.DevNull":             "",
+	"os.DirEntry":            "",
+	"os.DirFS":               PLUGIN_PERMISSION_FS_READ,
+	"os.Environ":             PLUGIN_PERMISSION_ENV,
+	"os.ErrClosed":           "",
+	"os.ErrDeadlineExceeded": "",
+	"os.ErrExist":            "",
+	"os.ErrInvalid":          "",
+	"os.ErrNoDeadline":       "",
+	"os.ErrNotExist":         "",
+	"os.ErrPermission":       "",
+	"os.ErrProcessDone":      "",
+	"os.Executable":          PLUGIN_PERMISSION_ENV,
+	"os.Expand":              "",
+	"os.ExpandEnv":           PLUGIN_PERMISSION_ENV,
+	"os.File":                "",
+	"os.FileInfo":            "",
+	"os.FileMode":            "",
+	"os.FindProcess":         PLUGIN_PERMISSION_EXEC,
+	"os.Getegid":             PLUGIN_PERMISSION_ENV,
+	"os.Getenv":              PLUGIN_PERMISSION_ENV,
+	"os.Geteuid":             PLUGIN_PERMISSION_ENV,
+	"os.Getgid":              PLUGIN_PERMISSION_ENV,
+	"os.Getgroups":           PLUGIN_PERMISSION_ENV,
+	"os.Getpagesize":         "",
+	"os.Getpid":              PLUGIN_PERMISSION_ENV,
+	"os.Getppid":             PLUGIN_PERMISSION_ENV,
+	"os.Getuid":              PLUGIN_PERMISSION_ENV,
+	"os.Getwd":               PLUGIN_PERMISSION_ENV,
+	"os.Hostname":            PLUGIN_PERMISSION_ENV,
+	"os.Interrupt":           "",
+	"os.IsExist":             "",
+	"os.IsNotExist":          "",
+	"os.IsPathSeparator":     "",
+	"os.IsPermission":        "",
+	"os.IsTimeout":           "",
+	"os.Kill":                "",
+	"os.Lchown":              PLUGIN_PERMISSION_FS_WRITE,
+	"os.Link":                PLUGIN_PERMISSION_FS_WRITE,
+	"os.LinkError":           "",
+	"os.LookupEnv":           PLUGIN_PERMISSION_ENV,
+	"os.Lstat":               PLUGIN_PERMISSION_FS_READ,
+	"os.Mkdir":               PLUGIN_PERMISSION_FS_WRITE,
+	"os.MkdirAll":            PLUGIN_PERMISSION_FS_WRITE,
+	"os.MkdirTemp":           PLUGIN_PERMISSION_FS_WRITE,
+	"os.ModeAppend":          "",
+	"os.ModeCharDevice":      "",
+	"os.ModeDevice":          "",
+	"os.ModeDir":             "",
+	"os.ModeExclusive":       "",
+	"os.ModeIrregular":       "",
+	"os.ModeNamedPipe":       "",
+	"os.ModePerm":            "",
+	"os.ModeSetgid":          "",
+	"os.ModeSetuid":          "",
+	"os.ModeSocket":          "",
+	"os.ModeSticky":          "",
+	"os.ModeSymlink":         "",
+	"os.ModeTemporary":       "",
+	"os.ModeType":            "",
+	"os.NewSyscallError":     "",
+	"os.O_APPEND":            "",
+	"os.O_CREATE":            "",
+	"os.O_EXCL":              "",
+	"os.O_RDONLY":            "",
+	"os.O_RDWR":              "",
+	"os.O_SYNC":              "",
+	"os.O_TRUNC":             "",
+	"os.O_WRONLY":            "",
+	"os.Open":                PLUGIN_PERMISSION_FS_READ,
+	"os.OpenFile":            PLUGIN_PERMISSION_FS_WRITE,
+	"os.PathError":           "",
+	"os.PathListSeparator":   "",
+	"os.PathSeparator":       "",
+	"os.Pipe":                "",
+	"os.ProcAttr":            PLUGIN_PERMISSION_EXEC,
+	"os.Process":             PLUGIN_PERMISSION_EXEC,
+	"os.ProcessState":        PLUGIN_PERMISSION_EXEC,
+	"os.ReadDir":             PLUGIN_PERMISSION_FS_READ,
+	"os.ReadFile":            PLUGIN_PERMISSION_FS_READ,
+	"os.Readlink":            PLUGIN_PERMISSION_FS_READ,
+	"os.Remove":              PLUGIN_PERMISSION_FS_WRITE,
+	"os.RemoveAll":           PLUGIN_PERMISSION_FS_WRITE,
+	"os.Rename":              PLUGIN_PERMISSION_FS_WRITE,
+	"os.SEEK_CUR":            "",
+	"os.SEEK_END":            "",
+	"os.SEEK_SET":            "",
+	"os.SameFile":            "",
+	"os.Setenv":              PLUGIN_PERMISSION_ENV,
+	"os.Signal":              "",
+	"os.StartProcess":        PLUGIN_PERMISSION_EXEC,
+	"os.Stat":                PLUGIN_PERMISSION_FS_READ,
+	"os.Stderr":              "",
+	"os.Stdin":               "",
+	"os.Stdout":              "",
+	"os.Symlink":             PLUGIN_PERMISSION_FS_WRITE,
+	"os.SyscallError":        "",
+	"os.TempDir":             PLUGIN_PERMISSION_ENV,
+	"os.Truncate":            PLUGIN_PERMISSION_FS_WRITE,
+	"os.Unsetenv":            PLUGIN_PERMISSION_ENV,
+	"os.UserCacheDir":        PLUGIN_PERMISSION_ENV,
+	"os.UserConfigDir":       PLUGIN_PERMISSION_ENV,
+	"os.UserHomeDir":         PLUGIN_PERMISSION_ENV,
+	"os.WriteFile":           PLUGIN_PERMISSION_FS_WRITE,
+
+	// a File opened for read may still change the metadata of the file
+	"os.File.Chdir":       PLUGIN_PERMISSION_SYS,
+	"os.File.Chmod":       PLUGIN_PERMISSION_FS_WRITE,
+	"os.File.Chown":       PLUGIN_PERMISSION_FS_WRITE,
+	"os.File.ReadFrom":    PLUGIN_PERMISSION_FS_WRITE,
+	"os.File.Sync":        PLUGIN_PERMISSION_FS_WRITE,
+	"os.File.Truncate":    PLUGIN_PERMISSION_FS_WRITE,
+	"os.File.Write":       PLUGIN_PERMISSION_FS_WRITE,
+	"os.File.WriteAt":     PLUGIN_PERMISSION_FS_WRITE,
+	"os.File.WriteString": PLUGIN_PERMISSION_FS_WRITE,
+
+	"os/exec":   PLUGIN_PERMISSION_EXEC,
+	"os/signal": PLUGIN_PERMISSION_SYS,
+	"os/user":   PLUGIN_PERMISSION_ENV,
+	"syscall":   PLUGIN_PERMISSION_SYS,
+
+	"path/filepath":              "",
+	"path/filepath.Abs":          PLUGIN_PERMISSION_FS_READ,
+	"path/filepath.EvalSymlinks": PLUGIN_PERMISSION_FS_READ,
+	"path/filepath.Glob":         PLUGIN_PERMISSION_FS_READ,
+	"path/filepath.Walk":         PLUGIN_PERMISSION_FS_READ,
+	"path/filepath.WalkDir":      PLUGIN_PERMISSION_FS_READ,
+
+	"net":                    PLUGIN_PERMISSION_NET_DIAL,
+	"net.FileListener":       PLUGIN_PERMISSION_NET_LISTEN,
+	"net.FilePacketConn":     PLUGIN_PERMISSION_NET_LISTEN,
+	"net.Listen":             PLUGIN_PERMISSION_NET_LISTEN,
+	"net.ListenConfig":       PLUGIN_PERMISSION_NET_LISTEN,
+	"net.ListenIP":           PLUGIN_PERMISSION_NET_LISTEN,
+	"net.ListenMulticastUDP": PLUGIN_PERMISSION_NET_LISTEN,
+	"net.ListenPacket":       PLUGIN_PERMISSION_NET_LISTEN,
+	"net.ListenTCP":          PLUGIN_PERMISSION_NET_LISTEN,
+	"net.ListenUDP":          PLUGIN_PERMISSION_NET_LISTEN,
+	"net.ListenUnix":         PLUGIN_PERMISSION_NET_LISTEN,
+	"net.ListenUnixgram":     PLUGIN_PERMISSION_NET_LISTEN,
+
+	"net/http":                   PLUGIN_PERMISSION_NET_DIAL,
+	"net/http.Dir":               PLUGIN_PERMISSION_FS_READ,
+	"net/http.ListenAndServe":    PLUGIN_PERMISSION_NET_LISTEN,
+	"net/http.ListenAndServeTLS": PLUGIN_PERMISSION_NET_LISTEN,
+	"net/http.NewFileTransport":  PLUGIN_PERMISSION_FS_READ,
+	"net/http.Serve":             PLUGIN_PERMISSION_NET_LISTEN,
+	"net/http.ServeFile":         PLUGIN_PERMISSION_FS_READ,
+	"net/http.ServeTLS":          PLUGIN_PERMISSION_NET_LISTEN,
+	"net/http.Server":            PLUGIN_PERMISSION_NET_LISTEN,
+
+	"net/http/cgi":       PLUGIN_PERMISSION_EXEC,
+	"net/http/cookiejar": "",
+	"net/http/fcgi":      PLUGIN_PERMISSION_NET_LISTEN,
+	"net/http/httptest":  PLUGIN_PERMISSION_NET_LISTEN,
+	"net/http/httptrace": "",
+	"net/http/httputil":  PLUGIN_PERMISSION_NET_DIAL,
+	"net/http/pprof":     PLUGIN_PERMISSION_NET_LISTEN,
+	"net/mail":           "",
+	"net/netip":          "",
+	"net/rpc":            PLUGIN_PERMISSION_NET_DIAL,
+	"net/rpc/jsonrpc":    PLUGIN_PERMISSION_NET_DIAL,
+	"net/smtp":           PLUGIN_PERMISSION_NET_DIAL,
+	"net/textproto":      "",
+	"net/textproto.Dial": PLUGIN_PERMISSION_NET_DIAL,
+	"net/url":            "",
+
+	"runtime":                    PLUGIN_PERMISSION_SYS,
+	"runtime.Caller":             "",
+	"runtime.Callers":            "",
+	"runtime.CallersFrames":      "",
+	"runtime.Compiler":           "",
+	"runtime.Error":              "",
+	"runtime.Frame":              "",
+	"runtime.Frames":             "",
+	"runtime.Func":               "",
+	"runtime.FuncForPC":          "",
+	"runtime.GC":                 "",
+	"runtime.GOARCH":             "",
+	"runtime.GOOS":               "",
+	"runtime.Gosched":            "",
+	"runtime.KeepAlive":          "",
+	"runtime.MemStats":           "",
+	"runtime.NumCPU":             "",
+	"runtime.NumCgoCall":         "",
+	"runtime.NumGoroutine":       "",
+	"runtime.ReadMemStats":       "",
+	"runtime.Stack":              "",
+	"runtime.TypeAssertionError": "",
+	"runtime.Version":            "",
+}
+
+// pluginStdlibPackages are the stdlib packages the interpreter could import. The other packages, ie. the host
+// exports and the plugin's own packages, are not subject to the permissions.
+var pluginStdlibPackages = func() map[string]bool {
+	r := map[string]bool{"syscall": true, "unsafe": true}
+	for key := range stdlib.Symbols {
+		if importPath := path.Dir(key); importPath != "." {
+			r[importPath] = true
+		}
+	}
+	return r
+}()
+
+// RequiredPluginPermission returns the permission required to use the symbol of the stdlib package, or empty if
+// nothing is required
+func RequiredPluginPermission(importPath string, symbol string) PluginPermission {
+	if r, found := pluginPermissionRules[importPath+"."+symbol]; found {
+		return r
+	}
+	return requiredPluginPackagePermission(importPath)
+}
+
+// requiredPluginPackagePermission returns the permission required to import the package
+func requiredPluginPackagePermission(importPath string) PluginPermission {
+	if r, found := pluginPermissionRules[importPath]; found {
+		return r
+	}
+	if pluginStdlibPackages[importPath] {
+		return PLUGIN_PERMISSION_SYS
+	}
+	return ""
+}
+
+// requiredPluginMethodPermission returns the permission required to call the method of the stdlib type
+func requiredPluginMethodPermission(importPath string, typeName string, method string) PluginPermission {
+	return pluginPermissionRules[importPath+"."+typeName+"."+method]
+}
+
+func hasPluginPermission(permissions []PluginPermission, permission PluginPermission) bool {
+	if len(permission) == 0 {
+		return true
+	}
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPluginPermissions verifies the permissions are known, and all within the cap. A nil cap means no cap.
+func checkPluginPermissions(permissions []PluginPermission, permissionCap []PluginPermission) error {
+	errs := comm.NewErrorGroup(false)
+	for _, p := range permissions {
+		if !hasPluginPermission(pluginPermissions, p) {
+			errs.Add(fmt.Errorf("unknown permission %s, expect one of: %s", p, strings.Join(pluginPermissions, ", ")))
+		} else if permissionCap != nil && !hasPluginPermission(permissionCap, p) {
+			errs.Add(fmt.Errorf("permission %s is beyond the cap: %s", p, strings.Join(permissionCap, ", ")))
+		}
+	}
+	return errs.MayError()
+}
+
+// filterPluginSymbols returns the symbols allowed by the permissions
+func filterPluginSymbols(symbols interp.Exports, permissions []PluginPermission) interp.Exports {
+	r := make(interp.Exports, len(symbols))
+	for key, pkgSymbols := range symbols {
+		importPath := path.Dir(key)
+		if importPath == "." {
+			// not a package but the wrapper mapping
+			r[key] = pkgSymbols
+			continue
+		}
+
+		allowed := make(map[string]reflect.Value, len(pkgSymbols))
+		for name, symbol := range pkgSymbols {
+			if hasPluginPermission(permissions, RequiredPluginPermission(importPath, strings.TrimPrefix(name, "_"))) {
+				allowed[name] = symbol
+			}
+		}
+		if len(allowed) > 0 {
+			r[key] = allowed
+		}
+	}
+	return r
+}
+
+// checkPluginSourcePermissions scans the use of stdlib symbols in the source, so that a denied one is reported
+// with the missing permission rather than as an undefined symbol
+func checkPluginSourcePermissions(fset *token.FileSet, file *ast.File, permissions []PluginPermission) []error {
+	r := []error{}
+	fileName := fset.Position(file.Pos()).Filename
+	reported := map[string]bool{}
+
+	imports := map[string]string{}
+	for _, imp := range file.Imports {
+		importPath, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+
+		name := path.Base(importPath)
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+
+		switch name {
+		case "_":
+			continue
+		case ".":
+			if p := requiredPluginPackagePermission(importPath); !hasPluginPermission(permissions, p) {
+				r = append(r, fmt.Errorf("%s: import %s requires permission %s", fileName, importPath, p))
+			}
+			continue
+		}
+		imports[name] = importPath
+	}
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		x, ok := sel.X.(*ast.Ident)
+		if !ok || x.Obj != nil {
+			return true
+		}
+		importPath, found := imports[x.Name]
+		if !found {
+			return true
+		}
+
+		symbol := importPath + "." + sel.Sel.Name
+		if p := RequiredPluginPermission(importPath, sel.Sel.Name); !hasPluginPermission(permissions, p) && !reported[symbol] {
+			reported[symbol] = true
+			r = append(r, fmt.Errorf("%s: %s requires permission %s", fset.Position(sel.Pos()), symbol, p))
+		}
+		return true
+	})
+
+	return r
+}
+
+// pluginMethodRules maps the method name to the stdlib types whose method of the name requires a permission
+var pluginMethodRules = func() map[string][][2]string {
+	r := map[string][][2]string{}
+	for key := range pluginPermissionRules {
+		dot := strings.LastIndex(key, ".")
+		if dot < 0 {
+			continue
+		}
+		typeKey, method := key[:dot], key[dot+1:]
+		typeDot := strings.LastIndex(typeKey, ".")
+		if typeDot < 0 || typeDot < strings.LastIndex(typeKey, "/") {
+			// not a method but a package or a package symbol
+			continue
+		}
+		r[method] = append(r[method], [2]string{typeKey[:typeDot], typeKey[typeDot+1:]})
+	}
+	return r
+}()
+
+// checkPluginMethodPermissions scans the calls of the stdlib methods in the type-checked source. Unlike the
+// package symbols, the methods can't be filtered out of the interpreter, so this is where they are denied. A call
+// through the plugin's own interface is denied as well if a stdlib type implementing the interface requires a
+// permission for the method. reflect requires the sys permission, so the methods can't be called otherwise.
+func checkPluginMethodPermissions(fset *token.FileSet, info *types.Info, permissions []PluginPermission) []error {
+	exprs := make([]*ast.SelectorExpr, 0, len(info.Selections))
+	for expr := range info.Selections {
+		exprs = append(exprs, expr)
+	}
+	sort.Slice(exprs, func(i, j int) bool {
+		return exprs[i].Pos() < exprs[j].Pos()
+	})
+
+	packages := pluginUsedPackages(info)
+
+	r := []error{}
+	reported := map[string]bool{}
+	deny := func(expr *ast.SelectorExpr, importPath string, typeName string, method string, through string) {
+		symbol := importPath + "." + typeName + "." + method
+		p := requiredPluginMethodPermission(importPath, typeName, method)
+		if !hasPluginPermission(permissions, p) && !reported[symbol+through] {
+			reported[symbol+through] = true
+			r = append(r, fmt.Errorf("%s: %s%s requires permission %s", fset.Position(expr.Sel.Pos()), symbol, through, p))
+		}
+	}
+
+	for _, expr := range exprs {
+		sel := info.Selections[expr]
+		method, ok := sel.Obj().(*types.Func)
+		if !ok || method.Pkg() == nil {
+			continue
+		}
+
+		if pluginStdlibPackages[method.Pkg().Path()] {
+			if typeName := pluginMethodTypeName(sel); len(typeName) > 0 {
+				deny(expr, method.Pkg().Path(), typeName, method.Name(), "")
+			}
+			continue
+		}
+
+		iface, ok := sel.Recv().Underlying().(*types.Interface)
+		if !ok {
+			continue
+		}
+		for _, rule := range pluginMethodRules[method.Name()] {
+			pkg := packages[rule[0]]
+			if pkg == nil {
+				continue
+			}
+			obj, ok := pkg.Scope().Lookup(rule[1]).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			if types.Implements(obj.Type(), iface) || types.Implements(types.NewPointer(obj.Type()), iface) {
+				deny(expr, rule[0], rule[1], method.Name(), " (through "+types.TypeString(sel.Recv(), nil)+")")
+			}
+		}
+	}
+	return r
+}
+
+// pluginUsedPackages returns the packages used by the type-checked source, by import path
+func pluginUsedPackages(info *types.Info) map[string]*types.Package {
+	r := map[string]*types.Package{}
+	for _, obj := range info.Uses {
+		if pkgName, ok := obj.(*types.PkgName); ok {
+			r[pkgName.Imported().Path()] = pkgName.Imported()
+		} else if obj.Pkg() != nil {
+			r[obj.Pkg().Path()] = obj.Pkg()
+		}
+	}
+	return r
+}
+
+// pluginMethodTypeName returns the name of the type declaring the selected method, or empty if it's not named
+func pluginMethodTypeName(sel *types.Selection) string {
+	candidates := []types.Type{sel.Recv()}
+	if recv := sel.Obj().Type().(*types.Signature).Recv(); recv != nil {
+		candidates = append([]types.Type{recv.Type()}, candidates...)
+	}
+	for _, t := range candidates {
+		if pt, ok := t.(*types.Pointer); ok {
+			t = pt.Elem()
+		}
+		if named, ok := t.(*types.Named); ok {
+			return named.Obj().Name()
+		}
+	}
+	return ""
+}
@@ -2,32 +2,54 @@ package qplugin
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/emirpasic/gods/sets/hashset"
 	"github.com/fastgh/go-comm/v2"
+	"github.com/pkg/errors"
 )
 
 type PluginRegistryT struct {
-	loaders               map[string]PluginLoader
-	plugins               []Plugin
-	pluginsByKind         map[PluginKind]map[string]Plugin
+	loaders               *comm.OrderedMap[PluginLoader]
+	snapshot              atomic.Pointer[PluginRegistrySnapshotT]
 	supportedKinds        hashset.Set
 	supportedMajorVersion int
-	mutex                 sync.RWMutex
+	hostVersion           *semver.Version
+	apiLevel              int
+	startMode             PluginStartMode
+	shadowPolicy          PluginShadowPolicy
+	namespacePriority     []string
+	dataDir               string
+	permissionCaps        map[string][]PluginPermission
+
+	// guards loaders and settings, never held while a plugin starts or stops
+	mutex sync.Mutex
+
+	// serializes Init and Destroy
+	lifecycleMutex sync.Mutex
 }
 
 type PluginRegistry = *PluginRegistryT
 
 func NewPluginRegistry(supportedMajorVersion int, supportedKinds ...PluginKind) PluginRegistry {
 	r := &PluginRegistryT{
-		loaders:               map[string]PluginLoader{},
-		plugins:               []Plugin{},
-		pluginsByKind:         map[PluginKind]map[string]Plugin{},
+		loaders:               comm.NewOrderedMap[PluginLoader](nil),
 		supportedKinds:        *comm.Slice2Set(supportedKinds...),
 		supportedMajorVersion: supportedMajorVersion,
-		mutex:                 sync.RWMutex{},
+		hostVersion:           nil,
+		apiLevel:              0,
+		startMode:             PLUGIN_START_PER_LOADER,
+		shadowPolicy:          PLUGIN_SHADOW_REJECT,
+		namespacePriority:     []string{},
+		dataDir:               "",
+		permissionCaps:        map[string][]PluginPermission{},
+		mutex:                 sync.Mutex{},
+		lifecycleMutex:        sync.Mutex{},
 	}
+	r.snapshot.Store(newEmptyPluginRegistrySnapshot())
 	return r
 }
 
@@ -39,8 +61,164 @@ func (me PluginRegistry) SupportedMajorVersion() int {
 	return me.supportedMajorVersion
 }
 
+// HostVersion returns the version of the host application, or empty string if not set
+func (me PluginRegistry) HostVersion() string {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	if me.hostVersion == nil {
+		return ""
+	}
+	return me.hostVersion.Original()
+}
+
+// SetHostVersion sets the version of the host application, ie. 2.3.1, to check the requires.host and
+// min_host_version of the plugins discovered afterwards; they aren't checked if not set. It's the HOST_VERSION
+// manifest variable of the plugins discovered afterwards as well.
+func (me PluginRegistry) SetHostVersion(version string) {
+	v, err := parseHostVersion(version)
+	if err != nil {
+		panic(err)
+	}
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	me.hostVersion = v
+}
+
+// constraints returns what the registry requires of the plugins of the namespace
+func (me PluginRegistry) constraints(namespace string) externalPluginConstraints {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.constraintsLocked(namespace)
+}
+
+// constraintsLocked returns what the registry requires of the plugins of the namespace, the caller holds the mutex
+func (me PluginRegistry) constraintsLocked(namespace string) externalPluginConstraints {
+	return &externalPluginConstraintsT{
+		namespace:     namespace,
+		permissionCap: me.permissionCaps[namespace],
+		hostVersion:   me.hostVersion,
+		apiLevel:      me.apiLevel,
+	}
+}
+
+// ApiLevel returns the API level of the host application, or 0 if not set
+func (me PluginRegistry) ApiLevel() int {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.apiLevel
+}
+
+// SetApiLevel sets the API level of the host application, which increases whenever the host API gains features, to
+// check the requires.api_level of the plugins discovered afterwards; it isn't checked if not set
+func (me PluginRegistry) SetApiLevel(apiLevel int) {
+	if apiLevel < 0 {
+		panic(fmt.Errorf("invalid API level %d, expect non-negative", apiLevel))
+	}
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	me.apiLevel = apiLevel
+}
+
+func (me PluginRegistry) StartMode() PluginStartMode {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.startMode
+}
+
+// SetStartMode decides whether a failed loader rolls back the other loaders started by Init
+func (me PluginRegistry) SetStartMode(startMode PluginStartMode) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	me.startMode = startMode
+}
+
+func (me PluginRegistry) ShadowPolicy() PluginShadowPolicy {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.shadowPolicy
+}
+
+// SetShadowPolicy decides how to handle plugins of the same kind and name from different namespaces.
+// The namespaces are listed by priority, the highest first; namespaces not listed follow them, in the order
+// their loaders were registered.
+func (me PluginRegistry) SetShadowPolicy(shadowPolicy PluginShadowPolicy, namespacesByPriority ...string) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	me.shadowPolicy = shadowPolicy
+	me.namespacePriority = namespacesByPriority
+}
+
+func (me PluginRegistry) DataDir() string {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.dataDir
+}
+
+// SetDataDir sets the base directory where plugins keep their data, each plugin has its own sub directory
+func (me PluginRegistry) SetDataDir(dataDir string) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	me.dataDir = dataDir
+}
+
+// PermissionCap returns the permissions the plugins of the namespace may request, or nil if no cap
+func (me PluginRegistry) PermissionCap(namespace string) []PluginPermission {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.permissionCaps[namespace]
+}
+
+// SetPermissionCap caps the permissions the plugins of the namespace may request, a plugin requesting more is
+// rejected before its code runs. No permissions means nothing may be requested.
+func (me PluginRegistry) SetPermissionCap(namespace string, permissions ...PluginPermission) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	if permissions == nil {
+		permissions = []PluginPermission{}
+	}
+	me.permissionCaps[namespace] = permissions
+}
+
+// loadersByPriority sorts the loaders by the priority of their namespaces, the highest first
+func loadersByPriority(loaders []PluginLoader, namespacePriority []string) []PluginLoader {
+	rank := func(ns string) int {
+		for i, n := range namespacePriority {
+			if n == ns {
+				return i
+			}
+		}
+		return len(namespacePriority)
+	}
+
+	r := make([]PluginLoader, len(loaders))
+	copy(r, loaders)
+
+	sort.SliceStable(r, func(i, j int) bool {
+		return rank(r[i].Namespace()) < rank(r[j].Namespace())
+	})
+	return r
+}
+
 func (me PluginRegistry) ValidatePlugin(namespace string, plugin Plugin) error {
 	name := plugin.Name()
+	if len(name) == 0 {
+		return fmt.Errorf("plugin name of namespace %s is not specified", namespace)
+	}
 
 	major, _ := plugin.Version()
 	if major != me.supportedMajorVersion {
@@ -53,63 +231,348 @@ func (me PluginRegistry) ValidatePlugin(namespace string, plugin Plugin) error {
 		return fmt.Errorf("plugin %s/%s claims unsupported plugin kind %s", namespace, name, kind)
 	}
 
+	if p, ok := plugin.(PermissionedPlugin); ok {
+		if err := checkPluginPermissions(p.Permissions(), me.PermissionCap(namespace)); err != nil {
+			return errors.Wrapf(err, "invalid permissions of plugin %s/%s", namespace, name)
+		}
+	}
+
+	if mf := PluginManifestOf(plugin); mf != nil {
+		me.mutex.Lock()
+		hostVersion, apiLevel := me.hostVersion, me.apiLevel
+		me.mutex.Unlock()
+
+		if err := checkPluginCompatibility(mf, hostVersion, apiLevel); err != nil {
+			return errors.Wrapf(err, "plugin %s/%s is incompatible with the host", namespace, name)
+		}
+	}
+
 	return nil
 }
 
+// Snapshot returns the current immutable view of the indexed plugins, it never blocks
+func (me PluginRegistry) Snapshot() PluginRegistrySnapshot {
+	return me.snapshot.Load()
+}
+
+// ById returns the plugin with the full plugin id, ie. namespace/name, or nil if not found
+func (me PluginRegistry) ById(id string) Plugin {
+	return me.Snapshot().ById(id)
+}
+
+// ByKind returns the plugins of the kind, keyed by plugin id
 func (me PluginRegistry) ByKind(kind PluginKind) map[string]Plugin {
-	me.mutex.RLock()
-	defer me.mutex.RUnlock()
+	return me.Snapshot().ByKind(kind)
+}
+
+// ByName returns the plugin of the kind and name from the namespace of the highest priority, or nil if not found
+func (me PluginRegistry) ByName(kind PluginKind, name string) Plugin {
+	return me.Snapshot().ByName(kind, name)
+}
 
-	return me.pluginsByKind[kind]
+// Contributions returns the contributions of the type from the started plugins, in the order of namespace
+// priority then plugin name
+func (me PluginRegistry) Contributions(contributionType string) []PluginContribution {
+	return me.Snapshot().Contributions(contributionType)
 }
 
-func (me PluginRegistry) Init(logger comm.Logger) {
+// Init runs the plugin pipeline in phases: every loader discovers its candidate plugins, then the registry
+// validates and indexes the candidates and tells each loader which of them are accepted, then the accepted plugins
+// are initialized, and at last the loaders start them, in the order the loaders were registered. No plugin code
+// runs before the plugin is accepted.
+//
+// Each loader starts its plugins all or nothing; with PLUGIN_START_PER_REGISTRY, a failed loader also stops the
+// loaders started before it, in reverse order.
+//
+// The plugins are indexed before they start, so that a plugin is able to look up the others from its own Start.
+func (me PluginRegistry) Init(logger comm.Logger) error {
+	me.lifecycleMutex.Lock()
+	defer me.lifecycleMutex.Unlock()
+
 	me.mutex.Lock()
-	defer me.mutex.Unlock()
+	allLoaders := me.loaders.Values()
+	startMode := me.startMode
+	for _, loader := range allLoaders {
+		if l, ok := loader.(constrainedPluginLoader); ok {
+			l.constrain(me.constraintsLocked(loader.Namespace()))
+		}
+	}
+	me.mutex.Unlock()
 
-	for ns, loader := range me.loaders {
-		logCtx := comm.NewLogContext(false)
-		logCtx.Str("namespace", ns)
-		subLogger := logger.NewSubLogger(logCtx)
+	errs := comm.NewErrorGroup(false)
+
+	loaders, candidates := discoverPlugins(logger, allLoaders, errs)
+	if errs.HasError() && startMode == PLUGIN_START_PER_REGISTRY {
+		return errs
+	}
+
+	me.index(logger, loaders, candidates, errs)
+	me.initPlugins(logger, loaders, errs)
+
+	started := make([]PluginLoader, 0, len(loaders))
+
+	for _, loader := range loaders {
+		subLogger := loaderLogger(logger, loader)
 
 		subLogger.Info().Msg("starting plugin loader")
 		err := loader.Start(logger)
 		if err != nil {
 			subLogger.Error(err).Msg("failed to start plugin loader")
+			errs.Add(err)
+
+			if startMode == PLUGIN_START_PER_REGISTRY {
+				if err := stopLoadersInReverse(logger, started); err != nil {
+					errs.Add(errors.Wrap(err, "rollback plugin loaders"))
+				}
+				started = started[:0]
+				break
+			}
 		} else {
 			subLogger.Info().Msg("started plugin loader")
+			started = append(started, loader)
 		}
 	}
+
+	// failed loaders have nothing running, so drop their plugins from the index, and release them
+	if len(started) != len(loaders) {
+		errs.Add(me.reindex(logger, started))
+		releaseUnstartedPlugins(logger, loaders, started)
+	}
+
+	return errs.MayError()
+}
+
+// releaseUnstartedPlugins releases the plugins of the loaders which aren't started
+func releaseUnstartedPlugins(logger comm.Logger, loaders []PluginLoader, started []PluginLoader) {
+	startedNamespaces := map[string]bool{}
+	for _, loader := range started {
+		startedNamespaces[loader.Namespace()] = true
+	}
+
+	for _, loader := range loaders {
+		if startedNamespaces[loader.Namespace()] {
+			continue
+		}
+		for _, plugin := range sortedPlugins(loader.Plugins()) {
+			if p, ok := plugin.(releasablePlugin); ok {
+				p.release(logger)
+			}
+		}
+	}
+}
+
+// discoverPlugins asks every loader for its candidate plugins, returns the loaders which discovered successfully,
+// and their candidates by namespace
+func discoverPlugins(logger comm.Logger, loaders []PluginLoader, errs comm.ErrorGroup) ([]PluginLoader, map[string][]Plugin) {
+	r := make([]PluginLoader, 0, len(loaders))
+	candidatesByNs := map[string][]Plugin{}
+
+	for _, loader := range loaders {
+		subLogger := loaderLogger(logger, loader)
+
+		subLogger.Info().Msg("discovering plugins")
+		candidates, err := loader.Discover(logger)
+		if err != nil {
+			subLogger.Error(err).Msg("failed to discover plugins")
+			errs.Add(errors.Wrapf(err, "discover plugins of namespace %s", loader.Namespace()))
+			continue
+		}
+		subLogger.Info().Int("amount", len(candidates)).Msg("discovered plugins")
+
+		if l, ok := loader.(DiagnosedPluginLoader); ok {
+			for _, d := range l.Diagnostics() {
+				errs.Add(errors.Wrapf(d, "discover plugins of namespace %s", loader.Namespace()))
+			}
+		}
+
+		candidatesByNs[loader.Namespace()] = candidates
+		r = append(r, loader)
+	}
+
+	return r, candidatesByNs
+}
+
+// index validates the candidates of the loaders, rejects the invalid ones and the ones duplicated with an
+// earlier loader's plugin, then builds the lookup tables with the accepted plugins
+func (me PluginRegistry) index(logger comm.Logger, loaders []PluginLoader, candidatesByNs map[string][]Plugin, errs comm.ErrorGroup) {
+	for _, loader := range loaders {
+		ns := loader.Namespace()
+		candidates := candidatesByNs[ns]
+		accepted := make([]Plugin, 0, len(candidates))
+
+		for _, plugin := range candidates {
+			if err := me.ValidatePlugin(ns, plugin); err != nil {
+				logger.Error(err).Str("pluginId", PluginId(ns, plugin.Name())).Msg("plugin rejected")
+				errs.Add(err)
+				continue
+			}
+
+			if p, ok := plugin.(registryBoundPlugin); ok {
+				p.bindRegistry(ns, me)
+			}
+			accepted = append(accepted, plugin)
+		}
+
+		loader.Accept(accepted)
+	}
+
+	if err := me.reindex(logger, loaders); err != nil {
+		errs.Add(err)
+	}
+}
+
+// initPlugins initializes the plugins accepted by the loaders, ie. loads their code, and drops the ones failed
+func (me PluginRegistry) initPlugins(logger comm.Logger, loaders []PluginLoader, errs comm.ErrorGroup) {
+	dropped := false
+
+	for _, loader := range loaders {
+		ns := loader.Namespace()
+		plugins := sortedPlugins(loader.Plugins())
+		accepted := make([]Plugin, 0, len(plugins))
+
+		for _, plugin := range plugins {
+			if p, ok := plugin.(initializablePlugin); ok {
+				if err := p.Init(logger); err != nil {
+					err = errors.Wrapf(err, "initialize plugin %s", PluginId(ns, plugin.Name()))
+					logger.Error(err).Str("pluginId", PluginId(ns, plugin.Name())).Msg("plugin failed to initialize")
+					errs.Add(err)
+					continue
+				}
+			}
+			accepted = append(accepted, plugin)
+		}
+
+		if len(accepted) != len(plugins) {
+			loader.Accept(accepted)
+			dropped = true
+		}
+	}
+
+	if dropped {
+		errs.Add(me.reindex(logger, loaders))
+	}
+}
+
+// reindex builds the lookup tables with the plugins accepted by the loaders, then publishes them as a new
+// snapshot. Plugins having the same kind and name in different namespaces are handled by the shadow policy, and
+// the loaders are told to drop the plugins rejected or shadowed.
+func (me PluginRegistry) reindex(logger comm.Logger, loaders []PluginLoader) error {
+	me.mutex.Lock()
+	shadowPolicy := me.shadowPolicy
+	namespacePriority := me.namespacePriority
+	me.mutex.Unlock()
+
+	errs := comm.NewErrorGroup(false)
+
+	r := newEmptyPluginRegistrySnapshot()
+	namespaceOfName := map[PluginKind]map[string]string{}
+
+	for _, loader := range loadersByPriority(loaders, namespacePriority) {
+		ns := loader.Namespace()
+		accepted := []Plugin{}
+		dropped := false
+
+		for _, plugin := range sortedPlugins(loader.Plugins()) {
+			name := plugin.Name()
+			kind := plugin.Kind()
+			id := PluginId(ns, name)
+
+			if r.pluginsByKind[kind] == nil {
+				r.pluginsByKind[kind] = map[string]Plugin{}
+				r.pluginsByName[kind] = map[string]Plugin{}
+				namespaceOfName[kind] = map[string]string{}
+			}
+
+			if existingPlugin, found := r.pluginsByName[kind][name]; found {
+				existingId := PluginId(namespaceOfName[kind][name], name)
+
+				switch shadowPolicy {
+				case PLUGIN_SHADOW_OVERRIDE:
+					logger.Warn().Str("pluginId", id).Str("by", existingId).Msg("plugin is shadowed, ignored")
+					dropped = true
+					continue
+				case PLUGIN_SHADOW_COEXIST:
+					logger.Warn().Str("pluginId", id).Str("by", existingId).Msg("plugin is shadowed, but coexists")
+				default:
+					errs.Add(fmt.Errorf("plugin %s has duplicated kind %s with %s: %+v", id, kind, existingId, existingPlugin))
+					dropped = true
+					continue
+				}
+			} else {
+				r.pluginsByName[kind][name] = plugin
+				namespaceOfName[kind][name] = ns
+			}
+
+			r.pluginsById[id] = plugin
+			r.pluginsByKind[kind][id] = plugin
+
+			accepted = append(accepted, plugin)
+			r.plugins = append(r.plugins, plugin)
+		}
+
+		if dropped {
+			loader.Accept(accepted)
+		}
+	}
+
+	me.snapshot.Store(r)
+
+	return errs.MayError()
 }
 
 func (me PluginRegistry) Destroy(logger comm.Logger) {
+	me.lifecycleMutex.Lock()
+	defer me.lifecycleMutex.Unlock()
+
 	me.mutex.Lock()
-	defer me.mutex.Unlock()
+	loaders := me.loaders.Values()
+	me.mutex.Unlock()
+
+	if err := stopLoadersInReverse(logger, loaders); err != nil {
+		logger.Error(err).Msg("failed to stop plugin loaders")
+	}
+
+	me.mutex.Lock()
+	me.loaders = comm.NewOrderedMap[PluginLoader](nil)
+	me.mutex.Unlock()
 
-	for ns, loader := range me.loaders {
-		logCtx := comm.NewLogContext(false)
-		logCtx.Str("namespace", ns)
-		subLogger := logger.NewSubLogger(logCtx)
+	me.snapshot.Store(newEmptyPluginRegistrySnapshot())
+}
+
+func loaderLogger(logger comm.Logger, loader PluginLoader) comm.Logger {
+	logCtx := comm.NewLogContext(false)
+	logCtx.Str("namespace", loader.Namespace())
+	return logger.NewSubLogger(logCtx)
+}
+
+func stopLoadersInReverse(logger comm.Logger, loaders []PluginLoader) error {
+	errs := comm.NewErrorGroup(false)
+
+	for i := len(loaders) - 1; i >= 0; i-- {
+		loader := loaders[i]
+		subLogger := loaderLogger(logger, loader)
 
 		subLogger.Info().Msg("stopping plugin loader")
 		err := loader.Stop(logger)
 		if err != nil {
 			subLogger.Error(err).Msg("failed to stop plugin loader")
+			errs.Add(err)
 		} else {
 			subLogger.Info().Msg("stopped plugin loader")
 		}
 	}
 
-	me.loaders = map[string]PluginLoader{}
-	me.plugins = []Plugin{}
-	me.pluginsByKind = map[PluginKind]map[string]Plugin{}
+	return errs.MayError()
 }
 
 func (me PluginRegistry) HasNamespace(ns string) bool {
-	_, r := me.loaders[ns]
-	return r
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	return me.loaders.Has(ns)
 }
 
+// Register adds the loader, its plugins are discovered, indexed and started by Init
 func (me PluginRegistry) Register(loader PluginLoader) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
@@ -119,41 +582,9 @@ func (me PluginRegistry) Register(loader PluginLoader) {
 		panic(fmt.Errorf("namespace not specified: %+v", loader))
 	}
 
-	if existingLoader, alreadyRegistered := me.loaders[ns]; alreadyRegistered {
+	if existingLoader, alreadyRegistered := me.loaders.Find(ns); alreadyRegistered {
 		panic(fmt.Errorf("plugin namespace %s is already registered by: %+v", ns, existingLoader))
 	}
 
-	newPlugins := loader.Plugins()
-
-	pluginsByKind := comm.DeepCopyMap(me.pluginsByKind)
-
-	for name, plugin := range newPlugins {
-		if err := me.ValidatePlugin(ns, plugin); err != nil {
-			panic(err)
-		}
-
-		kind := plugin.Kind()
-		id := PluginId(ns, name)
-
-		pluginsWithKind, found := pluginsByKind[kind]
-		if !found {
-			pluginsWithKind = map[string]Plugin{}
-			pluginsByKind[kind] = pluginsWithKind
-		}
-
-		if existingPlugin, found := pluginsWithKind[name]; found {
-			panic(fmt.Errorf("plugin %s has duplicated kind %s with %+v", id, kind, existingPlugin))
-		}
-		pluginsWithKind[name] = plugin
-	}
-
-	allPlugins := make([]Plugin, len(me.plugins), len(me.plugins)+len(newPlugins))
-	allPlugins = append(allPlugins, me.plugins...)
-
-	for _, plugin := range newPlugins {
-		allPlugins = append(allPlugins, plugin)
-	}
-
-	me.plugins = allPlugins
-	me.pluginsByKind = pluginsByKind
+	me.loaders.Put(ns, loader)
 }
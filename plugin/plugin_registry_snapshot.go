@@ -0,0 +1,62 @@
+package qplugin
+
+// PluginRegistrySnapshotT is an immutable view of the plugins indexed by the registry. The registry never
+// modifies a published snapshot but builds then publishes a new one, so a snapshot is safe to read without any
+// lock. The maps returned are shared, callers must not modify them.
+type PluginRegistrySnapshotT struct {
+	plugins       []Plugin
+	pluginsById   map[string]Plugin
+	pluginsByKind map[PluginKind]map[string]Plugin // kind -> plugin id -> plugin
+	pluginsByName map[PluginKind]map[string]Plugin // kind -> plugin name -> visible plugin
+}
+
+type PluginRegistrySnapshot = *PluginRegistrySnapshotT
+
+func newEmptyPluginRegistrySnapshot() PluginRegistrySnapshot {
+	return &PluginRegistrySnapshotT{
+		plugins:       []Plugin{},
+		pluginsById:   map[string]Plugin{},
+		pluginsByKind: map[PluginKind]map[string]Plugin{},
+		pluginsByName: map[PluginKind]map[string]Plugin{},
+	}
+}
+
+func (me PluginRegistrySnapshot) Plugins() []Plugin {
+	return me.plugins
+}
+
+// ById returns the plugin with the full plugin id, ie. namespace/name, or nil if not found
+func (me PluginRegistrySnapshot) ById(id string) Plugin {
+	return me.pluginsById[id]
+}
+
+// ByKind returns the plugins of the kind, keyed by plugin id
+func (me PluginRegistrySnapshot) ByKind(kind PluginKind) map[string]Plugin {
+	return me.pluginsByKind[kind]
+}
+
+// ByName returns the plugin of the kind and name from the namespace of the highest priority, or nil if not found
+func (me PluginRegistrySnapshot) ByName(kind PluginKind, name string) Plugin {
+	return me.pluginsByName[kind][name]
+}
+
+// Contributions returns the contributions of the type from the started plugins, in the order of the plugins
+func (me PluginRegistrySnapshot) Contributions(contributionType string) []PluginContribution {
+	r := []PluginContribution{}
+	for _, plugin := range me.plugins {
+		c, ok := plugin.(ContributingPlugin)
+		if !ok {
+			continue
+		}
+		if s, ok := plugin.(interface{ IsStarted() bool }); ok && !s.IsStarted() {
+			continue
+		}
+
+		for _, contribution := range c.Contributions() {
+			if contribution.Type() == contributionType {
+				r = append(r, contribution)
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,141 @@
+package qplugin
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/fastgh/go-comm/v2"
+	"github.com/spf13/afero"
+)
+
+// PluginDiagnosticT is a problem found in a plugin directory or file
+type PluginDiagnosticT struct {
+	Path string
+	Err  error
+}
+
+type PluginDiagnostic = *PluginDiagnosticT
+
+func NewPluginDiagnostic(path string, err error) PluginDiagnostic {
+	return &PluginDiagnosticT{
+		Path: path,
+		Err:  err,
+	}
+}
+
+func (me PluginDiagnostic) Error() string {
+	return fmt.Sprintf("%s: %v", me.Path, me.Err)
+}
+
+func (me PluginDiagnostic) Unwrap() error {
+	return me.Err
+}
+
+type PluginValidationReportT struct {
+	plugins     []ExternalPlugin
+	diagnostics []PluginDiagnostic
+}
+
+type PluginValidationReport = *PluginValidationReportT
+
+// Plugins returns the plugins passed the validation
+func (me PluginValidationReport) Plugins() []ExternalPlugin {
+	return me.plugins
+}
+
+func (me PluginValidationReport) Diagnostics() []PluginDiagnostic {
+	return me.diagnostics
+}
+
+func (me PluginValidationReport) HasError() bool {
+	return len(me.diagnostics) > 0
+}
+
+// MayError returns all diagnostics as an error group, or nil if there is no diagnostic
+func (me PluginValidationReport) MayError() error {
+	errs := comm.NewErrorGroup(false)
+	for _, d := range me.diagnostics {
+		errs.Add(d)
+	}
+	return errs.MayError()
+}
+
+func (me PluginValidationReport) addDiagnostic(path string, err error) {
+	me.diagnostics = append(me.diagnostics, NewPluginDiagnostic(path, err))
+}
+
+// ValidatePluginTree checks the plugins under baseDir as the registry would do for the namespace, but never
+// executes any plugin code: manifests are parsed, plugins are validated against the registry, and code is
+// compiled only. All problems are reported rather than stopping at the first one.
+func ValidatePluginTree(logger comm.Logger, registry PluginRegistry, fs afero.Fs, baseDir string, namespace string) PluginValidationReport {
+	r := &PluginValidationReportT{
+		plugins:     []ExternalPlugin{},
+		diagnostics: []PluginDiagnostic{},
+	}
+
+	pluginDirs, err := listExternalPluginDirs(fs, baseDir)
+	if err != nil {
+		r.addDiagnostic(baseDir, err)
+		return r
+	}
+
+	versions := map[string]string{}
+
+	for _, pluginDir := range pluginDirs {
+		p, errs := validateExternalPlugin(registry, fs, pluginDir, namespace)
+		if len(errs) > 0 {
+			for _, err := range errs {
+				r.addDiagnostic(pluginDir, err)
+			}
+			continue
+		}
+		if p == nil {
+			logger.Debug().Str("pluginDir", pluginDir).Msg("no manifest, skipped")
+			continue
+		}
+		logOutdatedPluginManifest(logger, pluginDir, p.manifest)
+
+		major, minor := p.Version()
+		ver := fmt.Sprintf("%s@%d.%d", p.Name(), major, minor)
+		if existingDir, found := versions[ver]; found {
+			r.addDiagnostic(pluginDir, fmt.Errorf("plugin %s version %d.%d is duplicated with %s",
+				PluginId(namespace, p.Name()), major, minor, existingDir))
+			continue
+		}
+		versions[ver] = pluginDir
+
+		r.plugins = append(r.plugins, p)
+	}
+
+	return r
+}
+
+func validateExternalPlugin(registry PluginRegistry, fs afero.Fs, pluginDir string, namespace string) (result ExternalPlugin, errs []error) {
+	defer func() {
+		if p := recover(); p != nil {
+			errs = []error{panicToError(p)}
+			result = nil
+		}
+	}()
+
+	result = newExternalPlugin(fs, pluginDir, registry.constraints(namespace))
+	if result == nil {
+		return nil, nil
+	}
+
+	if err := registry.ValidatePlugin(namespace, result); err != nil {
+		errs = append(errs, err)
+	}
+	if err := result.context.Compile(fs, result.codeFile); err != nil {
+		errs = append(errs, err)
+	}
+	if icon := result.manifest.Icon; len(icon) > 0 {
+		if exists, err := comm.FileExists(fs, filepath.Join(result.dir, icon)); err != nil {
+			errs = append(errs, err)
+		} else if !exists {
+			errs = append(errs, fmt.Errorf("icon not found: %s", icon))
+		}
+	}
+
+	return result, errs
+}
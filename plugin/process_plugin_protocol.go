@@ -0,0 +1,173 @@
+package qplugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The protocol between the host and a process plugin is JSON-RPC 2.0 over the stdin / stdout of the plugin, one
+// message per line. The host sends the requests and the plugin responds, in the order of:
+//
+//	handshake {"protocol_version": 1, "plugin_id": "...", "config": {...}} -> {"protocol_version": 1}
+//	start     {}                                                         -> {}
+//	invoke    {"function": "...", "args": [...]}                         -> {"results": [...]}
+//	health    {}                                                         -> {"status": "ok"}, as the heartbeat
+//	stop      {}                                                         -> {}
+//
+// A failure is responded as the error object of JSON-RPC. The stderr of the plugin goes to the plugin logger.
+const (
+	PROCESS_PLUGIN_PROTOCOL_VERSION = 1
+
+	PROCESS_PLUGIN_METHOD_HANDSHAKE = "handshake"
+	PROCESS_PLUGIN_METHOD_START     = "start"
+	PROCESS_PLUGIN_METHOD_STOP      = "stop"
+	PROCESS_PLUGIN_METHOD_INVOKE    = "invoke"
+	PROCESS_PLUGIN_METHOD_HEALTH    = "health"
+
+	PROCESS_PLUGIN_ERROR_PARSE            = -32700
+	PROCESS_PLUGIN_ERROR_METHOD_NOT_FOUND = -32601
+	PROCESS_PLUGIN_ERROR_INVALID_PARAMS   = -32602
+	PROCESS_PLUGIN_ERROR_INTERNAL         = -32603
+
+	processPluginJsonRpcVersion = "2.0"
+)
+
+type processPluginRequest struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Id      int64           `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type processPluginResponse struct {
+	JsonRpc string             `json:"jsonrpc"`
+	Id      int64              `json:"id"`
+	Result  json.RawMessage    `json:"result,omitempty"`
+	Error   ProcessPluginError `json:"error,omitempty"`
+}
+
+// ProcessPluginErrorT is the error object of JSON-RPC
+type ProcessPluginErrorT struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+type ProcessPluginError = *ProcessPluginErrorT
+
+func (me ProcessPluginError) Error() string {
+	return fmt.Sprintf("%s (code %d)", me.Message, me.Code)
+}
+
+type ProcessPluginHandshakeT struct {
+	ProtocolVersion int            `json:"protocol_version"`
+	PluginId        string         `json:"plugin_id,omitempty"`
+	Config          map[string]any `json:"config,omitempty"`
+}
+
+type ProcessPluginHandshake = *ProcessPluginHandshakeT
+
+type processPluginInvokeParams struct {
+	Function string `json:"function"`
+	Args     []any  `json:"args"`
+}
+
+type processPluginInvokeResult struct {
+	Results []any `json:"results"`
+}
+
+type processPluginHealthResult struct {
+	Status string `json:"status"`
+}
+
+// ProcessPluginHandler is what a process plugin written in Go implements, served by ServeProcessPlugin
+type ProcessPluginHandler interface {
+	Start(ctx context.Context, handshake ProcessPluginHandshake) error
+	Stop(ctx context.Context) error
+	Invoke(ctx context.Context, funcName string, args []any) ([]any, error)
+}
+
+// ServeProcessPlugin serves the requests from the host on in, and writes the responses to out, until in is
+// closed or the stop request is served. For a process plugin written in Go, its main() is usually:
+//
+//	qplugin.ServeProcessPlugin(context.Background(), os.Stdin, os.Stdout, handler)
+//
+// so it must not write anything else to os.Stdout.
+func ServeProcessPlugin(ctx context.Context, in io.Reader, out io.Writer, handler ProcessPluginHandler) error {
+	encoder := json.NewEncoder(out)
+	respond := func(resp *processPluginResponse) error {
+		resp.JsonRpc = processPluginJsonRpcVersion
+		return encoder.Encode(resp)
+	}
+
+	var handshake ProcessPluginHandshake
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var req processPluginRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			if err := respond(&processPluginResponse{
+				Error: &ProcessPluginErrorT{Code: PROCESS_PLUGIN_ERROR_PARSE, Message: err.Error()},
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var result any
+		var err error
+
+		switch req.Method {
+		case PROCESS_PLUGIN_METHOD_HANDSHAKE:
+			handshake = &ProcessPluginHandshakeT{}
+			if err = json.Unmarshal(req.Params, handshake); err == nil {
+				result = &ProcessPluginHandshakeT{ProtocolVersion: PROCESS_PLUGIN_PROTOCOL_VERSION}
+			}
+		case PROCESS_PLUGIN_METHOD_START:
+			if handshake == nil {
+				err = fmt.Errorf("handshake is required before start")
+			} else if err = handler.Start(ctx, handshake); err == nil {
+				result = struct{}{}
+			}
+		case PROCESS_PLUGIN_METHOD_INVOKE:
+			var params processPluginInvokeParams
+			if err = json.Unmarshal(req.Params, &params); err == nil {
+				var results []any
+				if results, err = handler.Invoke(ctx, params.Function, params.Args); err == nil {
+					result = &processPluginInvokeResult{Results: results}
+				}
+			}
+		case PROCESS_PLUGIN_METHOD_HEALTH:
+			result = &processPluginHealthResult{Status: "ok"}
+		case PROCESS_PLUGIN_METHOD_STOP:
+			if err = handler.Stop(ctx); err == nil {
+				result = struct{}{}
+			}
+		default:
+			err = &ProcessPluginErrorT{Code: PROCESS_PLUGIN_ERROR_METHOD_NOT_FOUND, Message: "method not found: " + req.Method}
+		}
+
+		resp := &processPluginResponse{Id: req.Id}
+		if err != nil {
+			if rpcErr, ok := err.(ProcessPluginError); ok {
+				resp.Error = rpcErr
+			} else {
+				resp.Error = &ProcessPluginErrorT{Code: PROCESS_PLUGIN_ERROR_INTERNAL, Message: err.Error()}
+			}
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Error = &ProcessPluginErrorT{Code: PROCESS_PLUGIN_ERROR_INTERNAL, Message: err.Error()}
+		}
+
+		if err := respond(resp); err != nil {
+			return err
+		}
+		if req.Method == PROCESS_PLUGIN_METHOD_STOP && resp.Error == nil {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
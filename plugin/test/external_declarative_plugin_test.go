@@ -0,0 +1,197 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ExternalDeclarativePlugin_contributions(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: theme
+name: a
+version_major: 1
+version_minor: 0
+language: declarative
+contributes:
+  - type: template
+    name: greeting
+    template: "hello, {{ .name | upper }}"
+  - type: template
+    name: footer
+    file: templates/footer.tmpl
+  - type: config
+    name: defaults
+    values:
+      color: blue
+      size: 3
+  - type: asset
+    name: logo
+    file: assets/logo.svg
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/templates/footer.tmpl", `{{ .year | default 2023 }} by {{ .owner }}`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/assets/logo.svg", "<svg/>")
+
+	comm.WriteFileTextP(fs, "/plugins/local/b/plugin.manifest.yml", `
+kind: theme
+name: b
+version_major: 1
+version_minor: 0
+language: declarative
+contributes:
+  - type: config
+    name: defaults
+    values:
+      color: red
+`)
+
+	registry := qplugin.NewPluginRegistry(1, "theme")
+	registry.Register(qplugin.NewLocalPluginLoader(logger, fs, "/plugins"))
+	a.NoError(registry.Init(logger))
+
+	templates := registry.Contributions(qplugin.PLUGIN_CONTRIBUTION_TEMPLATE)
+	a.Len(templates, 2)
+	a.Equal("greeting", templates[0].Name())
+	a.Equal("local/a", templates[0].PluginId())
+
+	r, err := templates[0].Render(map[string]any{"name": "world"})
+	a.NoError(err)
+	a.Equal("hello, WORLD", r)
+
+	r, err = templates[1].Render(map[string]any{"owner": "qiangyt"})
+	a.NoError(err)
+	a.Equal("2023 by qiangyt", r)
+
+	configs := registry.Contributions(qplugin.PLUGIN_CONTRIBUTION_CONFIG)
+	a.Len(configs, 2)
+	a.Equal("local/a", configs[0].PluginId())
+	a.Equal(map[string]any{"color": "blue", "size": 3}, configs[0].Values())
+	a.Equal("local/b", configs[1].PluginId())
+	a.Equal(map[string]any{"color": "red"}, configs[1].Values())
+
+	_, err = configs[0].Render(nil)
+	a.Error(err)
+
+	assets := registry.Contributions(qplugin.PLUGIN_CONTRIBUTION_ASSET)
+	a.Len(assets, 1)
+	a.Equal("/plugins/local/a/assets/logo.svg", assets[0].File())
+	content, err := assets[0].Read()
+	a.NoError(err)
+	a.Equal("<svg/>", string(content))
+
+	a.Empty(registry.Contributions("menu"))
+
+	// a declarative plugin has no function
+	p := registry.ById("local/a").(qplugin.ExternalPlugin)
+	_, err = p.Invoke(context.Background(), "Hello")
+	a.Error(err)
+
+	// only the contributions of started plugins are visible
+	registry.Destroy(logger)
+	a.Empty(registry.Contributions(qplugin.PLUGIN_CONTRIBUTION_CONFIG))
+}
+
+func Test_ExternalDeclarativePlugin_invalid(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	writeManifest := func(name string, contributes string) {
+		comm.WriteFileTextP(fs, "/plugins/"+name+"/plugin.manifest.yml", `
+kind: theme
+name: `+name+`
+version_major: 1
+version_minor: 0
+language: declarative
+contributes:
+`+contributes)
+	}
+
+	writeManifest("escaping", `
+  - type: asset
+    name: passwd
+    file: ../../etc/passwd
+`)
+	comm.WriteFileTextP(fs, "/etc/passwd", "root")
+
+	writeManifest("badtemplate", `
+  - type: template
+    name: broken
+    template: "{{ .name "
+`)
+
+	writeManifest("duplicated", `
+  - type: config
+    name: defaults
+  - type: config
+    name: defaults
+`)
+
+	writeManifest("nofile", `
+  - type: asset
+    name: logo
+`)
+
+	registry := qplugin.NewPluginRegistry(1, "theme")
+	report := qplugin.ValidatePluginTree(logger, registry, fs, "/plugins", "local")
+	a.Empty(report.Plugins())
+	a.Len(report.Diagnostics(), 4)
+
+	errs := report.MayError().Error()
+	a.Contains(errs, "file ../../etc/passwd is out of the plugin directory")
+	a.Contains(errs, "parse template contribution broken")
+	a.Contains(errs, "duplicated config contribution defaults")
+	a.Contains(errs, "file of asset contribution logo is required")
+}
+
+func Test_ExternalDeclarativePlugin_envRequiresPermission(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+	t.Setenv("QPLUGIN_TEST_SECRET", "s3cr3t")
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: theme
+name: a
+version_major: 1
+version_minor: 0
+language: declarative
+permissions: []
+contributes:
+  - type: template
+    name: secret
+    template: '{{ env "QPLUGIN_TEST_SECRET" }}'
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/b/plugin.manifest.yml", `
+kind: theme
+name: b
+version_major: 1
+version_minor: 0
+language: declarative
+permissions: [env]
+contributes:
+  - type: template
+    name: secret
+    template: '{{ env "QPLUGIN_TEST_SECRET" }} {{ expandenv "$QPLUGIN_TEST_SECRET" }}'
+`)
+
+	registry := qplugin.NewPluginRegistry(1, "theme")
+	report := qplugin.ValidatePluginTree(logger, registry, fs, "/plugins/local", "local")
+	a.Len(report.Diagnostics(), 1)
+	a.Equal("/plugins/local/a", report.Diagnostics()[0].Path)
+	a.Contains(report.Diagnostics()[0].Error(), `function "env" not defined`)
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/local/b")
+	a.NotNil(p)
+	r, err := p.Contributions()[0].Render(nil)
+	a.NoError(err)
+	a.Equal("s3cr3t s3cr3t", r)
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/yaegi/interp"
+)
+
+func Test_ExternalGoPlugin_hostPackage(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	recorded := map[string]any{}
+	qplugin.RegisterHostExports(interp.Exports{
+		"qplugintest/recorder/recorder": {
+			"Record": reflect.ValueOf(func(key string, value any) { recorded[key] = value }),
+		},
+	})
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: hosts
+name: PluginA
+version_major: 1
+version_minor: 0
+config:
+  greeting: hello
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", `
+	package plugin
+
+	import (
+		"qplugin/host"
+		"qplugintest/recorder"
+	)
+
+	func PluginStart() {
+		host.Logger().Info().Msg("starting")
+
+		recorder.Record("id", host.Id())
+		recorder.Record("greeting", host.Config()["greeting"])
+		recorder.Record("dataDir", host.DataDir())
+		recorder.Record("manifestName", host.Manifest().Name)
+		recorder.Record("lookup", host.Lookup("local/plugina") != nil)
+		recorder.Record("byKind", len(host.ByKind("hosts")))
+
+		var p host.Plugin = host.Current()
+		recorder.Record("kind", p.Kind())
+	}
+	`)
+
+	registry := qplugin.NewPluginRegistry(1, "hosts")
+	registry.SetDataDir("/data")
+	registry.Register(qplugin.NewLocalPluginLoader(logger, fs, "/plugins"))
+
+	a.NoError(registry.Init(logger))
+
+	a.Equal("local/plugina", recorded["id"])
+	a.Equal("hello", recorded["greeting"])
+	a.Equal("/data/local/plugina", recorded["dataDir"])
+	a.Equal("plugina", recorded["manifestName"])
+	a.Equal(true, recorded["lookup"])
+	a.Equal(1, recorded["byKind"])
+	a.Equal("hosts", recorded["kind"])
+}
+
+func Test_ExternalGoPlugin_hostPackageCompileOnly(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import "qplugin/host"
+
+	func PluginStart() {
+		host.Logger()
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	a.NoError(p.Compile(fs, "/plugin.go"))
+}
+
+func Test_RegisterHostExports_reserved(t *testing.T) {
+	a := require.New(t)
+
+	a.Panics(func() {
+		qplugin.RegisterHostExports(interp.Exports{
+			qplugin.HOST_PACKAGE + "/host": {},
+		})
+	})
+}
+
+func Test_HostExports_copy(t *testing.T) {
+	a := require.New(t)
+
+	qplugin.RegisterHostExports(interp.Exports{
+		"qplugintest/copied/copied": {
+			"A": reflect.ValueOf(1),
+		},
+	})
+
+	exports := qplugin.HostExports()
+	exports["qplugintest/copied/copied"]["B"] = reflect.ValueOf(2)
+	delete(exports["qplugintest/copied/copied"], "A")
+
+	symbols := qplugin.HostExports()["qplugintest/copied/copied"]
+	a.Contains(symbols, "A")
+	a.NotContains(symbols, "B")
+}
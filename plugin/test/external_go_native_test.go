@@ -0,0 +1,169 @@
+package test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CheckGoNativeCompatibility_happy(t *testing.T) {
+	a := require.New(t)
+
+	host := &debug.BuildInfo{
+		GoVersion: "go1.21.0",
+		Main:      debug.Module{Path: "example.com/host", Version: "(devel)"},
+		Deps: []*debug.Module{
+			{Path: "github.com/pkg/errors", Version: "v0.9.1"},
+		},
+		Settings: []debug.BuildSetting{{Key: "GOOS", Value: "linux"}, {Key: "GOARCH", Value: "amd64"}},
+	}
+	library := &debug.BuildInfo{
+		GoVersion: "go1.21.0",
+		Deps: []*debug.Module{
+			{Path: "github.com/pkg/errors", Version: "v0.9.1"},
+			{Path: "example.com/other", Version: "v1.0.0"},
+		},
+		Settings: []debug.BuildSetting{{Key: "GOOS", Value: "linux"}, {Key: "GOARCH", Value: "amd64"}},
+	}
+
+	a.NoError(qplugin.CheckGoNativeCompatibility("plugin.so", library, host))
+}
+
+func Test_CheckGoNativeCompatibility_mismatch(t *testing.T) {
+	a := require.New(t)
+
+	host := &debug.BuildInfo{
+		GoVersion: "go1.21.0",
+		Main:      debug.Module{Path: "example.com/host", Version: "(devel)"},
+		Deps: []*debug.Module{
+			{Path: "github.com/pkg/errors", Version: "v0.9.1"},
+			{Path: "github.com/spf13/afero", Version: "v1.9.0"},
+		},
+		Settings: []debug.BuildSetting{{Key: "GOOS", Value: "linux"}, {Key: "GOARCH", Value: "amd64"}},
+	}
+	library := &debug.BuildInfo{
+		GoVersion: "go1.20.5",
+		Deps: []*debug.Module{
+			{Path: "github.com/pkg/errors", Version: "v0.8.0"},
+			{Path: "github.com/spf13/afero", Version: "v1.9.0", Replace: &debug.Module{Path: "../afero"}},
+		},
+		Settings: []debug.BuildSetting{
+			{Key: "GOOS", Value: "linux"}, {Key: "GOARCH", Value: "amd64"}, {Key: "-race", Value: "true"},
+		},
+	}
+
+	err := qplugin.CheckGoNativeCompatibility("plugin.so", library, host)
+	a.ErrorContains(err, "plugin.so is built with go1.20.5, but the host is built with go1.21.0")
+	a.ErrorContains(err, "plugin.so is built with module github.com/pkg/errors v0.8.0, but the host has v0.9.1")
+	a.ErrorContains(err, "plugin.so is built with module github.com/spf13/afero ../afero@, but the host has v1.9.0")
+	a.ErrorContains(err, "plugin.so is built with -race=true, but the host is built with -race=")
+}
+
+func Test_ExternalGoNativePlugin_notLibrary(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: go-native
+go_native:
+  library: a.so
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/a.so", "not a library")
+
+	p := qplugin.NewExternalGoNativePluginContext()
+	a.ErrorContains(p.Compile(fs, "/plugins/a/a.so"), "read build info of /plugins/a/a.so")
+
+	a.Nil(qplugin.ResolveExternalPlugin(comm.NewDiscardLogger(), fs, "/plugins/a"))
+}
+
+func Test_ExternalGoNativePlugin_happy(t *testing.T) {
+	a := require.New(t)
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("go plugin is not supported on " + runtime.GOOS)
+	}
+
+	dir := t.TempDir()
+	buildGoNativeTestPlugin(t, filepath.Join(dir, "plugins", "a", "plugin.so"), "./testdata/native")
+
+	fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: go-native
+`)
+
+	p := qplugin.ResolveExternalPlugin(comm.NewDiscardLogger(), fs, "/plugins/a")
+	a.NotNil(p)
+	a.Equal(qplugin.PLUGIN_LANG_GO_NATIVE, p.Language())
+	a.Len(p.Permissions(), 8)
+
+	r, err := qplugin.Call[string](context.Background(), p, "Upper", "hello")
+	a.NoError(err)
+	a.Equal("HELLO", r)
+}
+
+func Test_ExternalGoNativePlugin_tempCopyRemoved(t *testing.T) {
+	a := require.New(t)
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("go plugin is not supported on " + runtime.GOOS)
+	}
+
+	// built from the file rather than the package, for a distinct plugin path, since a plugin can't be loaded twice
+	library := filepath.Join(t.TempDir(), "plugin.so")
+	buildGoNativeTestPlugin(t, library, "./testdata/native/main.go")
+
+	// a library not on the OS filesystem is copied to a temporary file
+	fs := afero.NewMemMapFs()
+	a.NoError(afero.WriteFile(fs, "/plugins/a/plugin.so", comm.ReadFileBytesP(afero.NewOsFs(), library), 0o644))
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: go-native
+`)
+
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	p := qplugin.ResolveExternalPlugin(comm.NewDiscardLogger(), fs, "/plugins/a")
+	a.NotNil(p)
+
+	r, err := qplugin.Call[string](context.Background(), p, "Upper", "hello")
+	a.NoError(err)
+	a.Equal("HELLO", r)
+
+	entries, err := os.ReadDir(tmp)
+	a.NoError(err)
+	a.Empty(entries)
+}
+
+// buildGoNativeTestPlugin builds the test plugin with -race if the test is, or the host would reject it
+func buildGoNativeTestPlugin(t *testing.T, library string, src string) {
+	args := []string{"build", "-buildmode=plugin", "-o", library}
+	if raceEnabled {
+		args = append(args, "-race")
+	}
+
+	build := exec.Command("go", append(args, src)...)
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Skipf("failed to build the go plugin: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,197 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/yaegi/interp"
+)
+
+func Test_ExternalGoPlugin_package(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	recorded := map[string]any{}
+	qplugin.RegisterHostExports(interp.Exports{
+		"qplugintest/pkgrecorder/pkgrecorder": {
+			"Record": reflect.ValueOf(func(key string, value any) { recorded[key] = value }),
+		},
+	})
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: pkgs
+name: PluginA
+version_major: 1
+version_minor: 0
+go:
+  package: example.com/plugina
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", `
+	package plugina
+
+	import (
+		"example.com/plugina/greeting"
+		"qplugintest/pkgrecorder"
+	)
+
+	func PluginStart() {
+		pkgrecorder.Record("start", greeting.Hello("a"))
+	}
+	`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/stop.go", `
+	package plugina
+
+	import "qplugintest/pkgrecorder"
+
+	func PluginStop() {
+		pkgrecorder.Record("stop", true)
+	}
+	`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/greeting/greeting.go", `
+	package greeting
+
+	import "example.org/upper"
+
+	func Hello(name string) string {
+		return "hello " + upper.Upper(name)
+	}
+	`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/vendor/example.org/upper/upper.go", `
+	package upper
+
+	import "strings"
+
+	func Upper(s string) string {
+		return strings.ToUpper(s)
+	}
+	`)
+
+	registry := qplugin.NewPluginRegistry(1, "pkgs")
+	registry.Register(qplugin.NewLocalPluginLoader(logger, fs, "/plugins"))
+
+	a.NoError(registry.Init(logger))
+	a.Equal("hello A", recorded["start"])
+
+	registry.Destroy(logger)
+	a.Equal(true, recorded["stop"])
+}
+
+func Test_ExternalGoPlugin_packageCompile(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/a/plugin.go", `
+	package plugina
+
+	func PluginStart() {}
+	`)
+	comm.WriteFileTextP(fs, "/a/sub/sub.go", `
+	package sub
+
+	func Broken( {}
+	`)
+
+	p := qplugin.NewExternalGoPackagePluginContext("example.com/plugina")
+	a.Error(p.Compile(fs, "/a"))
+
+	fs.Remove("/a/sub/sub.go")
+	a.NoError(p.Compile(fs, "/a"))
+
+	a.Error(p.Compile(fs, "/empty"))
+}
+
+func Test_ExternalGoPlugin_packageTypeCheck(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/a/plugin.go", `
+	package plugina
+
+	import (
+		"context"
+		"errors"
+		"fmt"
+		"io"
+		"net/http"
+		"os"
+		"sort"
+		"strings"
+		"sync"
+		"time"
+
+		"example.com/plugina/sub"
+		"qplugin/host"
+	)
+
+	type counter struct {
+		sync.Mutex
+		n int
+	}
+
+	type reader struct{}
+
+	func (reader) Read(p []byte) (int, error) { return 0, io.EOF }
+
+	var _ io.Reader = reader{}
+
+	func PluginStart(ctx context.Context, h host.Plugin) error {
+		c := &counter{}
+		c.Lock()
+		c.n++
+		c.Unlock()
+
+		names := []string{"b", "a"}
+		sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+		var timeout time.Duration = 2 * time.Second
+		if http.StatusOK != 200 || timeout < time.Second {
+			return errors.New("unexpected")
+		}
+		fmt.Fprintln(os.Stdout, strings.Join(names, ","), sub.Twice(c.n), h.Id())
+		return nil
+	}
+	`)
+	comm.WriteFileTextP(fs, "/a/sub/sub.go", `
+	package sub
+
+	func Twice(n int) int {
+		return n * 2
+	}
+	`)
+
+	p := qplugin.NewExternalGoPackagePluginContext("example.com/plugina")
+	a.NoError(p.Compile(fs, "/a"))
+
+	// type errors are found without running the package
+	comm.WriteFileTextP(fs, "/a/sub/sub.go", `
+	package sub
+
+	func Twice(n int) string {
+		return n * 2
+	}
+	`)
+	err := p.Compile(fs, "/a")
+	a.ErrorContains(err, "type-check example.com/plugina")
+	a.ErrorContains(err, "cannot use n * 2")
+
+	comm.WriteFileTextP(fs, "/a/sub/sub.go", `
+	package sub
+
+	import "os"
+
+	func init() {
+		os.Exit(3)
+	}
+
+	func Twice(n int) int {
+		return n.Double()
+	}
+	`)
+	err = p.Compile(fs, "/a")
+	a.ErrorContains(err, "n.Double undefined")
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHttpPluginServer(t *testing.T, a *require.Assertions) (*httptest.Server, *[]string, *int32) {
+	calls := &[]string{}
+	failures := new(int32)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls = append(*calls, r.Method+" "+r.URL.Path)
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var body map[string]any
+		if r.Method == http.MethodPost {
+			a.NoError(json.NewDecoder(r.Body).Decode(&body))
+		}
+
+		switch r.URL.Path {
+		case "/start":
+			a.Equal("/plugina", body["plugin_id"])
+		case "/stop", "/health":
+		case "/invoke/add":
+			args := body["args"].([]any)
+			json.NewEncoder(w).Encode(map[string]any{"results": []any{args[0].(float64) + args[1].(float64)}})
+		case "/invoke/flaky":
+			if atomic.AddInt32(failures, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"results": []any{"ok"}})
+		case "/invoke/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/invoke/slow":
+			time.Sleep(500 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"error": "function not found: " + strings.TrimPrefix(r.URL.Path, "/invoke/")})
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, calls, failures
+}
+
+func newTestHttpPlugin(a *require.Assertions, baseUrl string, extra string) qplugin.ExternalPlugin {
+	fs := afero.NewMemMapFs()
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: http
+config:
+  api_token: Bearer secret
+http:
+  base_url: `+baseUrl+`
+  headers_from_config:
+    Authorization: api_token
+`+extra)
+
+	p := qplugin.ResolveExternalPlugin(comm.NewDiscardLogger(), fs, "/plugins/a")
+	a.NotNil(p)
+	return p
+}
+
+func Test_ExternalHttpPlugin_happy(t *testing.T) {
+	a := require.New(t)
+	server, calls, _ := newTestHttpPluginServer(t, a)
+
+	p := newTestHttpPlugin(a, server.URL+"/", "")
+	a.Equal(qplugin.PLUGIN_LANG_HTTP, p.Language())
+	a.Equal(server.URL+"/", p.CodeFile())
+
+	p.Start(comm.NewDiscardLogger())
+
+	sum, err := qplugin.Call[int](context.Background(), p, "add", 40, 2)
+	a.NoError(err)
+	a.Equal(42, sum)
+
+	_, err = p.Invoke(context.Background(), "missing")
+	a.ErrorContains(err, "404 Not Found: function not found: missing")
+
+	p.Stop(comm.NewDiscardLogger())
+	a.Equal([]string{"POST /start", "POST /invoke/add", "POST /invoke/missing", "POST /stop"}, *calls)
+}
+
+func Test_ExternalHttpPlugin_retries(t *testing.T) {
+	a := require.New(t)
+	server, calls, _ := newTestHttpPluginServer(t, a)
+
+	p := newTestHttpPlugin(a, server.URL, `
+  retries: 2
+  retry_delay: 10
+`)
+
+	r, err := qplugin.Call[string](context.Background(), p, "flaky")
+	a.NoError(err)
+	a.Equal("ok", r)
+	a.Len(*calls, 3)
+
+	// not retried
+	_, err = p.Invoke(context.Background(), "missing")
+	a.Error(err)
+	a.Len(*calls, 4)
+
+	// the function may have run
+	_, err = p.Invoke(context.Background(), "broken")
+	a.ErrorContains(err, "500 Internal Server Error")
+	a.Len(*calls, 5)
+
+	// the connection is refused, so retried
+	server.Close()
+	logger, logs := newFileLogger(t)
+	hc := qplugin.NewExternalHttpPluginContext()
+	hc.SetRetries(1, 10*time.Millisecond)
+	hc.Init(logger, nil, afero.NewMemMapFs(), server.URL)
+	a.ErrorContains(hc.Health(context.Background()), "connection refused")
+	a.Equal(1, strings.Count(logs.String(), "plugin request failed, retry"))
+}
+
+func Test_ExternalHttpPlugin_failures(t *testing.T) {
+	a := require.New(t)
+	server, _, _ := newTestHttpPluginServer(t, a)
+
+	p := newTestHttpPlugin(a, server.URL, "")
+
+	hc := qplugin.NewExternalHttpPluginContext()
+	hc.SetTimeout(100 * time.Millisecond)
+	hc.SetHeadersFromConfig(map[string]string{"Authorization": "api_token"})
+	hc.Init(comm.NewDiscardLogger(), p.Host(), afero.NewMemMapFs(), server.URL)
+	a.NoError(hc.Health(context.Background()))
+
+	_, err := hc.Invoke(context.Background(), "slow")
+	a.ErrorContains(err, "context deadline exceeded")
+
+	// the header config is missing
+	hc = qplugin.NewExternalHttpPluginContext()
+	hc.SetHeadersFromConfig(map[string]string{"Authorization": "missing_token"})
+	hc.Init(comm.NewDiscardLogger(), p.Host(), afero.NewMemMapFs(), server.URL)
+	a.ErrorContains(hc.Health(context.Background()), "config missing_token of header Authorization not found")
+
+	// unauthorized without the header
+	hc = qplugin.NewExternalHttpPluginContext()
+	hc.Init(comm.NewDiscardLogger(), p.Host(), afero.NewMemMapFs(), server.URL)
+	a.ErrorContains(hc.Health(context.Background()), "401 Unauthorized")
+
+	a.ErrorContains(hc.Compile(afero.NewMemMapFs(), "ftp://example.com"), "expect http or https")
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ExternalJsPlugin_happy(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger, logs := newFileLogger(t)
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: javascript
+config:
+  greeting: hello
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.js", `
+let started = false;
+
+exports.pluginStart = function(host) {
+	started = true;
+	host.logger().info().msg("started " + host.id());
+	console.log("greeting is", host.config().greeting);
+};
+
+exports.pluginStop = function() {
+	console.warn("stopped");
+};
+
+exports.greet = function(name, times) {
+	return host.config().greeting + ", " + name.repeat(times);
+};
+
+exports.sum = function(values) {
+	return values.reduce((a, b) => a + b, 0);
+};
+
+function describe(obj) {
+	return { name: obj.name, tags: obj.tags.length, started: started };
+}
+`)
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a")
+	a.NotNil(p)
+	a.Equal(qplugin.PLUGIN_LANG_JAVASCRIPT, p.Language())
+	a.Equal("/plugins/a/plugin.js", p.CodeFile())
+
+	p.Start(logger)
+	a.Contains(logs.String(), "started /plugina")
+	a.Contains(logs.String(), "greeting is hello")
+
+	greeting, err := qplugin.Call[string](context.Background(), p, "greet", "ab", 2)
+	a.NoError(err)
+	a.Equal("hello, abab", greeting)
+
+	sum, err := qplugin.Call[int](context.Background(), p, "sum", []int{1, 2, 3})
+	a.NoError(err)
+	a.Equal(6, sum)
+
+	desc, err := qplugin.Call[map[string]any](context.Background(), p, "describe",
+		map[string]any{"name": "x", "tags": []string{"a", "b"}})
+	a.NoError(err)
+	a.Equal(map[string]any{"name": "x", "tags": int64(2), "started": true}, desc)
+
+	_, err = p.Invoke(context.Background(), "missing")
+	a.ErrorContains(err, "function not found: missing")
+
+	p.Stop(logger)
+	a.Contains(logs.String(), "stopped")
+}
+
+func Test_ExternalJsPlugin_exception(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.js", `
+function check(value) {
+	if (!value) {
+		throw new Error("value is required");
+	}
+}
+
+module.exports = {
+	pluginStart: function() {
+		check(null);
+	},
+	loop: function() {
+		for (;;) {}
+	},
+};
+`)
+
+	p := qplugin.NewExternalJsPluginContext()
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.js")
+
+	err := p.Start(context.Background())
+	a.ErrorContains(err, "pluginStart failed: Error: value is required")
+	a.ErrorContains(err, "at check (/plugin.js:4:9(")
+	a.ErrorContains(err, "at pluginStart (/plugin.js:10:8(")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = p.Invoke(ctx, "loop")
+	a.ErrorContains(err, "loop failed: context deadline exceeded")
+}
+
+func Test_ExternalJsPlugin_syntaxError(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.js", `function broken( {`)
+
+	p := qplugin.NewExternalJsPluginContext()
+	a.ErrorContains(p.Compile(fs, "/plugin.js"), "compile /plugin.js")
+}
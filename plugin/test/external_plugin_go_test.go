@@ -1,7 +1,7 @@
 package test
 
 import (
-	"reflect"
+	"context"
 	"testing"
 
 	"github.com/fastgh/go-comm/v2"
@@ -18,7 +18,7 @@ func Test_ExternalGoPlugin_compileError(t *testing.T) {
 
 	p := qplugin.NewExternalGoPluginContext()
 	a.Panics(func() {
-		p.Init(comm.NewDiscardLogger(), fs, "/plugin.go")
+		p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
 	})
 }
 
@@ -29,23 +29,22 @@ func Test_ExternalGoPlugin_full(t *testing.T) {
 	comm.WriteFileTextP(fs, "/plugin.go", `
 	package plugin
 
-	func PluginStart() string {
-		return "start"
+	func PluginStart() error {
+		return nil
 	}
 
-	func PluginStop() string {
-		return "stop"
+	func PluginStop() {
 	}
 	`)
 
 	p := qplugin.NewExternalGoPluginContext()
-	p.Init(comm.NewDiscardLogger(), fs, "/plugin.go")
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
 
 	a.NotNil(p.GetStartFunc())
-	a.Equal("start", p.Start().([]reflect.Value)[0].String())
+	a.NoError(p.Start(context.Background()))
 
 	a.NotNil(p.GetStopFunc())
-	a.Equal("stop", p.Stop().([]reflect.Value)[0].String())
+	a.NoError(p.Stop(context.Background()))
 }
 
 func Test_ExternalGoPlugin_noStart(t *testing.T) {
@@ -55,19 +54,21 @@ func Test_ExternalGoPlugin_noStart(t *testing.T) {
 	comm.WriteFileTextP(fs, "/plugin.go", `
 	package plugin
 
-	func PluginStop() string {
-		return "stop"
+	import "context"
+
+	func PluginStop(ctx context.Context) error {
+		return nil
 	}
 	`)
 
 	p := qplugin.NewExternalGoPluginContext()
-	p.Init(comm.NewDiscardLogger(), fs, "/plugin.go")
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
 
 	a.Nil(p.GetStartFunc())
-	a.Empty(p.Start())
+	a.NoError(p.Start(context.Background()))
 
 	a.NotNil(p.GetStopFunc())
-	a.Equal("stop", p.Stop().([]reflect.Value)[0].String())
+	a.NoError(p.Stop(context.Background()))
 }
 
 func Test_ExternalGoPlugin_noStop(t *testing.T) {
@@ -77,19 +78,24 @@ func Test_ExternalGoPlugin_noStop(t *testing.T) {
 	comm.WriteFileTextP(fs, "/plugin.go", `
 	package plugin
 
-	func PluginStart() string {
-		return "start"
+	import (
+		"context"
+		"qplugin/host"
+	)
+
+	func PluginStart(ctx context.Context, p host.Plugin) error {
+		return nil
 	}
 	`)
 
 	p := qplugin.NewExternalGoPluginContext()
-	p.Init(comm.NewDiscardLogger(), fs, "/plugin.go")
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
 
 	a.NotNil(p.GetStartFunc())
-	a.Equal("start", p.Start().([]reflect.Value)[0].String())
+	a.NoError(p.Start(context.Background()))
 
 	a.Nil(p.GetStopFunc())
-	a.Empty(p.Stop())
+	a.NoError(p.Stop(context.Background()))
 }
 
 func Test_ExternalGoPlugin_startIsNotFunction(t *testing.T) {
@@ -103,10 +109,10 @@ func Test_ExternalGoPlugin_startIsNotFunction(t *testing.T) {
 	`)
 
 	p := qplugin.NewExternalGoPluginContext()
-	p.Init(comm.NewDiscardLogger(), fs, "/plugin.go")
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
 
 	a.Nil(p.GetStartFunc())
-	a.Empty(p.Start())
+	a.NoError(p.Start(context.Background()))
 }
 
 func Test_ExternalGoPlugin_stopIsNotFunction(t *testing.T) {
@@ -120,8 +126,93 @@ func Test_ExternalGoPlugin_stopIsNotFunction(t *testing.T) {
 	`)
 
 	p := qplugin.NewExternalGoPluginContext()
-	p.Init(comm.NewDiscardLogger(), fs, "/plugin.go")
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
 
 	a.Nil(p.GetStopFunc())
-	a.Empty(p.Stop())
+	a.NoError(p.Stop(context.Background()))
+}
+
+func Test_ExternalGoPlugin_unsupportedSignature(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	func PluginStart() string {
+		return "start"
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	a.PanicsWithError("plugin.PluginStart has unsupported signature func() string, expect one of: "+
+		"func(), func() error, func(context.Context) error, func(context.Context, host.Plugin) error", func() {
+		p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+	})
+}
+
+func Test_ExternalGoPlugin_startError(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import "errors"
+
+	func PluginStart() error {
+		return errors.New("not ready")
+	}
+
+	func PluginStop() error {
+		panic("boom")
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+
+	err := p.Start(context.Background())
+	a.Error(err)
+	a.Contains(err.Error(), "plugin.PluginStart failed: not ready")
+
+	err = p.Stop(context.Background())
+	a.Error(err)
+	a.Contains(err.Error(), "plugin.PluginStop panicked")
+	a.Contains(err.Error(), "boom")
+}
+
+func Test_ExternalGoPlugin_startErrorFailsPluginStart(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: hosts
+name: PluginA
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", `
+	package plugin
+
+	import (
+		"context"
+		"errors"
+	)
+
+	func PluginStart(ctx context.Context) error {
+		return errors.New("not ready")
+	}
+	`)
+
+	loader := qplugin.NewLocalPluginLoader(logger, fs, "/plugins")
+
+	registry := qplugin.NewPluginRegistry(1, "hosts")
+	registry.Register(loader)
+
+	err := registry.Init(logger)
+	a.Error(err)
+	a.Contains(err.Error(), "not ready")
+	a.Empty(registry.ByKind("hosts"))
 }
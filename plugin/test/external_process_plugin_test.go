@@ -0,0 +1,228 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const testProcessPluginEnv = "QPLUGIN_TEST_PROCESS_PLUGIN"
+
+// the test binary runs as the process plugin if the env is set
+func TestMain(m *testing.M) {
+	if os.Getenv(testProcessPluginEnv) == "1" {
+		if err := qplugin.ServeProcessPlugin(context.Background(), os.Stdin, os.Stdout, &testProcessPlugin{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type testProcessPlugin struct {
+	greeting string
+}
+
+func (me *testProcessPlugin) Start(ctx context.Context, handshake qplugin.ProcessPluginHandshake) error {
+	if os.Getenv(testProcessPluginEnv+"_FAIL") == "1" {
+		return fmt.Errorf("fails to start")
+	}
+	me.greeting = fmt.Sprint(handshake.Config["greeting"])
+	fmt.Fprintln(os.Stderr, "started "+handshake.PluginId)
+	return nil
+}
+
+func (me *testProcessPlugin) Stop(ctx context.Context) error {
+	fmt.Fprintln(os.Stderr, "stopping")
+	return nil
+}
+
+func (me *testProcessPlugin) Invoke(ctx context.Context, funcName string, args []any) ([]any, error) {
+	switch funcName {
+	case "greet":
+		return []any{me.greeting + ", " + strings.Repeat(args[0].(string), int(args[1].(float64)))}, nil
+	case "sleep":
+		time.Sleep(time.Minute)
+		return nil, nil
+	case "spawn":
+		// the child keeps the stderr of the plugin open
+		child := exec.Command("sleep", "60")
+		child.Stderr = os.Stderr
+		if err := child.Start(); err != nil {
+			return nil, err
+		}
+		return []any{child.Process.Pid}, nil
+	case "crash":
+		os.Exit(3)
+	}
+	return nil, fmt.Errorf("function not found: %s", funcName)
+}
+
+// writeTestProcessPlugin writes the plugin running the test binary into pluginDir, and returns the fs
+func writeTestProcessPlugin(t *testing.T, a *require.Assertions, pluginDir string, timeout int) afero.Fs {
+	t.Setenv(testProcessPluginEnv, "1")
+
+	executable, err := os.Executable()
+	a.NoError(err)
+
+	dir := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	a.NoError(fs.MkdirAll(pluginDir, 0o755))
+
+	command, err := filepath.Rel(pluginDir, filepath.Join("/", filepath.Base(executable)))
+	a.NoError(err)
+	comm.WriteFileTextP(fs, pluginDir+"/plugin.manifest.yml", fmt.Sprintf(`
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: process
+config:
+  greeting: hello
+process:
+  command: %s
+  timeout: %d
+`, command, timeout))
+
+	a.NoError(os.Symlink(executable, filepath.Join(dir, filepath.Base(executable))))
+	return fs
+}
+
+func newTestProcessPlugin(t *testing.T, a *require.Assertions, logger comm.Logger, timeout int) qplugin.ExternalPlugin {
+	fs := writeTestProcessPlugin(t, a, "/plugins/a", timeout)
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a")
+	a.NotNil(p)
+	return p
+}
+
+func Test_ExternalProcessPlugin_happy(t *testing.T) {
+	a := require.New(t)
+	logger, logs := newFileLogger(t)
+
+	fs := writeTestProcessPlugin(t, a, "/plugins/local/a", 0)
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	registry.Register(qplugin.NewLocalPluginLoader(logger, fs, "/plugins"))
+	a.NoError(registry.Init(logger))
+
+	p := registry.ById("local/plugina").(qplugin.ExternalPlugin)
+	a.Equal(qplugin.PLUGIN_LANG_PROCESS, p.Language())
+	a.Len(p.Permissions(), 8)
+
+	// the handshake is done once the plugin is bound to its namespace
+	a.Eventually(func() bool { return strings.Contains(logs.String(), "started local/plugina") }, time.Second, 10*time.Millisecond)
+	a.Contains(logs.String(), `"stream":"stderr"`)
+
+	r, err := qplugin.Call[string](context.Background(), p, "greet", "ab", 2)
+	a.NoError(err)
+	a.Equal("hello, abab", r)
+
+	_, err = p.Invoke(context.Background(), "missing")
+	a.ErrorContains(err, "function not found: missing")
+
+	registry.Destroy(logger)
+	a.Contains(logs.String(), "stopping")
+	a.Contains(logs.String(), "plugin process exited")
+}
+
+func Test_ExternalProcessPlugin_spawnedOnStart(t *testing.T) {
+	a := require.New(t)
+	logger, _ := newFileLogger(t)
+
+	p := newTestProcessPlugin(t, a, logger, 0)
+
+	_, err := p.Invoke(context.Background(), "greet", "a", 1)
+	a.ErrorContains(err, "plugin is not initialized")
+
+	p.Start(logger)
+	r, err := qplugin.Call[string](context.Background(), p, "greet", "a", 1)
+	a.NoError(err)
+	a.Equal("hello, a", r)
+
+	p.Stop(logger)
+	_, err = p.Invoke(context.Background(), "greet", "a", 1)
+	a.ErrorContains(err, "plugin process exited")
+
+	// spawned again
+	p.Start(logger)
+	r, err = qplugin.Call[string](context.Background(), p, "greet", "a", 2)
+	a.NoError(err)
+	a.Equal("hello, aa", r)
+	p.Stop(logger)
+}
+
+func Test_ExternalProcessPlugin_killedIfStartFails(t *testing.T) {
+	a := require.New(t)
+	fs := writeTestProcessPlugin(t, a, "/plugins/a", 0)
+
+	executable, err := os.Executable()
+	a.NoError(err)
+
+	c := qplugin.NewExternalProcessPluginContext()
+	c.SetEnv(map[string]string{testProcessPluginEnv + "_FAIL": "1"})
+	c.Init(comm.NewDiscardLogger(), nil, fs, "/"+filepath.Base(executable))
+	a.Zero(c.Pid())
+
+	a.ErrorContains(c.Start(context.Background()), "fails to start")
+	a.NotZero(c.Pid())
+	a.True(c.Exited())
+}
+
+func Test_ExternalProcessPlugin_timeout(t *testing.T) {
+	a := require.New(t)
+	logger, logs := newFileLogger(t)
+
+	p := newTestProcessPlugin(t, a, logger, 1)
+	p.Start(logger)
+
+	_, err := p.Invoke(context.Background(), "sleep")
+	a.ErrorContains(err, "no response, the plugin process is killed")
+
+	a.Eventually(func() bool { return strings.Contains(logs.String(), "plugin process exited") }, time.Second, 10*time.Millisecond)
+
+	_, err = p.Invoke(context.Background(), "greet", "a", 1)
+	a.ErrorContains(err, "plugin process exited")
+}
+
+func Test_ExternalProcessPlugin_childrenKilled(t *testing.T) {
+	a := require.New(t)
+	if runtime.GOOS == "windows" {
+		t.Skip("process group is not killed on windows")
+	}
+	logger, logs := newFileLogger(t)
+
+	p := newTestProcessPlugin(t, a, logger, 1)
+	p.Start(logger)
+
+	_, err := p.Invoke(context.Background(), "spawn")
+	a.NoError(err)
+
+	// the process is reaped only after its child is killed as well, which closes the stderr
+	_, err = p.Invoke(context.Background(), "sleep")
+	a.ErrorContains(err, "no response, the plugin process is killed")
+	a.Eventually(func() bool { return strings.Contains(logs.String(), "plugin process exited") }, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_ExternalProcessPlugin_crash(t *testing.T) {
+	a := require.New(t)
+	logger, _ := newFileLogger(t)
+
+	p := newTestProcessPlugin(t, a, logger, 0)
+	p.Start(logger)
+
+	_, err := p.Invoke(context.Background(), "crash")
+	a.ErrorContains(err, "plugin process exited: exit status 3")
+}
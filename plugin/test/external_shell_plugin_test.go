@@ -0,0 +1,214 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ExternalShellPlugin_happy(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger, logs := newFileLogger(t)
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: shell
+shell:
+  env:
+    GREETING: hello
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.sh", `
+started=no
+
+plugin_start() {
+	started=yes
+	echo "$GREETING from plugin_start"
+	echo "warning from plugin_start" >&2
+}
+
+plugin_stop() {
+	echo "stopped, started=$started"
+}
+
+greet() {
+	echo "$GREETING, $1 $2"
+}
+
+fail() {
+	echo "failing" >&2
+	return 3
+}
+`)
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a")
+	a.NotNil(p)
+	a.Equal(qplugin.PLUGIN_LANG_SHELL, p.Language())
+	a.Equal("/plugins/a/plugin.sh", p.CodeFile())
+
+	p.Start(logger)
+	a.True(p.IsStarted())
+	a.Contains(logs.String(), "hello from plugin_start")
+	a.Contains(logs.String(), "warning from plugin_start")
+
+	r, err := qplugin.Call[string](context.Background(), p, "greet", "it's", 42)
+	a.NoError(err)
+	a.Equal("hello, it's 42", r)
+
+	_, err = p.Invoke(context.Background(), "fail")
+	a.ErrorContains(err, "fail failed: exit status 3")
+	a.Contains(logs.String(), "failing")
+
+	_, err = p.Invoke(context.Background(), "missing")
+	a.ErrorContains(err, "function not found: missing")
+
+	// each call runs in a subshell
+	p.Stop(logger)
+	a.Contains(logs.String(), "stopped, started=no")
+}
+
+func Test_ExternalShellPlugin_permissions(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	t.Setenv("QPLUGIN_TEST", "hello")
+
+	comm.WriteFileTextP(fs, "/plugin.sh", `
+home() {
+	echo "[$QPLUGIN_TEST]"
+}
+
+run() {
+	ls /
+}
+
+load() {
+	cat < /etc/hostname
+}
+
+glob() {
+	echo /etc/host*
+}
+
+exists() {
+	if test -e /etc/hostname; then
+		echo yes
+	else
+		echo no
+	fi
+}
+`)
+
+	p := qplugin.NewExternalShellPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{})
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.sh")
+
+	r, err := qplugin.Call[string](context.Background(), p, "home")
+	a.NoError(err)
+	a.Equal("[]", r)
+
+	_, err = p.Invoke(context.Background(), "run")
+	a.ErrorContains(err, "ls: command requires permission exec")
+
+	_, err = p.Invoke(context.Background(), "load")
+	a.ErrorContains(err, "/etc/hostname: read requires permission fs.read")
+
+	// globbing and stat don't see the files
+	r, err = qplugin.Call[string](context.Background(), p, "glob")
+	a.NoError(err)
+	a.Equal("/etc/host*", r)
+
+	r, err = qplugin.Call[string](context.Background(), p, "exists")
+	a.NoError(err)
+	a.Equal("no", r)
+
+	p = qplugin.NewExternalShellPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{qplugin.PLUGIN_PERMISSION_ENV, qplugin.PLUGIN_PERMISSION_FS_READ})
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.sh")
+
+	r, err = qplugin.Call[string](context.Background(), p, "home")
+	a.NoError(err)
+	a.Equal("[hello]", r)
+
+	r, err = qplugin.Call[string](context.Background(), p, "glob")
+	a.NoError(err)
+	a.Contains(r, "/etc/hostname")
+
+	r, err = qplugin.Call[string](context.Background(), p, "exists")
+	a.NoError(err)
+	a.Equal("yes", r)
+}
+
+func Test_ExternalShellPlugin_dir(t *testing.T) {
+	a := require.New(t)
+
+	dir := t.TempDir()
+	a.NoError(os.MkdirAll(filepath.Join(dir, "a", "work"), 0o755))
+	fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+
+	comm.WriteFileTextP(fs, "/a/plugin.sh", `
+where() {
+	echo "$PWD"
+}
+`)
+
+	p := qplugin.NewExternalShellPluginContext()
+	p.SetDir("work")
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/a/plugin.sh")
+
+	r, err := qplugin.Call[string](context.Background(), p, "where")
+	a.NoError(err)
+	a.Equal(filepath.Join(dir, "a", "work"), r)
+}
+
+func Test_ExternalShellPlugin_syntaxError(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.sh", `
+broken() {
+	echo "unclosed
+`)
+
+	p := qplugin.NewExternalShellPluginContext()
+	a.ErrorContains(p.Compile(fs, "/plugin.sh"), "parse /plugin.sh")
+}
+
+func Test_ExternalShellPlugin_resultLimit(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugin.sh", `
+small() {
+	echo "fits"
+}
+
+flood() {
+	while true; do
+		echo "0123456789"
+	done
+}
+`)
+
+	p := qplugin.NewExternalShellPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{})
+	p.SetOutputLimits(0, 64)
+	p.Init(logger, nil, fs, "/plugin.sh")
+
+	r, err := p.Invoke(context.Background(), "small")
+	a.NoError(err)
+	a.Equal([]any{"fits"}, r)
+
+	_, err = p.Invoke(context.Background(), "flood")
+	a.ErrorContains(err, "flood failed: result exceeds the limit of 64 bytes")
+}
@@ -0,0 +1,269 @@
+package test
+
+// The .wat files are the source of the wasm fixtures, to be assembled by wat2wasm of WABT,
+// https://github.com/WebAssembly/wabt. The committed .wasm files were not generated by wat2wasm but assembled by
+// hand, since WABT wasn't available, so their encoding may differ from what wat2wasm emits;
+// Test_WasmFixtures_matchSources checks their imports and exports against the .wat files. Run 'go generate' in this
+// directory to regenerate them, ie. after changing the .wat files, and commit both.
+//go:generate wat2wasm testdata/wasm/plugin.wat -o testdata/wasm/plugin.wasm
+//go:generate wat2wasm testdata/wasm/wasi.wat -o testdata/wasm/wasi.wasm
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/wazero"
+)
+
+func init() {
+	qplugin.RegisterWasmHostFunction("echo", func(ctx context.Context, host qplugin.HostPlugin, args json.RawMessage) (any, error) {
+		var values []int
+		if err := json.Unmarshal(args, &values); err != nil {
+			return nil, err
+		}
+		return map[string]any{"plugin": host.Id(), "values": values}, nil
+	})
+}
+
+func newTestWasmFs(t *testing.T, a *require.Assertions, manifest string) afero.Fs {
+	fs := afero.NewMemMapFs()
+	writeTestWasmPlugin(a, fs, "/plugins/a", manifest)
+	return fs
+}
+
+func writeTestWasmPlugin(a *require.Assertions, fs afero.Fs, pluginDir string, manifest string) {
+	comm.WriteFileTextP(fs, pluginDir+"/plugin.manifest.yml", manifest)
+
+	code, err := os.ReadFile("testdata/wasm/plugin.wasm")
+	a.NoError(err)
+	a.NoError(afero.WriteFile(fs, pluginDir+"/plugin.wasm", code, 0o644))
+}
+
+var (
+	watImportPattern = regexp.MustCompile(`\(import "([^"]+)" "([^"]+)" \(func`)
+	watExportPattern = regexp.MustCompile(`\(func \(export "([^"]+)"\)`)
+)
+
+// Test_WasmFixtures_matchSources verifies the wasm fixtures import and export the functions of their .wat source
+func Test_WasmFixtures_matchSources(t *testing.T) {
+	a := require.New(t)
+	ctx := context.Background()
+
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	for _, name := range []string{"plugin", "wasi"} {
+		wat, err := os.ReadFile("testdata/wasm/" + name + ".wat")
+		a.NoError(err)
+		code, err := os.ReadFile("testdata/wasm/" + name + ".wasm")
+		a.NoError(err)
+
+		compiled, err := runtime.CompileModule(ctx, code)
+		a.NoError(err)
+
+		expectedImports := []string{}
+		for _, m := range watImportPattern.FindAllStringSubmatch(string(wat), -1) {
+			expectedImports = append(expectedImports, m[1]+"."+m[2])
+		}
+		imports := []string{}
+		for _, f := range compiled.ImportedFunctions() {
+			moduleName, funcName, _ := f.Import()
+			imports = append(imports, moduleName+"."+funcName)
+		}
+		a.NotEmpty(expectedImports, name)
+		a.Equal(expectedImports, imports, name)
+
+		expectedExports := []string{}
+		for _, m := range watExportPattern.FindAllStringSubmatch(string(wat), -1) {
+			expectedExports = append(expectedExports, m[1])
+		}
+		exports := []string{}
+		for funcName := range compiled.ExportedFunctions() {
+			exports = append(exports, funcName)
+		}
+		sort.Strings(expectedExports)
+		sort.Strings(exports)
+		a.Equal(expectedExports, exports, name)
+	}
+}
+
+func Test_ExternalWasmPlugin_happy(t *testing.T) {
+	a := require.New(t)
+	logger, logs := newFileLogger(t)
+
+	fs := newTestWasmFs(t, a, `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: wasm
+config:
+  greeting: hello
+`)
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a")
+	a.NotNil(p)
+	a.Equal(qplugin.PLUGIN_LANG_WASM, p.Language())
+
+	p.Start(logger)
+	a.Contains(logs.String(), `"message":"started"`)
+
+	sum, err := qplugin.Call[int](context.Background(), p, "add", 40, 2)
+	a.NoError(err)
+	a.Equal(42, sum)
+
+	n, err := qplugin.Call[int](context.Background(), p, "greeting")
+	a.NoError(err)
+	a.Equal(len(`"hello"`), n)
+	a.Contains(logs.String(), `"message":"\"hello\""`)
+
+	n, err = qplugin.Call[int](context.Background(), p, "echo")
+	a.NoError(err)
+	a.Positive(n)
+	a.Contains(logs.String(), `{\"plugin\":\"/plugina\",\"values\":[1,2]}`)
+
+	_, err = p.Invoke(context.Background(), "add", 1)
+	a.ErrorContains(err, "add expects 2 arguments, got 1")
+
+	_, err = p.Invoke(context.Background(), "trap")
+	a.ErrorContains(err, "trap failed: wasm error: unreachable")
+
+	a.PanicsWithError("plugin_stop returns 2", func() { p.Stop(logger) })
+}
+
+func Test_ExternalWasmPlugin_limits(t *testing.T) {
+	a := require.New(t)
+
+	fs := newTestWasmFs(t, a, `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: wasm
+wasm:
+  max_memory_pages: 4
+  timeout: 1
+`)
+
+	p := qplugin.ResolveExternalPlugin(comm.NewDiscardLogger(), fs, "/plugins/a")
+	a.NotNil(p)
+
+	pages, err := qplugin.Call[int](context.Background(), p, "grow", 2)
+	a.NoError(err)
+	a.Equal(1, pages)
+
+	pages, err = qplugin.Call[int](context.Background(), p, "grow", 2)
+	a.NoError(err)
+	a.Equal(-1, pages)
+
+	_, err = p.Invoke(context.Background(), "loop")
+	a.ErrorContains(err, "loop failed")
+	a.ErrorContains(err, "context deadline exceeded")
+}
+
+func Test_ExternalWasmPlugin_wasi(t *testing.T) {
+	a := require.New(t)
+
+	code, err := os.ReadFile("testdata/wasm/wasi.wasm")
+	a.NoError(err)
+
+	fs := afero.NewMemMapFs()
+	a.NoError(afero.WriteFile(fs, "/plugin.wasm", code, 0o644))
+
+	p := qplugin.NewExternalWasmPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{})
+	a.ErrorContains(p.Compile(fs, "/plugin.wasm"),
+		"/plugin.wasm: import wasi_snapshot_preview1.proc_exit requires permission wasi")
+
+	p = qplugin.NewExternalWasmPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{qplugin.PLUGIN_PERMISSION_WASI})
+	a.NoError(p.Compile(fs, "/plugin.wasm"))
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.wasm")
+}
+
+func Test_ExternalWasmPlugin_closedOnStop(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+
+	fs := newTestWasmFs(t, a, `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+language: wasm
+`)
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a")
+	a.NotNil(p)
+
+	p.Start(logger)
+	a.PanicsWithError("plugin_stop returns 2", func() { p.Stop(logger) })
+
+	// closed even if plugin_stop fails
+	_, err := p.Invoke(context.Background(), "add", 1, 2)
+	a.ErrorContains(err, "add: plugin is not initialized")
+
+	// instantiated again
+	p.Start(logger)
+	sum, err := qplugin.Call[int](context.Background(), p, "add", 1, 2)
+	a.NoError(err)
+	a.Equal(3, sum)
+
+	c := qplugin.NewExternalWasmPluginContext()
+	c.Init(logger, nil, fs, "/plugins/a/plugin.wasm")
+	a.NoError(c.Close(context.Background()))
+	a.NoError(c.Close(context.Background()))
+
+	_, err = c.Invoke(context.Background(), "add", 1, 2)
+	a.ErrorContains(err, "add: plugin is not initialized")
+}
+
+func Test_ExternalWasmPlugin_closedIfLoaderFails(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+
+	fs := afero.NewMemMapFs()
+	writeTestWasmPlugin(a, fs, "/plugins/local/b", `
+kind: tool
+name: PluginB
+version_major: 1
+version_minor: 0
+language: wasm
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: tool
+name: PluginA
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", `
+	package plugin
+
+	import "errors"
+
+	func PluginStart() error {
+		return errors.New("a fails")
+	}
+	`)
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	loader := qplugin.NewLocalPluginLoader(logger, fs, "/plugins")
+	registry.Register(loader)
+
+	a.ErrorContains(registry.Init(logger), "a fails")
+	a.Nil(registry.ById("local/pluginb"))
+
+	// initialized but never started, so closed
+	pb := loader.Plugins()["pluginb"].(qplugin.ExternalPlugin)
+	a.False(pb.IsStarted())
+	_, err := pb.Invoke(context.Background(), "add", 1, 2)
+	a.ErrorContains(err, "add: plugin is not initialized")
+}
@@ -0,0 +1,150 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCompatibilityTestPlugin(fs afero.Fs, name string, requires string) {
+	comm.WriteFileTextP(fs, "/plugins/local/"+name+"/plugin.manifest.yml", `
+kind: test
+name: `+name+`
+version_major: 1
+version_minor: 0
+`+requires)
+	comm.WriteFileTextP(fs, "/plugins/local/"+name+"/plugin.go", `
+	package plugin
+	`)
+}
+
+func Test_PluginCompatibility_rejectedAtDiscovery(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	writeCompatibilityTestPlugin(fs, "any", "")
+	writeCompatibilityTestPlugin(fs, "v2", `
+requires:
+  host: ">=2.3 <3"
+  api_level: 4
+substitute: strict
+config:
+  host: ${HOST_VERSION}
+`)
+	writeCompatibilityTestPlugin(fs, "v3", `
+requires:
+  host: ^3
+`)
+	writeCompatibilityTestPlugin(fs, "newer", `
+min_host_version: 2.5.0
+requires:
+  api_level: 7
+`)
+
+	// set by the host application, but the registry knows better
+	qplugin.SetManifestVariable(qplugin.MANIFEST_VAR_HOST_VERSION, "1.5.0")
+
+	registry := qplugin.NewPluginRegistry(1, "test")
+	registry.SetHostVersion("2.4.1")
+	registry.SetApiLevel(5)
+	a.Equal("2.4.1", registry.HostVersion())
+	a.Equal(5, registry.ApiLevel())
+
+	loader := qplugin.NewLocalPluginLoader(logger, fs, "/plugins")
+	registry.Register(loader)
+	err := registry.Init(logger)
+	a.Error(err)
+	a.Contains(err.Error(), "plugin local/v3 is incompatible with the host")
+	a.Contains(err.Error(), "supports host versions ^3, but the host is 2.4.1")
+	a.Contains(err.Error(), "plugin local/newer is incompatible with the host")
+	a.Contains(err.Error(), "supports host versions >=2.5.0, but the host is 2.4.1")
+	a.Contains(err.Error(), "requires host API level 7 or later, but the host is at 5")
+
+	a.NotNil(registry.ById("local/any"))
+	a.NotNil(registry.ById("local/v2"))
+
+	// the host version is substituted, the global variable is left to the host application
+	a.Equal("2.4.1", registry.ById("local/v2").(qplugin.ExternalPlugin).Host().Config()["host"])
+	a.Equal("1.5.0", qplugin.ManifestVariables()[qplugin.MANIFEST_VAR_HOST_VERSION])
+	a.Nil(registry.ById("local/v3"))
+	a.Nil(registry.ById("local/newer"))
+
+	// checked on the manifest, so never discovered as a candidate
+	diagnostics := loader.(qplugin.DiagnosedPluginLoader).Diagnostics()
+	a.Len(diagnostics, 2)
+	a.Equal("/plugins/local/newer", diagnostics[0].Path)
+	a.Equal("/plugins/local/v3", diagnostics[1].Path)
+	a.Len(loader.Plugins(), 2)
+}
+
+func Test_PluginCompatibility_unknownHost(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	writeCompatibilityTestPlugin(fs, "v3", `
+requires:
+  host: ^3
+  api_level: 9
+`)
+
+	// nothing to check if the host doesn't tell its version and API level
+	registry := qplugin.NewPluginRegistry(1, "test")
+	a.Empty(registry.HostVersion())
+	a.Equal(0, registry.ApiLevel())
+
+	report := qplugin.ValidatePluginTree(logger, registry, fs, "/plugins/local", "local")
+	a.Empty(report.Diagnostics())
+	a.Len(report.Plugins(), 1)
+}
+
+func Test_PluginCompatibility_prereleaseHost(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	writeCompatibilityTestPlugin(fs, "v2", `
+requires:
+  host: ">=2.3 <3"
+`)
+
+	registry := qplugin.NewPluginRegistry(1, "test")
+	registry.SetHostVersion("2.4.0-rc.1")
+
+	report := qplugin.ValidatePluginTree(logger, registry, fs, "/plugins/local", "local")
+	a.Empty(report.Diagnostics())
+
+	registry.SetHostVersion("3.0.0-rc.1")
+	report = qplugin.ValidatePluginTree(logger, registry, fs, "/plugins/local", "local")
+	a.Len(report.Diagnostics(), 1)
+	a.Contains(report.Diagnostics()[0].Error(), "supports host versions >=2.3 <3, but the host is 3.0.0-rc.1")
+}
+
+func Test_PluginCompatibility_invalid(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	writeCompatibilityTestPlugin(fs, "a", `
+requires:
+  host: "newer than 2"
+  api_level: -1
+`)
+
+	registry := qplugin.NewPluginRegistry(1, "test")
+	report := qplugin.ValidatePluginTree(logger, registry, fs, "/plugins/local", "local")
+	a.Len(report.Diagnostics(), 1)
+	a.Contains(report.Diagnostics()[0].Error(), "requires.host 'newer than 2' is not a valid version range")
+	a.Contains(report.Diagnostics()[0].Error(), "requires.api_level '-1' must be gte 0")
+
+	a.Panics(func() {
+		registry.SetHostVersion("two")
+	})
+	a.Panics(func() {
+		registry.SetApiLevel(-1)
+	})
+}
@@ -0,0 +1,232 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+type Greeter interface {
+	Hello(name string) string
+	Bye() string
+}
+
+// _github_com_qiangyt_qbase_go_plugin_test_Greeter is the yaegi wrapper of Greeter, as 'yaegi extract' generates
+type _github_com_qiangyt_qbase_go_plugin_test_Greeter struct {
+	IValue interface{}
+	WBye   func() string
+	WHello func(name string) string
+}
+
+func (W _github_com_qiangyt_qbase_go_plugin_test_Greeter) Bye() string {
+	return W.WBye()
+}
+func (W _github_com_qiangyt_qbase_go_plugin_test_Greeter) Hello(name string) string {
+	return W.WHello(name)
+}
+
+func init() {
+	qplugin.RegisterPluginInterface("greeters", (*Greeter)(nil), (*_github_com_qiangyt_qbase_go_plugin_test_Greeter)(nil))
+}
+
+func Test_PluginInterface_bridge(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: greeters
+name: a
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", `
+	package plugin
+
+	import "github.com/qiangyt/qbase-go/plugin/test"
+
+	type greeter struct {
+		prefix string
+	}
+
+	func (me *greeter) Hello(name string) string {
+		return me.prefix + name
+	}
+
+	func (me *greeter) Bye() string {
+		return "bye"
+	}
+
+	func New() test.Greeter {
+		return &greeter{prefix: "hello "}
+	}
+	`)
+
+	registry := qplugin.NewPluginRegistry(1, "greeters")
+	registry.Register(qplugin.NewLocalPluginLoader(logger, fs, "/plugins"))
+	a.NoError(registry.Init(logger))
+
+	p := registry.ByName("greeters", "a")
+	a.NotNil(p)
+
+	g, ok := qplugin.PluginImplementation[Greeter](p)
+	a.True(ok)
+	a.Equal("hello x", g.Hello("x"))
+	a.Equal("bye", g.Bye())
+
+	// the plugin itself implements the type
+	_, ok = qplugin.PluginImplementation[qplugin.Plugin](p)
+	a.True(ok)
+}
+
+func Test_PluginInterface_missingMethods(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	type greeter struct{}
+
+	func (me *greeter) Hello(name string) string {
+		return name
+	}
+
+	func New() any {
+		return &greeter{}
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+
+	// yaegi loses the methods of the value returned as any
+	_, err := qplugin.NewPluginInstance(context.Background(), p, "greeters")
+	a.ErrorContains(err, "New declares the result as interface {}, expect test.Greeter")
+	a.ErrorContains(err, "doesn't implement test.Greeter, missing methods: Bye, Hello")
+
+	// no declared interface
+	instance, err := qplugin.NewPluginInstance(context.Background(), p, "others")
+	a.NoError(err)
+	a.Nil(instance)
+}
+
+func Test_PluginInterface_constructorTakesContext(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import (
+		"context"
+
+		"github.com/qiangyt/qbase-go/plugin/test"
+	)
+
+	type greeter struct{}
+
+	func (me *greeter) Hello(name string) string {
+		return "hello " + name
+	}
+
+	func (me *greeter) Bye() string {
+		return "bye"
+	}
+
+	func New(ctx context.Context) (test.Greeter, error) {
+		return &greeter{}, nil
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+
+	instance, err := qplugin.NewPluginInstance(context.Background(), p, "greeters")
+	a.NoError(err)
+
+	g, ok := instance.(Greeter)
+	a.True(ok)
+	a.Equal("hello x", g.Hello("x"))
+	a.Equal("bye", g.Bye())
+
+	// the constructor is resolved once
+	instance, err = qplugin.NewPluginInstance(context.Background(), p, "greeters")
+	a.NoError(err)
+	a.Equal("bye", instance.(Greeter).Bye())
+}
+
+func Test_PluginInterface_packageConstructorReturnsAny(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin/greeter.go", `
+	package greeters
+
+	type greeter struct {
+		prefix string
+	}
+
+	func (me greeter) Hello(name string) string {
+		return me.prefix + name
+	}
+
+	func (me greeter) Bye() string {
+		return "bye"
+	}
+	`)
+	comm.WriteFileTextP(fs, "/plugin/new.go", `
+	package greeters
+
+	import "github.com/qiangyt/qbase-go/plugin/test"
+
+	// converted to the interface before returned as any
+	func New() any {
+		var r test.Greeter = greeter{prefix: "hi "}
+		return r
+	}
+	`)
+
+	p := qplugin.NewExternalGoPackagePluginContext("example.com/greeters")
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin")
+
+	instance, err := qplugin.NewPluginInstance(context.Background(), p, "greeters")
+	a.NoError(err)
+	a.Equal("hi x", instance.(Greeter).Hello("x"))
+}
+
+func Test_PluginInterface_constructorFails(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import "errors"
+
+	func New() (any, error) {
+		return nil, errors.New("not now")
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+
+	_, err := qplugin.NewPluginInstance(context.Background(), p, "greeters")
+	a.ErrorContains(err, "not now")
+}
+
+func Test_RegisterPluginInterface_invalid(t *testing.T) {
+	a := require.New(t)
+
+	a.Panics(func() {
+		qplugin.RegisterPluginInterface("x", Greeter(nil), (*_github_com_qiangyt_qbase_go_plugin_test_Greeter)(nil))
+	})
+	a.Panics(func() {
+		qplugin.RegisterPluginInterface("x", (*Greeter)(nil), (*testPluginT)(nil))
+	})
+}
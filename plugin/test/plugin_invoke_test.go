@@ -0,0 +1,156 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func newInvokeTestContext(a *require.Assertions) qplugin.ExternalGoPluginContext {
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import (
+		"context"
+		"errors"
+		"strings"
+	)
+
+	func Transform(in string) string {
+		return strings.ToUpper(in)
+	}
+
+	func Add(a int, b int) (int, error) {
+		if a < 0 {
+			return 0, errors.New("negative")
+		}
+		return a + b, nil
+	}
+
+	func Join(ctx context.Context, sep string, parts ...string) string {
+		return strings.Join(parts, sep)
+	}
+
+	func Boom() {
+		panic("boom")
+	}
+
+	func Pair() (string, int) {
+		return "a", 1
+	}
+
+	func Byte(b uint8) uint8 {
+		return b
+	}
+
+	func Unsigned(u uint) uint {
+		return u
+	}
+
+	func Number(n int) int {
+		return n
+	}
+
+	var NotFunc = 1
+	`)
+
+	r := qplugin.NewExternalGoPluginContext()
+	a.NotPanics(func() {
+		r.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+	})
+	return r
+}
+
+func Test_ExternalGoPlugin_invoke(t *testing.T) {
+	a := require.New(t)
+	p := newInvokeTestContext(a)
+	ctx := context.Background()
+
+	results, err := p.Invoke(ctx, "Transform", "abc")
+	a.NoError(err)
+	a.Equal([]any{"ABC"}, results)
+
+	// context is passed implicitly, and variadic arguments
+	results, err = p.Invoke(ctx, "Join", "-", "a", "b")
+	a.NoError(err)
+	a.Equal([]any{"a-b"}, results)
+
+	results, err = p.Invoke(ctx, "Pair")
+	a.NoError(err)
+	a.Equal([]any{"a", 1}, results)
+
+	_, err = p.Invoke(ctx, "Boom")
+	a.ErrorContains(err, "Boom panicked")
+
+	_, err = p.Invoke(ctx, "Add", -1, 2)
+	a.ErrorContains(err, "negative")
+
+	_, err = p.Invoke(ctx, "Transform", 1)
+	a.ErrorContains(err, "argument 0 of Transform: expect string, got int")
+
+	_, err = p.Invoke(ctx, "Transform")
+	a.ErrorContains(err, "Transform expects 1 arguments, got 0")
+
+	_, err = p.Invoke(ctx, "NotFunc")
+	a.ErrorContains(err, "NotFunc is not a function")
+
+	_, err = p.Invoke(ctx, "Missing")
+	a.Error(err)
+
+	// only the exported function names are evaluated
+	_, err = p.Invoke(ctx, `Transform("x"); os.Exit(1)`)
+	a.ErrorContains(err, "is not an exported function name")
+	_, err = p.Invoke(ctx, "strings")
+	a.ErrorContains(err, `"strings" is not an exported function name`)
+}
+
+func Test_ExternalGoPlugin_call(t *testing.T) {
+	a := require.New(t)
+	p := newInvokeTestContext(a)
+	ctx := context.Background()
+
+	s, err := qplugin.Call[string](ctx, p, "Transform", "abc")
+	a.NoError(err)
+	a.Equal("ABC", s)
+
+	// numbers are converted without loss
+	n, err := qplugin.Call[int](ctx, p, "Add", float64(1), int8(2))
+	a.NoError(err)
+	a.Equal(3, n)
+
+	_, err = qplugin.Call[int](ctx, p, "Add", 1.5, 2)
+	a.ErrorContains(err, "1.5 can't be int without loss")
+
+	// out of the range of the type
+	_, err = qplugin.Call[uint](ctx, p, "Unsigned", -1)
+	a.ErrorContains(err, "-1 can't be uint without loss")
+	_, err = qplugin.Call[uint8](ctx, p, "Byte", 256)
+	a.ErrorContains(err, "256 can't be uint8 without loss")
+	_, err = qplugin.Call[uint8](ctx, p, "Byte", 255.0)
+	a.NoError(err)
+
+	b, err := qplugin.Call[uint8](ctx, p, "Number", 255)
+	a.NoError(err)
+	a.Equal(uint8(255), b)
+	_, err = qplugin.Call[uint8](ctx, p, "Number", 256)
+	a.ErrorContains(err, "Number returns int, expect uint8")
+	_, err = qplugin.Call[uint](ctx, p, "Number", -1)
+	a.ErrorContains(err, "Number returns int, expect uint")
+	f, err := qplugin.Call[float32](ctx, p, "Number", 1<<24)
+	a.NoError(err)
+	a.Equal(float32(1<<24), f)
+	_, err = qplugin.Call[float32](ctx, p, "Number", 1<<24+1)
+	a.ErrorContains(err, "Number returns int, expect float32")
+
+	_, err = qplugin.Call[int](ctx, p, "Transform", "abc")
+	a.ErrorContains(err, "Transform returns string, expect int")
+
+	_, err = qplugin.Call[string](ctx, p, "Pair")
+	a.ErrorContains(err, "Pair returns 2 values, expect 1")
+}
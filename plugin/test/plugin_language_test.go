@@ -0,0 +1,166 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// textPluginContext is a toy runtime whose plugin code is a text file, every function returns the text
+type textPluginContext struct {
+	text string
+}
+
+func (me *textPluginContext) Compile(fs afero.Fs, codeFile string) error {
+	_, err := afero.ReadFile(fs, codeFile)
+	return err
+}
+
+func (me *textPluginContext) Init(logger comm.Logger, host qplugin.HostPlugin, fs afero.Fs, codeFile string) {
+	me.text = comm.ReadFileTextP(fs, codeFile)
+}
+
+func (me *textPluginContext) Start(ctx context.Context) error {
+	return nil
+}
+
+func (me *textPluginContext) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (me *textPluginContext) Invoke(ctx context.Context, funcName string, args ...any) ([]any, error) {
+	return []any{fmt.Sprintf("%s: %s", funcName, me.text)}, nil
+}
+
+func Test_LanguageRuntime_builtin(t *testing.T) {
+	a := require.New(t)
+
+	langs := qplugin.LanguageRuntimes()
+	for _, lang := range []qplugin.PluginLang{qplugin.PLUGIN_LANG_GO, qplugin.PLUGIN_LANG_GO_NATIVE,
+		qplugin.PLUGIN_LANG_JAVASCRIPT, qplugin.PLUGIN_LANG_SHELL, qplugin.PLUGIN_LANG_PROCESS,
+		qplugin.PLUGIN_LANG_WASM, qplugin.PLUGIN_LANG_HTTP} {
+		a.Contains(langs, lang)
+		a.NotNil(qplugin.LanguageRuntime(lang))
+	}
+	a.Nil(qplugin.LanguageRuntime("cobol"))
+}
+
+func Test_LanguageRuntime_custom(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	qplugin.RegisterLanguageRuntime("text", func(fs afero.Fs, pluginDir string, manifest qplugin.PluginManifest) (string, qplugin.ExternalPluginContext, error) {
+		codeFile, err := qplugin.ExternalPluginEntry(fs, pluginDir, manifest, "plugin.txt")
+		if err != nil {
+			return "", nil, err
+		}
+		return codeFile, &textPluginContext{}, nil
+	})
+	a.Contains(qplugin.LanguageRuntimes(), "text")
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: test
+name: a
+version_major: 1
+version_minor: 0
+language: text
+entry: hello.txt
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/hello.txt", "hello")
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a")
+	a.NotNil(p)
+	a.Equal("text", p.Language())
+	a.Equal("/plugins/a/hello.txt", p.CodeFile())
+
+	r, err := qplugin.Call[string](context.Background(), p, "greet")
+	a.NoError(err)
+	a.Equal("greet: hello", r)
+}
+
+func Test_LanguageRuntime_entry(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: test
+name: a
+version_major: 1
+version_minor: 0
+entry: main.go
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/main.go", `
+	package plugin
+
+	func Hello() string { return "hello" }
+	`)
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a")
+	a.NotNil(p)
+	a.Equal(qplugin.PLUGIN_LANG_GO, p.Language())
+	a.Equal("/plugins/a/main.go", p.CodeFile())
+
+	r, err := qplugin.Call[string](context.Background(), p, "Hello")
+	a.NoError(err)
+	a.Equal("hello", r)
+
+	// the entry must exist
+	comm.WriteFileTextP(fs, "/plugins/b/plugin.manifest.yml", `
+kind: test
+name: b
+version_major: 1
+version_minor: 0
+entry: missing.go
+`)
+	a.Nil(qplugin.ResolveExternalPlugin(logger, fs, "/plugins/b"))
+}
+
+func Test_LanguageRuntime_unknownIsDiagnosed(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/local/good/plugin.manifest.yml", `
+kind: test
+name: good
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/good/plugin.go", `
+	package plugin
+
+	func PluginStart() {}
+	`)
+	comm.WriteFileTextP(fs, "/plugins/local/bad/plugin.manifest.yml", `
+kind: test
+name: bad
+version_major: 1
+version_minor: 0
+language: cobol
+`)
+
+	loader := qplugin.NewLocalPluginLoader(logger, fs, "/plugins")
+	candidates, err := loader.Discover(logger)
+	a.NoError(err)
+	a.Len(candidates, 1)
+	a.Equal("good", candidates[0].Name())
+
+	diagnostics := loader.(qplugin.DiagnosedPluginLoader).Diagnostics()
+	a.Len(diagnostics, 1)
+	a.Equal("/plugins/local/bad", diagnostics[0].Path)
+	a.Contains(diagnostics[0].Error(), "unknown plugin language cobol")
+
+	registry := qplugin.NewPluginRegistry(1, "test")
+	registry.Register(qplugin.NewLocalPluginLoader(logger, fs, "/plugins"))
+	err = registry.Init(logger)
+	a.Error(err)
+	a.Contains(err.Error(), "unknown plugin language cobol, expect one of:")
+	a.NotNil(registry.ById("local/good"))
+}
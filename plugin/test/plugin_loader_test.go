@@ -0,0 +1,156 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+type testPluginT struct {
+	qplugin.BasePluginT
+
+	failStart bool
+	optional  bool
+	events    *[]string
+	onStart   func()
+}
+
+type testPlugin = *testPluginT
+
+func newTestPlugin(name string, events *[]string) testPlugin {
+	return &testPluginT{
+		BasePluginT: qplugin.NewBasePlugin(name, "tool"),
+		events:      events,
+	}
+}
+
+func (me testPlugin) Start(logger comm.Logger) {
+	if me.failStart {
+		panic(fmt.Errorf("%s failed", me.Name()))
+	}
+	if me.onStart != nil {
+		me.onStart()
+	}
+	*me.events = append(*me.events, "start "+me.Name())
+	me.BasePluginT.Start(logger)
+}
+
+func (me testPlugin) Stop(logger comm.Logger) {
+	*me.events = append(*me.events, "stop "+me.Name())
+	me.BasePluginT.Stop(logger)
+}
+
+func (me testPlugin) Optional() bool {
+	return me.optional
+}
+
+func Test_BasePluginLoader_rollback(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+	events := []string{}
+
+	pa := newTestPlugin("a", &events)
+	pb := newTestPlugin("b", &events)
+	pc := newTestPlugin("c", &events)
+	pc.failStart = true
+
+	loader := qplugin.NewPluginLoader("local")
+	loader.Register(pa)
+	loader.Register(pb)
+	loader.Register(pc)
+
+	a.Error(loader.Start(logger))
+	a.False(loader.IsStarted())
+	a.Equal([]string{"start a", "start b", "stop b", "stop a"}, events)
+	a.False(pa.IsStarted())
+	a.False(pb.IsStarted())
+
+	// nothing is running, so stop is a no-op
+	events = events[:0]
+	a.NoError(loader.Stop(logger))
+	a.Empty(events)
+
+	// retry
+	pc.failStart = false
+	a.NoError(loader.Start(logger))
+	a.True(loader.IsStarted())
+	a.Equal([]string{"start a", "start b", "start c"}, events)
+
+	events = events[:0]
+	a.NoError(loader.Stop(logger))
+	a.False(loader.IsStarted())
+	a.Equal([]string{"stop c", "stop b", "stop a"}, events)
+}
+
+func Test_BasePluginLoader_optional(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+	events := []string{}
+
+	pa := newTestPlugin("a", &events)
+	pb := newTestPlugin("b", &events)
+	pb.failStart = true
+	pb.optional = true
+
+	loader := qplugin.NewPluginLoader("local")
+	loader.Register(pa)
+	loader.Register(pb)
+
+	a.NoError(loader.Start(logger))
+	a.True(loader.IsStarted())
+	a.Equal([]string{"start a"}, events)
+}
+
+func Test_PluginRegistry_rollbackPerRegistry(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+	events := []string{}
+
+	loader1 := qplugin.NewPluginLoader("ns1")
+	loader1.Register(newTestPlugin("a", &events))
+
+	pb := newTestPlugin("b", &events)
+	pb.failStart = true
+	loader2 := qplugin.NewPluginLoader("ns2")
+	loader2.Register(pb)
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	registry.SetStartMode(qplugin.PLUGIN_START_PER_REGISTRY)
+	registry.Register(loader1)
+	registry.Register(loader2)
+
+	a.Error(registry.Init(logger))
+	a.False(loader1.IsStarted())
+	a.False(loader2.IsStarted())
+	a.Equal([]string{"start a", "stop a"}, events)
+}
+
+func Test_PluginRegistry_rollbackPerLoader(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+	events := []string{}
+
+	loader1 := qplugin.NewPluginLoader("ns1")
+	loader1.Register(newTestPlugin("a", &events))
+
+	pb := newTestPlugin("b", &events)
+	pb.failStart = true
+	loader2 := qplugin.NewPluginLoader("ns2")
+	loader2.Register(pb)
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	registry.Register(loader1)
+	registry.Register(loader2)
+
+	a.Error(registry.Init(logger))
+	a.True(loader1.IsStarted())
+	a.False(loader2.IsStarted())
+	a.Equal([]string{"start a"}, events)
+
+	registry.Destroy(logger)
+	a.False(loader1.IsStarted())
+	a.Equal([]string{"start a", "stop a"}, events)
+}
@@ -0,0 +1,213 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SingleFilePlugin_go(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/hello.go", `// Package plugin says hello.
+//
+// --- qplugin
+// manifest_version: 2
+// kind: tool
+// name: hello
+// version_major: 1
+// version_minor: 2
+// description: says hello
+// ---
+package plugin
+
+func Greet(name string) string {
+	return "hello, " + name
+}
+`)
+
+	a.True(qplugin.IsSingleFilePlugin(fs, "/plugins/hello.go"))
+	a.Equal("/plugins/hello.go", qplugin.FindPluginManifestFile(fs, "/plugins/hello.go"))
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/hello.go")
+	a.NotNil(p)
+	a.Equal("hello", p.Name())
+	a.Equal(qplugin.PLUGIN_LANG_GO, p.Language())
+	a.Equal("/plugins", p.Dir())
+	a.Equal("/plugins/hello.go", p.CodeFile())
+
+	mf := qplugin.PluginManifestOf(p)
+	a.Equal("says hello", mf.Description)
+	a.Equal("hello.go", mf.Entry)
+
+	p.Start(logger)
+	r, err := qplugin.Call[string](context.Background(), p, "Greet", "world")
+	a.NoError(err)
+	a.Equal("hello, world", r)
+	p.Stop(logger)
+}
+
+func Test_SingleFilePlugin_shell(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/greet.sh", `#!/bin/sh
+
+# --- qplugin
+# kind: tool
+# name: greet
+# version_major: 1
+# version_minor: 0
+# shell:
+#   env:
+#     GREETING: hi
+# ---
+
+greet() {
+	echo "$GREETING, $1"
+}
+`)
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/greet.sh")
+	a.NotNil(p)
+	a.Equal(qplugin.PLUGIN_LANG_SHELL, p.Language())
+
+	r, err := qplugin.Call[string](context.Background(), p, "greet", "there")
+	a.NoError(err)
+	a.Equal("hi, there", r)
+}
+
+func Test_SingleFilePlugin_listed(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/a.go", `// --- qplugin
+// kind: tool
+// name: a
+// version_major: 1
+// version_minor: 0
+// ---
+package plugin
+`)
+	// no embedded manifest
+	comm.WriteFileTextP(fs, "/plugins/helper.go", `package plugin
+`)
+	// the manifest must be in the leading comment block
+	comm.WriteFileTextP(fs, "/plugins/late.go", `package plugin
+
+// --- qplugin
+// kind: tool
+// name: late
+// ---
+`)
+	comm.WriteFileTextP(fs, "/plugins/README.md", "# --- qplugin")
+	comm.WriteFileTextP(fs, "/plugins/b/plugin.manifest.yml", `
+kind: tool
+name: b
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/b/plugin.go", `
+	package plugin
+	`)
+
+	a.False(qplugin.IsSingleFilePlugin(fs, "/plugins/helper.go"))
+	a.False(qplugin.IsSingleFilePlugin(fs, "/plugins/late.go"))
+	a.False(qplugin.IsSingleFilePlugin(fs, "/plugins/README.md"))
+	a.Empty(qplugin.FindPluginManifestFile(fs, "/plugins/helper.go"))
+
+	plugins := qplugin.ListExternalPlugins(comm.NewDiscardLogger(), fs, "/plugins")
+	a.Len(plugins, 2)
+	a.Equal("a", plugins[0].Name())
+	a.Equal("b", plugins[1].Name())
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	report := qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, "/plugins", "local")
+	a.Empty(report.Diagnostics())
+	a.Len(report.Plugins(), 2)
+}
+
+func Test_SingleFilePlugin_invalid(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/a.go", `// --- qplugin
+// kind: tool
+// name: "not valid"
+// version_major: 1
+// ---
+package plugin
+`)
+	comm.WriteFileTextP(fs, "/plugins/b.go", `// --- qplugin
+// kind: tool
+// name: b
+// language: javascript
+// ---
+package plugin
+`)
+	comm.WriteFileTextP(fs, "/plugins/c.sh", `# --- qplugin
+# kind: tool
+# name: c
+# entry: other.sh
+# ---
+`)
+	comm.WriteFileTextP(fs, "/plugins/d.js", `// --- qplugin
+// kind: tool
+// name: d
+
+function plugin_start() {}
+`)
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	report := qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, "/plugins", "local")
+	a.Empty(report.Plugins())
+	a.Len(report.Diagnostics(), 4)
+
+	a.Contains(report.Diagnostics()[0].Error(), "manifest /plugins/a.go")
+	a.Contains(report.Diagnostics()[0].Error(), "name 'not valid' must match")
+	a.Contains(report.Diagnostics()[1].Error(), "language javascript doesn't match the file extension, expect go")
+	a.Contains(report.Diagnostics()[2].Error(), "entry is the source file itself, must not be specified")
+	a.Contains(report.Diagnostics()[3].Error(), "line 4: embedded manifest is not closed by '// ---'")
+}
+
+func Test_SingleFilePlugin_migrate(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/a.go", `// Package plugin does a.
+//
+// --- qplugin
+// kind: tool
+// name: a
+// version_major: 1
+// version_minor: 0
+// ---
+package plugin
+
+func A() {}
+`)
+
+	fromVersion, err := qplugin.MigratePluginManifestFile(fs, "/plugins/a.go")
+	a.NoError(err)
+	a.Equal(1, fromVersion)
+
+	source := comm.ReadFileTextP(fs, "/plugins/a.go")
+	a.Contains(source, "// Package plugin does a.\n//\n// --- qplugin\n")
+	a.Contains(source, "// manifest_version: 2\n")
+	a.Contains(source, "// ---\npackage plugin\n\nfunc A() {}\n")
+
+	mf := qplugin.PluginManifestWithFile(fs, "/plugins/a.go")
+	a.False(mf.Outdated())
+	a.Equal("a", mf.Name)
+
+	fromVersion, err = qplugin.MigratePluginManifestFile(fs, "/plugins/a.go")
+	a.NoError(err)
+	a.Equal(qplugin.PLUGIN_MANIFEST_VERSION, fromVersion)
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ManifestSubstitution_happy(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	t.Setenv("QPLUGIN_TEST_REGION", "eu-west")
+	qplugin.SetManifestVariable(qplugin.MANIFEST_VAR_HOST_VERSION, "1.5.0")
+	qplugin.SetManifestVariable("QPLUGIN_TEST_TIER", "gold")
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+manifest_version: 2
+substitute: strict
+kind: tool
+name: a
+version_major: 1
+version_minor: 0
+permissions: [env]
+description: "for ${HOST_OS}/${HOST_ARCH}, host ${HOST_VERSION}"
+config:
+  home: ${PLUGIN_DIR}/data
+  region: ${QPLUGIN_TEST_REGION}
+  tier: ${QPLUGIN_TEST_TIER}
+  color: ${QPLUGIN_TEST_UNDEFINED:-blue}
+  literal: $${QPLUGIN_TEST_REGION}
+  list:
+    - ${QPLUGIN_TEST_TIER}
+    - 3
+`)
+
+	mf := qplugin.PluginManifestWithFile(fs, "/plugins/a/plugin.manifest.yml")
+	a.Equal("for "+runtime.GOOS+"/"+runtime.GOARCH+", host 1.5.0", mf.Description)
+	a.Equal("/plugins/a/data", mf.Config["home"])
+	a.Equal("eu-west", mf.Config["region"])
+	a.Equal("gold", mf.Config["tier"])
+	a.Equal("blue", mf.Config["color"])
+	a.Equal("${QPLUGIN_TEST_REGION}", mf.Config["literal"])
+	a.Equal([]any{"gold", 3}, mf.Config["list"])
+	a.Equal(qplugin.PLUGIN_SUBSTITUTION_STRICT, mf.Substitute)
+}
+
+func Test_ManifestSubstitution_optIn(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: tool
+name: a
+version_major: 1
+version_minor: 0
+config:
+  home: ${PLUGIN_DIR}/data
+`)
+
+	mf := qplugin.PluginManifestWithFile(fs, "/plugins/a/plugin.manifest.yml")
+	a.Equal("${PLUGIN_DIR}/data", mf.Config["home"])
+}
+
+func Test_ManifestSubstitution_envRequiresPermission(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	t.Setenv("QPLUGIN_TEST_SECRET", "s3cr3t")
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+substitute: lenient
+kind: tool
+name: a
+version_major: 1
+version_minor: 0
+config:
+  secret: "[${QPLUGIN_TEST_SECRET}]"
+`)
+	mf := qplugin.PluginManifestWithFile(fs, "/plugins/a/plugin.manifest.yml")
+	a.Equal("[]", mf.Config["secret"])
+
+	comm.WriteFileTextP(fs, "/plugins/b/plugin.manifest.yml", `
+substitute: strict
+kind: tool
+name: b
+version_major: 1
+version_minor: 0
+config:
+  secret: ${QPLUGIN_TEST_SECRET}
+`)
+	a.PanicsWithError("manifest /plugins/b/plugin.manifest.yml: substitute variables: config.secret: variable QPLUGIN_TEST_SECRET is undefined", func() {
+		qplugin.PluginManifestWithFile(fs, "/plugins/b/plugin.manifest.yml")
+	})
+}
+
+func Test_ManifestSubstitution_invalid(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+substitute: always
+kind: tool
+name: a
+`)
+	a.Panics(func() {
+		qplugin.PluginManifestWithFile(fs, "/plugins/a/plugin.manifest.yml")
+	})
+
+	comm.WriteFileTextP(fs, "/plugins/b/plugin.manifest.yml", `
+substitute: lenient
+kind: tool
+name: b
+description: ${HOST_OS
+`)
+	a.Panics(func() {
+		qplugin.PluginManifestWithFile(fs, "/plugins/b/plugin.manifest.yml")
+	})
+
+	a.Panics(func() {
+		qplugin.SetManifestVariable("1BAD", "x")
+	})
+}
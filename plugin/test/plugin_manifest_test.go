@@ -0,0 +1,276 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PluginManifest_metadata(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: test
+name: Hello-World
+version_major: 1
+version_minor: 2
+description: says hello
+authors:
+  - name: qiangyt
+    email: qiangyt@example.com
+    url: https://github.com/qiangyt
+license: Apache-2.0 OR MIT
+homepage: https://example.com/hello
+repository: https://github.com/qiangyt/hello
+tags: [greeting, demo]
+labels:
+  tier: free
+min_host_version: 1.4.0
+icon: assets/icon.png
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.go", `
+	package plugin
+
+	func PluginStart() {}
+	`)
+	comm.WriteFileTextP(fs, "/plugins/a/assets/icon.png", "png")
+
+	p := qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a")
+	a.NotNil(p)
+
+	mf := qplugin.PluginManifestOf(p)
+	a.NotNil(mf)
+	a.Equal("hello-world", mf.Name)
+	a.Equal("says hello", mf.Description)
+	a.Equal([]qplugin.PluginManifestAuthorT{
+		{Name: "qiangyt", Email: "qiangyt@example.com", Url: "https://github.com/qiangyt"},
+	}, mf.Authors)
+	a.Equal("Apache-2.0 OR MIT", mf.License)
+	a.Equal("https://example.com/hello", mf.Homepage)
+	a.Equal("https://github.com/qiangyt/hello", mf.Repository)
+	a.Equal([]string{"greeting", "demo"}, mf.Tags)
+	a.Equal(map[string]string{"tier": "free"}, mf.Labels)
+	a.Equal("1.4.0", mf.MinHostVersion)
+	a.Equal("assets/icon.png", mf.Icon)
+
+	a.Nil(qplugin.PluginManifestOf(newTestPlugin("b", &[]string{})))
+}
+
+func Test_PluginManifest_invalid(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: test
+name: "hello world"
+version_major: 1
+version_minor: 0
+authors:
+  - email: not-an-email
+license: "MIT OR"
+homepage: example.com
+min_host_version: v1
+icon: ../icon.png
+tags: [""]
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", `
+	package plugin
+	`)
+
+	comm.WriteFileTextP(fs, "/plugins/local/b/plugin.manifest.yml", `
+kind: test
+name: b
+version_major: 1
+version_minor: 0
+icon: missing.png
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/b/plugin.go", `
+	package plugin
+	`)
+
+	registry := qplugin.NewPluginRegistry(1, "test")
+	report := qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, "/plugins/local", "local")
+	a.Empty(report.Plugins())
+	a.Len(report.Diagnostics(), 2)
+
+	errA := report.Diagnostics()[0].Error()
+	a.Contains(errA, "manifest /plugins/local/a/plugin.manifest.yml")
+	a.Contains(errA, "name 'hello world' must match")
+	a.Contains(errA, "authors[0].name is required")
+	a.Contains(errA, "authors[0].email 'not-an-email' is not a valid email")
+	a.Contains(errA, "license 'MIT OR' is not a valid SPDX license expression: unexpected end")
+	a.Contains(errA, "homepage 'example.com' is not a valid URL")
+	a.Contains(errA, "min_host_version 'v1' is not a semantic version")
+	a.Contains(errA, "icon '../icon.png' must be a relative path inside the plugin directory")
+	a.Contains(errA, "tags[0] is required")
+
+	a.Contains(report.Diagnostics()[1].Error(), "icon not found: missing.png")
+}
+
+func Test_CheckSpdxExpression(t *testing.T) {
+	a := require.New(t)
+
+	for _, expr := range []string{
+		"MIT",
+		"Apache-2.0",
+		"GPL-2.0+",
+		"LicenseRef-Proprietary",
+		"DocumentRef-spdx-tool-1.2:LicenseRef-MIT-Style-2",
+		"Apache-2.0 OR MIT",
+		"mit or apache-2.0",
+		"GPL-2.0-or-later WITH Classpath-exception-2.0",
+		"(MIT AND BSD-3-Clause) OR Apache-2.0",
+		"((MIT))",
+	} {
+		a.NoError(qplugin.CheckSpdxExpression(expr), expr)
+	}
+
+	for _, expr := range []string{
+		"",
+		"MIT OR",
+		"AND MIT",
+		"MIT Apache-2.0",
+		"(MIT",
+		"MIT)",
+		"MIT WITH",
+		"MIT/Apache-2.0",
+		"()",
+	} {
+		a.Error(qplugin.CheckSpdxExpression(expr), expr)
+	}
+}
+
+func Test_MigratePluginManifestMap_v1(t *testing.T) {
+	a := require.New(t)
+
+	v1 := map[string]any{
+		"kind":      "tool",
+		"name":      "a",
+		"language":  "go-native",
+		"go_native": map[string]any{"library": "lib/a.so"},
+	}
+
+	r, fromVersion, err := qplugin.MigratePluginManifestMap(v1)
+	a.NoError(err)
+	a.Equal(1, fromVersion)
+	a.Equal(map[string]any{
+		"kind":             "tool",
+		"name":             "a",
+		"language":         "go-native",
+		"entry":            "lib/a.so",
+		"manifest_version": qplugin.PLUGIN_MANIFEST_VERSION,
+	}, r)
+
+	// the input is kept as is
+	a.Contains(v1, "go_native")
+	a.NotContains(v1, "manifest_version")
+
+	mf := qplugin.PluginManifestWithMap(v1)
+	a.True(mf.Outdated())
+	a.Equal(1, mf.MigratedFrom())
+	a.Equal(qplugin.PLUGIN_MANIFEST_VERSION, mf.ManifestVersion)
+	a.Equal("lib/a.so", mf.Entry)
+
+	mf = qplugin.PluginManifestWithMap(r)
+	a.False(mf.Outdated())
+}
+
+func Test_MigratePluginManifestMap_failed(t *testing.T) {
+	a := require.New(t)
+
+	_, _, err := qplugin.MigratePluginManifestMap(map[string]any{"manifest_version": 99})
+	a.ErrorContains(err, "manifest_version 99 is newer than the supported")
+
+	_, _, err = qplugin.MigratePluginManifestMap(map[string]any{"manifest_version": "x"})
+	a.ErrorContains(err, "manifest_version x is not an integer")
+
+	_, _, err = qplugin.MigratePluginManifestMap(map[string]any{"manifest_version": 0})
+	a.ErrorContains(err, "manifest_version 0 must be positive")
+
+	_, _, err = qplugin.MigratePluginManifestMap(map[string]any{
+		"entry":     "b.so",
+		"go_native": map[string]any{"library": "a.so"},
+	})
+	a.ErrorContains(err, "go_native.library conflicts with entry")
+}
+
+func Test_MigratePluginManifestFile(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/a/plugin.manifest.yml", `
+kind: tool
+name: a
+version_major: 1
+version_minor: 0
+go_native:
+  library: a.so
+`)
+	fromVersion, err := qplugin.MigratePluginManifestFile(fs, "/a/plugin.manifest.yml")
+	a.NoError(err)
+	a.Equal(1, fromVersion)
+
+	migrated := comm.MapFromYamlFileP(fs, "/a/plugin.manifest.yml", false)
+	a.Equal(qplugin.PLUGIN_MANIFEST_VERSION, migrated["manifest_version"])
+	a.Equal("a.so", migrated["entry"])
+	a.NotContains(migrated, "go_native")
+
+	// up to date, nothing is written
+	fromVersion, err = qplugin.MigratePluginManifestFile(fs, "/a/plugin.manifest.yml")
+	a.NoError(err)
+	a.Equal(qplugin.PLUGIN_MANIFEST_VERSION, fromVersion)
+
+	comm.WriteFileTextP(fs, "/b/plugin.manifest.json", `{"kind": "tool", "name": "b", "version_major": 1}`)
+	fromVersion, err = qplugin.MigratePluginManifestFile(fs, "/b/plugin.manifest.json")
+	a.NoError(err)
+	a.Equal(1, fromVersion)
+	a.Contains(comm.ReadFileTextP(fs, "/b/plugin.manifest.json"), `"manifest_version": 2`)
+
+	// an invalid manifest is never written
+	invalid := `
+kind: tool
+name: "not valid"
+`
+	comm.WriteFileTextP(fs, "/c/plugin.manifest.yml", invalid)
+	_, err = qplugin.MigratePluginManifestFile(fs, "/c/plugin.manifest.yml")
+	a.ErrorContains(err, "manifest /c/plugin.manifest.yml")
+	a.Equal(invalid, comm.ReadFileTextP(fs, "/c/plugin.manifest.yml"))
+}
+
+func Test_PluginManifest_outdatedIsWarned(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger, logs := newFileLogger(t)
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: tool
+name: a
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.go", `
+	package plugin
+	`)
+	comm.WriteFileTextP(fs, "/plugins/b/plugin.manifest.yml", `
+manifest_version: 2
+kind: tool
+name: b
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/b/plugin.go", `
+	package plugin
+	`)
+
+	a.NotNil(qplugin.ResolveExternalPlugin(logger, fs, "/plugins/a"))
+	a.Contains(logs.String(), "plugin manifest format is deprecated")
+
+	logger, logs = newFileLogger(t)
+	a.NotNil(qplugin.ResolveExternalPlugin(logger, fs, "/plugins/b"))
+	a.NotContains(logs.String(), "plugin manifest format is deprecated")
+}
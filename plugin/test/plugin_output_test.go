@@ -0,0 +1,113 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// logFileT is the content of the log file, written as json lines
+type logFileT string
+
+func (me *logFileT) String() string {
+	b, _ := os.ReadFile(string(*me))
+	return string(b)
+}
+
+func newFileLogger(t *testing.T) (comm.Logger, *logFileT) {
+	f := logFileT(filepath.Join(t.TempDir(), "test.log"))
+	logger := comm.NewLoggerP(nil, &comm.LoggerConfigT{}, string(f))
+	t.Cleanup(logger.Close)
+	return logger, &f
+}
+
+func Test_PluginOutput_lines(t *testing.T) {
+	a := require.New(t)
+	logger, logs := newFileLogger(t)
+
+	out := qplugin.NewPluginOutput(qplugin.PLUGIN_OUTPUT_STDOUT, func() comm.Logger { return logger }, 4, 12)
+
+	n, err := out.Write([]byte("ab\ncd"))
+	a.NoError(err)
+	a.Equal(5, n)
+	a.Contains(logs.String(), "ab")
+	a.NotContains(logs.String(), "cd")
+
+	out.Write([]byte("efgh\n"))
+	a.Contains(logs.String(), "cdef")
+	a.Contains(logs.String(), "gh")
+	a.Contains(logs.String(), `"stream":"stdout"`)
+
+	// beyond the total limit
+	n, err = out.Write([]byte("ijklmn\n"))
+	a.NoError(err)
+	a.Equal(7, n)
+	a.Contains(logs.String(), "ij")
+	a.NotContains(logs.String(), "ijk")
+	a.Contains(logs.String(), "plugin output exceeds the limit")
+	a.Equal(int64(12), out.Total())
+
+	out.Write([]byte("ignored\n"))
+	out.Flush()
+	a.NotContains(logs.String(), "ignored")
+	a.Contains(logs.String(), `"dropped":13`)
+
+	// the limit is reset by Flush
+	a.Equal(int64(0), out.Total())
+	out.Write([]byte("more\n"))
+	a.Contains(logs.String(), "more")
+}
+
+func Test_ExternalGoPlugin_output(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger, logs := newFileLogger(t)
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import (
+		"fmt"
+		"io"
+		"os"
+	)
+
+	func PluginStart() {
+		fmt.Println("hello from stdout")
+		fmt.Fprintln(os.Stderr, "hello from stderr")
+		fmt.Print("pending")
+	}
+
+	func ReadStdin() string {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("read %d", len(b))
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	p.Init(logger, nil, fs, "/plugin.go")
+
+	a.NoError(p.Start(context.Background()))
+	a.Contains(logs.String(), "hello from stdout")
+	a.Contains(logs.String(), `"stream":"stdout"`)
+	a.Contains(logs.String(), "hello from stderr")
+	a.Contains(logs.String(), `"stream":"stderr"`)
+
+	// pending line is flushed at the end of each call
+	a.Contains(logs.String(), "pending")
+
+	r, err := qplugin.Call[string](context.Background(), p, "ReadStdin")
+	a.NoError(err)
+	a.Equal("read 0", r)
+
+	a.NoError(p.Stop(context.Background()))
+}
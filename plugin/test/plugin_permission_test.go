@@ -0,0 +1,349 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PluginPermission_denied(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import (
+		"os"
+		"os/exec"
+		. "syscall"
+	)
+
+	func Home() string {
+		return os.Getenv("HOME") + os.Getenv("PATH")
+	}
+
+	func Run() error {
+		return exec.Command("ls").Run()
+	}
+
+	func Pid() int {
+		return Getpid()
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{})
+
+	err := p.Compile(fs, "/plugin.go")
+	a.ErrorContains(err, "os.Getenv requires permission env")
+	a.ErrorContains(err, "os/exec.Command requires permission exec")
+	a.ErrorContains(err, "import syscall requires permission sys")
+
+	a.Panics(func() {
+		p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+	})
+}
+
+func Test_PluginPermission_granted(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	t.Setenv("QPLUGIN_TEST", "hello")
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import (
+		"os"
+		"strings"
+	)
+
+	func Env() string {
+		return strings.ToUpper(os.Getenv("QPLUGIN_TEST"))
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{qplugin.PLUGIN_PERMISSION_ENV})
+	a.NoError(p.Compile(fs, "/plugin.go"))
+
+	p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+	r, err := qplugin.Call[string](context.Background(), p, "Env")
+	a.NoError(err)
+	a.Equal("HELLO", r)
+}
+
+func Test_PluginPermission_namespaceCap(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	writePlugin := func(name string, permissions string) {
+		comm.WriteFileTextP(fs, "/plugins/local/"+name+"/plugin.manifest.yml", `
+kind: sandboxed
+name: `+name+`
+version_major: 1
+version_minor: 0
+permissions: `+permissions+`
+`)
+		comm.WriteFileTextP(fs, "/plugins/local/"+name+"/plugin.go", `
+	package plugin
+
+	func PluginStart() {}
+	`)
+	}
+	writePlugin("reader", "[fs.read]")
+	writePlugin("runner", "[fs.read, exec]")
+	writePlugin("unknown", "[everything]")
+
+	registry := qplugin.NewPluginRegistry(1, "sandboxed")
+	registry.SetPermissionCap("local", qplugin.PLUGIN_PERMISSION_FS_READ)
+	registry.Register(qplugin.NewLocalPluginLoader(logger, fs, "/plugins"))
+
+	// the rejected plugins are reported, the others are started anyway
+	err := registry.Init(logger)
+	a.Error(err)
+	a.Contains(err.Error(), "permission exec is beyond the cap")
+	a.Contains(err.Error(), "unknown permission everything")
+
+	a.NotNil(registry.ById("local/reader"))
+	a.Nil(registry.ById("local/runner"))
+	a.Nil(registry.ById("local/unknown"))
+
+	a.Equal([]qplugin.PluginPermission{qplugin.PLUGIN_PERMISSION_FS_READ}, registry.PermissionCap("local"))
+	a.Nil(registry.PermissionCap("remote"))
+}
+
+func Test_PluginPermission_missingPermissions(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: sandboxed
+name: a
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", `
+	package plugin
+
+	import "os"
+
+	func Home() string {
+		return os.Getenv("HOME")
+	}
+	`)
+
+	// without a cap, a plugin without permissions is unrestricted as before
+	registry := qplugin.NewPluginRegistry(1, "sandboxed")
+	report := qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, "/plugins/local", "local")
+	a.NoError(report.MayError())
+
+	// with a cap, it is granted nothing
+	registry.SetPermissionCap("local", qplugin.PLUGIN_PERMISSION_ENV)
+	report = qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, "/plugins/local", "local")
+	a.ErrorContains(report.MayError(), "os.Getenv requires permission env")
+}
+
+func Test_PluginPermission_validatePlugin(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: sandboxed
+name: a
+version_major: 1
+version_minor: 0
+permissions: [net.dial]
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", `
+	package plugin
+
+	import "net/http"
+
+	func Get() {
+		http.ListenAndServe(":80", nil)
+	}
+	`)
+
+	registry := qplugin.NewPluginRegistry(1, "sandboxed")
+	registry.SetPermissionCap("local")
+
+	report := qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, "/plugins/local", "local")
+	err := report.MayError()
+	a.ErrorContains(err, "permission net.dial is beyond the cap")
+	a.ErrorContains(err, "net/http.ListenAndServe requires permission net.listen")
+}
+
+func Test_PluginPermission_allowlist(t *testing.T) {
+	compile := func(imports string, body string, permissions []qplugin.PluginPermission) error {
+		fs := afero.NewMemMapFs()
+		comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import (
+		`+imports+`
+	)
+
+	func Do() {
+		`+body+`
+	}
+	`)
+
+		p := qplugin.NewExternalGoPluginContext()
+		p.SetPermissions(permissions)
+		return p.Compile(fs, "/plugin.go")
+	}
+
+	cases := []struct {
+		imports  string
+		body     string
+		expected string
+	}{
+		{`"text/template"`, `template.ParseFiles("/etc/hostname")`, "text/template.ParseFiles requires permission fs.read"},
+		{`"text/template"`, `template.ParseGlob("/etc/*")`, "text/template.ParseGlob requires permission fs.read"},
+		{`"html/template"`, `template.ParseFiles("/etc/hostname")`, "html/template.ParseFiles requires permission fs.read"},
+		{`"html/template"`, `template.ParseGlob("/etc/*")`, "html/template.ParseGlob requires permission fs.read"},
+		{`"text/template"`, `template.New("x")`, "text/template.New requires permission fs.read"},
+		{`"html/template"`, `var t template.Template; t.Parse("")`, "html/template.Template requires permission fs.read"},
+		{`"reflect"`, `reflect.ValueOf(1)`, "reflect.ValueOf requires permission sys"},
+		{`"go/parser"; "go/token"`, `parser.ParseFile(token.NewFileSet(), "/etc/hostname", nil, 0)`, "go/parser.ParseFile requires permission fs.read"},
+		{`"go/parser"; "go/token"`, `parser.ParseDir(token.NewFileSet(), "/etc", nil, 0)`, "go/parser.ParseDir requires permission fs.read"},
+		{`"debug/elf"`, `elf.Open("/bin/sh")`, "debug/elf.Open requires permission fs.read"},
+		{`"debug/macho"`, `macho.Open("/bin/sh")`, "debug/macho.Open requires permission fs.read"},
+		{`"debug/pe"`, `pe.Open("/bin/sh")`, "debug/pe.Open requires permission fs.read"},
+		{`"log"`, `log.Fatal("bye")`, "log.Fatal requires permission sys"},
+		{`"log"`, `log.Fatalf("bye")`, "log.Fatalf requires permission sys"},
+		{`"log"`, `log.Fatalln("bye")`, "log.Fatalln requires permission sys"},
+		{`"os"`, `os.Getpagesize(); os.Exit(1)`, "os.Exit requires permission sys"},
+		{`"expvar"`, `expvar.NewInt("x")`, "expvar.NewInt requires permission sys"},
+		{`. "runtime/debug"`, `SetGCPercent(1)`, "import runtime/debug requires permission sys"},
+	}
+	for _, c := range cases {
+		t.Run(c.expected, func(t *testing.T) {
+			a := require.New(t)
+			a.ErrorContains(compile(c.imports, c.body, []qplugin.PluginPermission{}), c.expected)
+		})
+	}
+
+	t.Run("granted", func(t *testing.T) {
+		a := require.New(t)
+		a.NoError(compile(`"text/template"`, `template.ParseFiles("/etc/hostname")`,
+			[]qplugin.PluginPermission{qplugin.PLUGIN_PERMISSION_FS_READ}))
+		a.NoError(compile(`"log"; "strings"`, `log.Println(strings.ToUpper("hi"))`, []qplugin.PluginPermission{}))
+	})
+}
+
+func Test_PluginPermission_methods(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugin.go", `
+	package plugin
+
+	import (
+		"log"
+		"os"
+	)
+
+	func Touch() {
+		f, _ := os.Open("/etc/hostname")
+		f.Chmod(0o777)
+		f.WriteString("x")
+		truncate := f.Truncate
+		truncate(0)
+		f.Read(nil)
+		log.New(os.Stderr, "", 0).Print("not a method to deny")
+	}
+	`)
+
+	p := qplugin.NewExternalGoPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{qplugin.PLUGIN_PERMISSION_FS_READ})
+
+	err := p.Compile(fs, "/plugin.go")
+	a.ErrorContains(err, "os.File.Chmod requires permission fs.write")
+	a.ErrorContains(err, "os.File.WriteString requires permission fs.write")
+	a.ErrorContains(err, "os.File.Truncate requires permission fs.write")
+	a.NotContains(err.Error(), "os.File.Read ")
+	a.NotContains(err.Error(), "log.Logger")
+
+	a.Panics(func() {
+		p.Init(comm.NewDiscardLogger(), nil, fs, "/plugin.go")
+	})
+
+	p = qplugin.NewExternalGoPluginContext()
+	p.SetPermissions([]qplugin.PluginPermission{qplugin.PLUGIN_PERMISSION_FS_READ, qplugin.PLUGIN_PERMISSION_FS_WRITE})
+	a.NoError(p.Compile(fs, "/plugin.go"))
+}
+
+func Test_PluginPermission_dynamicMethods(t *testing.T) {
+	compile := func(code string, permissions ...qplugin.PluginPermission) error {
+		fs := afero.NewMemMapFs()
+		comm.WriteFileTextP(fs, "/plugin.go", code)
+
+		p := qplugin.NewExternalGoPluginContext()
+		p.SetPermissions(append([]qplugin.PluginPermission{}, permissions...))
+		return p.Compile(fs, "/plugin.go")
+	}
+
+	t.Run("interface", func(t *testing.T) {
+		a := require.New(t)
+
+		err := compile(`
+	package plugin
+
+	import "text/template"
+
+	type pf interface {
+		ParseFiles(...string) (*template.Template, error)
+	}
+
+	func Read() {
+		var p pf = template.New("x")
+		p.ParseFiles("/etc/hostname")
+	}
+	`)
+		a.ErrorContains(err, "text/template.New requires permission fs.read")
+
+		err = compile(`
+	package plugin
+
+	import "os"
+
+	type chmoder interface {
+		Chmod(os.FileMode) error
+	}
+
+	func Touch() {
+		f, _ := os.Open("/etc/hostname")
+		var c chmoder = f
+		c.Chmod(0o777)
+	}
+	`, qplugin.PLUGIN_PERMISSION_FS_READ)
+		a.ErrorContains(err, "os.File.Chmod (through plugin.chmoder) requires permission fs.write")
+	})
+
+	t.Run("reflect", func(t *testing.T) {
+		a := require.New(t)
+
+		err := compile(`
+	package plugin
+
+	import (
+		"os"
+		"reflect"
+	)
+
+	func Touch() {
+		f, _ := os.Open("/etc/hostname")
+		reflect.ValueOf(f).MethodByName("Chmod").Call([]reflect.Value{reflect.ValueOf(os.FileMode(0o777))})
+	}
+	`, qplugin.PLUGIN_PERMISSION_FS_READ)
+		a.ErrorContains(err, "reflect.ValueOf requires permission sys")
+	})
+}
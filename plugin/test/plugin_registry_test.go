@@ -0,0 +1,208 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/yaegi/interp"
+)
+
+func Test_PluginRegistry_fsPluginLoader(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.manifest.yml", `
+kind: hosts
+name: PluginA
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/a/plugin.go", "package plugin")
+
+	// unsupported kind
+	comm.WriteFileTextP(fs, "/plugins/local/b/plugin.manifest.yml", `
+kind: unknown
+name: PluginB
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/local/b/plugin.go", "package plugin")
+
+	loader := qplugin.NewLocalPluginLoader(logger, fs, "/plugins")
+
+	registry := qplugin.NewPluginRegistry(1, "hosts")
+	registry.Register(loader)
+
+	err := registry.Init(logger)
+	a.Error(err)
+	a.Contains(err.Error(), "unsupported plugin kind")
+
+	hosts := registry.ByKind("hosts")
+	a.Len(hosts, 1)
+	pa := hosts["local/plugina"]
+	a.NotNil(pa)
+	a.True(pa.(qplugin.ExternalPlugin).IsStarted())
+
+	a.Equal(pa, registry.ById("local/plugina"))
+	a.Equal(pa, registry.ByName("hosts", "plugina"))
+
+	a.Empty(registry.ByKind("unknown"))
+	a.Len(loader.Plugins(), 1)
+
+	registry.Destroy(logger)
+	a.False(pa.(qplugin.ExternalPlugin).IsStarted())
+}
+
+func newShadowTestRegistry(events *[]string, shadowPolicy qplugin.PluginShadowPolicy) qplugin.PluginRegistry {
+	remote := qplugin.NewPluginLoader("remote")
+	remote.Register(newTestPlugin("foo", events))
+
+	local := qplugin.NewPluginLoader("local")
+	local.Register(newTestPlugin("foo", events))
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	registry.SetShadowPolicy(shadowPolicy, "local", "remote")
+	registry.Register(remote)
+	registry.Register(local)
+	return registry
+}
+
+func Test_PluginRegistry_shadowReject(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+	events := []string{}
+
+	registry := newShadowTestRegistry(&events, qplugin.PLUGIN_SHADOW_REJECT)
+
+	err := registry.Init(logger)
+	a.Error(err)
+	a.Contains(err.Error(), "remote/foo has duplicated kind tool with local/foo")
+
+	a.Len(registry.ByKind("tool"), 1)
+	a.NotNil(registry.ById("local/foo"))
+	a.Nil(registry.ById("remote/foo"))
+	a.Equal([]string{"start foo"}, events)
+}
+
+func Test_PluginRegistry_shadowOverride(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+	events := []string{}
+
+	registry := newShadowTestRegistry(&events, qplugin.PLUGIN_SHADOW_OVERRIDE)
+
+	a.NoError(registry.Init(logger))
+
+	a.Len(registry.ByKind("tool"), 1)
+	local := registry.ById("local/foo")
+	a.NotNil(local)
+	a.Nil(registry.ById("remote/foo"))
+	a.Same(local, registry.ByName("tool", "foo"))
+	a.Equal([]string{"start foo"}, events)
+}
+
+func Test_PluginRegistry_shadowCoexist(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+	events := []string{}
+
+	registry := newShadowTestRegistry(&events, qplugin.PLUGIN_SHADOW_COEXIST)
+
+	a.NoError(registry.Init(logger))
+
+	a.Len(registry.ByKind("tool"), 2)
+	local := registry.ById("local/foo")
+	a.NotNil(local)
+	a.NotNil(registry.ById("remote/foo"))
+	a.Same(local, registry.ByName("tool", "foo"))
+	a.Equal([]string{"start foo", "start foo"}, events)
+}
+
+func Test_PluginRegistry_lookupFromPluginStart(t *testing.T) {
+	a := require.New(t)
+	logger := comm.NewDiscardLogger()
+	events := []string{}
+
+	pa := newTestPlugin("a", &events)
+	pb := newTestPlugin("b", &events)
+
+	loader := qplugin.NewPluginLoader("local")
+	loader.Register(pa)
+	loader.Register(pb)
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	registry.Register(loader)
+
+	var found qplugin.Plugin
+	pa.onStart = func() {
+		// must not deadlock
+		found = registry.ById("local/b")
+		a.True(registry.HasNamespace("local"))
+	}
+
+	a.NoError(registry.Init(logger))
+	a.Same(pb, found)
+
+	snapshot := registry.Snapshot()
+	a.Len(snapshot.Plugins(), 2)
+
+	registry.Destroy(logger)
+
+	// published snapshot is immutable
+	a.Len(snapshot.Plugins(), 2)
+	a.Empty(registry.Snapshot().Plugins())
+}
+
+func Test_PluginRegistry_codeRunsOnlyOnceAccepted(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+	logger := comm.NewDiscardLogger()
+
+	loaded := []string{}
+	qplugin.RegisterHostExports(interp.Exports{
+		"qplugintest/loaded/loaded": {
+			"Loaded": reflect.ValueOf(func(dir string) { loaded = append(loaded, dir) }),
+		},
+	})
+
+	writePlugin := func(dir string, kind string) {
+		comm.WriteFileTextP(fs, dir+"/plugin.manifest.yml", `
+kind: `+kind+`
+name: foo
+version_major: 1
+version_minor: 0
+`)
+		comm.WriteFileTextP(fs, dir+"/plugin.go", `
+	package plugin
+
+	import "qplugintest/loaded"
+
+	func init() {
+		loaded.Loaded("`+dir+`")
+	}
+	`)
+	}
+	writePlugin("/plugins/local/foo", "tool")
+	writePlugin("/plugins/remote/foo", "tool")
+	writePlugin("/plugins/other/foo", "unknown")
+
+	registry := qplugin.NewPluginRegistry(1, "tool")
+	registry.SetShadowPolicy(qplugin.PLUGIN_SHADOW_OVERRIDE, "local", "remote", "other")
+	registry.Register(qplugin.NewLocalPluginLoader(logger, fs, "/plugins"))
+	registry.Register(qplugin.NewRemotePluginLoader(logger, fs, "/plugins"))
+	registry.Register(qplugin.NewFsPluginLoader(logger, fs, "/plugins", "other"))
+
+	err := registry.Init(logger)
+	a.Error(err)
+	a.Contains(err.Error(), "unsupported plugin kind")
+
+	// neither the shadowed nor the rejected one is loaded
+	a.Equal([]string{"/plugins/local/foo"}, loaded)
+	a.NotNil(registry.ById("local/foo"))
+	a.Nil(registry.ById("remote/foo"))
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/fastgh/go-comm/v2"
+	qplugin "github.com/qiangyt/qbase-go/plugin"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ValidatePluginTree_happy(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: hosts
+name: PluginA
+version_major: 1
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.go", `
+	package plugin
+
+	func PluginStart() {
+		panic("must not be executed")
+	}
+	`)
+
+	registry := qplugin.NewPluginRegistry(1, "hosts")
+	report := qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, "/plugins", "local")
+
+	a.False(report.HasError())
+	a.NoError(report.MayError())
+	a.Len(report.Plugins(), 1)
+	a.Equal("plugina", report.Plugins()[0].Name())
+	a.False(report.Plugins()[0].IsStarted())
+}
+
+func Test_ValidatePluginTree_reportAllProblems(t *testing.T) {
+	a := require.New(t)
+	fs := afero.NewMemMapFs()
+
+	// wrong major version, and compile error
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.manifest.yml", `
+kind: hosts
+name: PluginA
+version_major: 2
+version_minor: 0
+`)
+	comm.WriteFileTextP(fs, "/plugins/a/plugin.go", "nothing")
+
+	// no plugin.go
+	comm.WriteFileTextP(fs, "/plugins/b/plugin.manifest.yml", `
+kind: hosts
+name: PluginB
+version_major: 1
+version_minor: 0
+`)
+
+	// unknown manifest field
+	comm.WriteFileTextP(fs, "/plugins/c/plugin.manifest.yml", `
+kind: hosts
+name: PluginC
+whatever: 1
+`)
+	comm.WriteFileTextP(fs, "/plugins/c/plugin.go", "package plugin")
+
+	registry := qplugin.NewPluginRegistry(1, "hosts")
+	report := qplugin.ValidatePluginTree(comm.NewDiscardLogger(), registry, fs, "/plugins", "local")
+
+	a.True(report.HasError())
+	a.Empty(report.Plugins())
+
+	diagnostics := report.Diagnostics()
+	a.Len(diagnostics, 4)
+	a.Equal("/plugins/a", diagnostics[0].Path)
+	a.Contains(diagnostics[0].Error(), "major version")
+	a.Equal("/plugins/a", diagnostics[1].Path)
+	a.Contains(diagnostics[1].Error(), "compile")
+	a.Equal("/plugins/b", diagnostics[2].Path)
+	a.Contains(diagnostics[2].Error(), "code file not found")
+	a.Equal("/plugins/c", diagnostics[3].Path)
+	a.Contains(diagnostics[3].Error(), "whatever")
+}
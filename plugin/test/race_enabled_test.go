@@ -0,0 +1,6 @@
+//go:build race
+
+package test
+
+// raceEnabled tells the test binary is built with -race, so are the go native plugins it loads
+const raceEnabled = true
@@ -0,0 +1,9 @@
+package main
+
+import "strings"
+
+func Upper(s string) string {
+	return strings.ToUpper(s)
+}
+
+func main() {}
@@ -0,0 +1,43 @@
+;; source of plugin.wasm, see the go:generate directives in external_wasm_plugin_test.go
+(module
+  (import "qplugin" "log" (func $log (param i32 i32 i32)))
+  (import "qplugin" "config_get" (func $config_get (param i32 i32 i32 i32) (result i32)))
+  (import "qplugin" "call_host" (func $call_host (param i32 i32 i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 0) "started")
+  (data (i32.const 16) "greeting")
+  (data (i32.const 32) "echo")
+  (data (i32.const 48) "[1,2]")
+
+  (func (export "plugin_start") (result i32)
+    (call $log (i32.const 1) (i32.const 0) (i32.const 7))
+    (i32.const 0))
+
+  (func (export "plugin_stop") (result i32)
+    (i32.const 2))
+
+  (func (export "add") (param i64 i64) (result i64)
+    (i64.add (local.get 0) (local.get 1)))
+
+  ;; logs the greeting config, returns its length
+  (func (export "greeting") (result i32) (local i32)
+    (local.set 0 (call $config_get (i32.const 16) (i32.const 8) (i32.const 256) (i32.const 64)))
+    (call $log (i32.const 2) (i32.const 256) (local.get 0))
+    (local.get 0))
+
+  ;; logs the result of the echo host function, returns its length
+  (func (export "echo") (result i32) (local i32)
+    (local.set 0 (call $call_host (i32.const 32) (i32.const 4) (i32.const 48) (i32.const 5) (i32.const 512) (i32.const 64)))
+    (call $log (i32.const 1) (i32.const 512) (local.get 0))
+    (local.get 0))
+
+  (func (export "loop")
+    (loop $l (br $l)))
+
+  ;; returns the previous size in pages, or -1 if beyond the limit
+  (func (export "grow") (param i32) (result i32)
+    (memory.grow (local.get 0)))
+
+  (func (export "trap")
+    (unreachable))
+)
@@ -0,0 +1,4 @@
+;; source of wasi.wasm, which only imports WASI; see the go:generate directives in external_wasm_plugin_test.go
+(module
+  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+)
@@ -2,6 +2,7 @@ package qplugin
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/fastgh/go-comm/v2"
 	"github.com/pkg/errors"
@@ -11,6 +12,29 @@ func PluginId(namespace string, name string) string {
 	return fmt.Sprintf("%s/%s", namespace, name)
 }
 
+// panicToError converts the recovered value to error
+func panicToError(p any) error {
+	if err, isErr := p.(error); isErr {
+		return err
+	}
+	return fmt.Errorf("%+v", p)
+}
+
+// sortedPlugins returns the plugins in the order of their names
+func sortedPlugins(plugins map[string]Plugin) []Plugin {
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r := make([]Plugin, 0, len(names))
+	for _, name := range names {
+		r = append(r, plugins[name])
+	}
+	return r
+}
+
 func StartPlugin(namespace string, plugin Plugin, logger comm.Logger) (err error) {
 	major, minor := plugin.Version()
 	ver := fmt.Sprintf("%d/%d", major, minor)